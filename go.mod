@@ -2,13 +2,16 @@ module github.com/MatthewTully/simple-chat-server
 
 go 1.23.0
 
+require (
+	github.com/gdamore/tcell/v2 v2.7.1
+	github.com/joho/godotenv v1.5.1
+	github.com/rivo/tview v0.0.0-20241103174730-c76f7879f592
+)
+
 require (
 	github.com/gdamore/encoding v1.0.0 // indirect
-	github.com/gdamore/tcell/v2 v2.7.1 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/mattn/go-runewidth v0.0.15 // indirect
-	github.com/rivo/tview v0.0.0-20241103174730-c76f7879f592 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
 	golang.org/x/sys v0.17.0 // indirect
 	golang.org/x/term v0.17.0 // indirect
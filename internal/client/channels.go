@@ -0,0 +1,130 @@
+package client
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/MatthewTully/simple-chat-server/internal/encoding"
+)
+
+// CurrentChannel is the channel messages typed in the chat box are sent to.
+func (c *Client) CurrentChannel() string {
+	c.channelsMu.Lock()
+	defer c.channelsMu.Unlock()
+	return c.currentChannel
+}
+
+func (c *Client) SetCurrentChannel(channel string) {
+	c.channelsMu.Lock()
+	c.currentChannel = channel
+	c.channelsMu.Unlock()
+	c.ShowActiveUsers()
+}
+
+// GetChannelMembers returns the members of a joined channel.
+func (c *Client) GetChannelMembers(channel string) []string {
+	c.channelsMu.Lock()
+	defer c.channelsMu.Unlock()
+	return c.channels[channel]
+}
+
+// JoinedChannels returns the channels the client is in, sorted.
+func (c *Client) JoinedChannels() []string {
+	c.channelsMu.Lock()
+	defer c.channelsMu.Unlock()
+	joined := make([]string, 0, len(c.channels))
+	for channel := range c.channels {
+		joined = append(joined, channel)
+	}
+	sort.Strings(joined)
+	return joined
+}
+
+func (c *Client) resetChannels() {
+	c.channelsMu.Lock()
+	defer c.channelsMu.Unlock()
+	c.channels = make(map[string][]string)
+	c.history = make(map[string]*channelHistory)
+	c.currentChannel = ""
+}
+
+// ActionChannelMembers updates the members of a channel. The server sends
+// the list when anyone joins or leaves, so a list that adds this client means
+// it has joined the channel, and one without it means it has left.
+func (c *Client) ActionChannelMembers(channel string, data []byte) {
+	members, err := encoding.DecodeChannelMembers(data)
+	if err != nil {
+		c.cfg.Logger.Println(err)
+		return
+	}
+
+	c.channelsMu.Lock()
+	_, wasMember := c.channels[channel]
+	isMember := slices.Contains(members, c.cfg.Username)
+	if isMember {
+		c.channels[channel] = members
+	} else {
+		delete(c.channels, channel)
+		delete(c.history, channel)
+	}
+	if isMember && !wasMember {
+		c.history[channel] = &channelHistory{}
+	}
+	switchTo := c.currentChannel
+	if isMember && !wasMember {
+		switchTo = channel
+	}
+	if !isMember && c.currentChannel == channel {
+		switchTo = ""
+		if _, ok := c.channels[encoding.DefaultChannel]; ok {
+			switchTo = encoding.DefaultChannel
+		} else {
+			for joined := range c.channels {
+				switchTo = joined
+				break
+			}
+		}
+	}
+	c.channelsMu.Unlock()
+
+	if isMember && !wasMember {
+		c.PushToChatView(fmt.Sprintf("Joined %v", channel))
+	}
+	if !isMember && wasMember {
+		c.PushToChatView(fmt.Sprintf("Left %v", channel))
+	}
+	if switchTo != c.CurrentChannel() {
+		if switchTo == "" {
+			c.PushToChatView("You are not in any channel. Use \\join #name to join one.")
+		} else {
+			c.PushToChatView(fmt.Sprintf("Now talking in %v", switchTo))
+		}
+	}
+	c.SetCurrentChannel(switchTo)
+}
+
+func (c *Client) ShowChannelList(data []byte) {
+	channels, err := encoding.DecodeChannelList(data)
+	if err != nil {
+		c.cfg.Logger.Println(err)
+		return
+	}
+	current := c.CurrentChannel()
+	joined := c.JoinedChannels()
+	c.PushToChatView("Channels:")
+	for _, ch := range channels {
+		status := ""
+		if ch.Name == current {
+			status = " [green](current)[white]"
+		} else if slices.Contains(joined, ch.Name) {
+			status = " (joined)"
+		}
+		c.PushToChatView(fmt.Sprintf("  %v - %d member(s)%s", ch.Name, ch.Members, status))
+	}
+}
+
+func (c *Client) sendChannelRequest(messageType encoding.MessageType, channel string) error {
+	toSend := encoding.PrepChannelPacketsForSending([]byte{}, messageType, channel, c.cfg.Username, c.cfg.UserColour)
+	return c.SendPackets(toSend)
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MatthewTully/simple-chat-server/internal/encoding"
+)
+
+const (
+	timestampFormat = "02/01/06 15:04"
+	// defaultHistoryPageSize is how many older records are loaded at a time.
+	defaultHistoryPageSize = 50
+)
+
+var errNoOlderHistory = errors.New("no older messages")
+
+// channelHistory is how far back a joined channel's history has been loaded.
+type channelHistory struct {
+	oldest  uint64
+	more    bool
+	loading bool
+}
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(timestampFormat)
+}
+
+// formatChatRecord renders a record for the chat view. Notices from the
+// server are shown as they are, messages with their time and sender.
+func formatChatRecord(record encoding.ChatRecord) string {
+	if record.Type == encoding.RecordNotice {
+		return string(record.Body)
+	}
+	return fmt.Sprintf("[white]%v[white] [%s]%v ~[white] %s", formatTimestamp(record.Sent), record.Colour, record.Sender, record.Body)
+}
+
+// formatChannelRecord is formatChatRecord, marked with the channel if that is
+// not the current one.
+func (c *Client) formatChannelRecord(channel string, record encoding.ChatRecord) string {
+	out := formatChatRecord(record)
+	if channel != "" && channel != c.CurrentChannel() {
+		out = fmt.Sprintf("[grey]%v[white] %s", channel, out)
+	}
+	return out
+}
+
+func (c *Client) ShowChatRecord(channel string, record encoding.ChatRecord) {
+	c.channelsMu.Lock()
+	if h, ok := c.history[channel]; ok && h.oldest == 0 {
+		h.oldest = record.ID
+	}
+	c.channelsMu.Unlock()
+	c.chatView.Write([]byte(c.formatChannelRecord(channel, record)))
+}
+
+// ShowHistoryPage writes a page of a channel's history. The latest page, sent
+// on joining, is added to the end of the chat log, and older pages the user
+// asked for to the start.
+func (c *Client) ShowHistoryPage(channel string, data []byte) {
+	page, err := encoding.DecodeHistoryPage(data)
+	if err != nil {
+		c.cfg.Logger.Println(err)
+		return
+	}
+	c.channelsMu.Lock()
+	h, joined := c.history[channel]
+	if joined {
+		h.loading = false
+		h.more = page.More
+		if len(page.Records) > 0 {
+			h.oldest = page.Records[0].ID
+		}
+	}
+	c.channelsMu.Unlock()
+	if !joined {
+		return
+	}
+
+	if page.Before == 0 {
+		if len(page.Records) == 0 {
+			return
+		}
+		c.PushToChatView(fmt.Sprintf("--- %v History ---", channel))
+		for _, record := range page.Records {
+			c.chatView.Write([]byte(formatChatRecord(record)))
+		}
+		c.PushToChatView("\n--- New Messages ---")
+		return
+	}
+
+	if len(page.Records) == 0 {
+		c.PushToChatView(fmt.Sprintf("No older messages in %v", channel))
+		return
+	}
+	var older strings.Builder
+	older.WriteString(fmt.Sprintf("--- Older %v messages ---\n", channel))
+	for _, record := range page.Records {
+		older.WriteString(c.formatChannelRecord(channel, record))
+	}
+	// Raise the line limit by the lines loaded, or the chat log would drop
+	// its oldest lines, which are the ones just loaded.
+	c.chatMaxLines += strings.Count(older.String(), "\n")
+	c.chatView.SetMaxLines(c.chatMaxLines)
+	c.chatView.SetText(older.String() + c.chatView.GetText(false))
+	c.chatView.ScrollToBeginning()
+}
+
+// RequestOlderHistory asks the server for up to limit records of the channel
+// older than those already shown.
+func (c *Client) RequestOlderHistory(channel string, limit int) error {
+	c.channelsMu.Lock()
+	h, joined := c.history[channel]
+	if !joined {
+		c.channelsMu.Unlock()
+		return fmt.Errorf("not in %v", channel)
+	}
+	if h.loading {
+		c.channelsMu.Unlock()
+		return nil
+	}
+	if !h.more {
+		c.channelsMu.Unlock()
+		return errNoOlderHistory
+	}
+	h.loading = true
+	before := h.oldest
+	c.channelsMu.Unlock()
+
+	data, err := encoding.EncodeHistoryRequest(encoding.HistoryRequestPayload{Before: before, Limit: limit})
+	if err == nil {
+		toSend := encoding.PrepChannelPacketsForSending(data, encoding.HistoryRequest, channel, c.cfg.Username, c.cfg.UserColour)
+		err = c.SendPackets(toSend)
+	}
+	if err != nil {
+		c.channelsMu.Lock()
+		h.loading = false
+		c.channelsMu.Unlock()
+	}
+	return err
+}
+
+// loadHistoryAtTop loads older history for the current channel once the chat
+// log is scrolled to the top.
+func (c *Client) loadHistoryAtTop() {
+	channel := c.CurrentChannel()
+	if row, _ := c.chatView.GetScrollOffset(); row > 0 || c.ActiveConn == nil || channel == "" {
+		return
+	}
+	err := c.RequestOlderHistory(channel, defaultHistoryPageSize)
+	if err != nil && !errors.Is(err, errNoOlderHistory) {
+		c.cfg.Logger.Printf("could not load %v history: %v", channel, err)
+	}
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MatthewTully/simple-chat-server/internal/encoding"
+	"github.com/rivo/tview"
+)
+
+func TestOlderHistoryRaisesLineLimit(t *testing.T) {
+	c := &Client{
+		chatView:       tview.NewTextView(),
+		chatMaxLines:   chatLogMaxLines,
+		currentChannel: encoding.DefaultChannel,
+		history:        map[string]*channelHistory{encoding.DefaultChannel: {oldest: 10, more: true}},
+	}
+	records := []encoding.ChatRecord{}
+	for i := range 3 {
+		records = append(records, encoding.ChatRecord{
+			ID:     uint64(i + 1),
+			Type:   encoding.RecordMessage,
+			Sent:   time.Now(),
+			Sender: "alice",
+			Body:   []byte("older message\n"),
+		})
+	}
+	data, err := encoding.EncodeHistoryPage(encoding.HistoryPagePayload{Before: 10, Records: records, More: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	c.ShowHistoryPage(encoding.DefaultChannel, data)
+	loaded := strings.Count(c.chatView.GetText(false), "\n")
+	if loaded < len(records) {
+		t.Fatalf("Expected the %d records to be shown, Got %q", len(records), c.chatView.GetText(false))
+	}
+	if c.chatMaxLines != chatLogMaxLines+loaded {
+		t.Errorf("Expected the line limit to be raised by the %d lines loaded to %d, Got %d", loaded, chatLogMaxLines+loaded, c.chatMaxLines)
+	}
+
+	c.clearChatView()
+	if c.chatMaxLines != chatLogMaxLines {
+		t.Errorf("Expected clearing the chat log to put back the limit of %d, Got %d", chatLogMaxLines, c.chatMaxLines)
+	}
+}
@@ -2,8 +2,10 @@ package client
 
 import (
 	"crypto/rsa"
+	"crypto/tls"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/MatthewTully/simple-chat-server/internal/crypto"
@@ -13,51 +15,69 @@ import (
 )
 
 type ClientConfig struct {
-	Username      string `json:"username"`
-	UserColour    string `json:"user_colour"`
-	Logger        *log.Logger
-	RSAKeyPair    crypto.RSAKeys
-	ClientAESKey  []byte
-	KeepAlivePing time.Duration
+	Username       string `json:"username"`
+	UserColour     string `json:"user_colour"`
+	Logger         *log.Logger
+	RSAKeyPair     crypto.RSAKeys
+	KeepAlivePing  time.Duration
+	KnownHostsPath string `json:"-"`
+	KeyPath        string `json:"-"`
+	// VerifiedUsersPath is where users marked as verified with \verify are
+	// saved.
+	VerifiedUsersPath string `json:"-"`
+	// TLSConfig is set to connect over TLS. TLSOnly offers to turn off the
+	// app-layer encryption on TLS connections.
+	TLSConfig *tls.Config `json:"-"`
+	TLSOnly   bool        `json:"-"`
 }
 
 type Client struct {
-	cfg             *ClientConfig
-	ActiveConn      net.Conn
-	Host            bool
-	HostServer      *server.Server
-	ServerAESKey    []byte
-	ServerPubKey    *rsa.PublicKey
+	cfg            *ClientConfig
+	ActiveConn     net.Conn
+	frameReader    *encoding.FrameReader
+	frameWriter    *encoding.FrameWriter
+	Host           bool
+	HostServer     *server.Server
+	session        *crypto.Session
+	ServerAddr     string
+	ServerPubKey   *rsa.PublicKey
+	ServerKeyPrint string
+	newServerKey   bool
+	changedHostKey knownHost
+	// changedHostArg is the \connect argument that found the changed key,
+	// so \trust reconnects with the same password or invite.
+	changedHostArg  string
+	ProtocolVersion uint16
+	Capabilities    encoding.Capability
 	processChannel  chan []byte
 	LastCommand     string
 	TUI             *tview.Application
 	chatView        *tview.TextView
+	chatMaxLines    int
 	activeUsersView *tview.TextView
-	multiMessages   map[int]encoding.MsgProtocol
+	reassembler     *encoding.Reassembler
+	activeUsers     map[string]encoding.ActiveUser
+	activeUsersMu   sync.Mutex
+	currentChannel  string
+	channels        map[string][]string
+	history         map[string]*channelHistory
+	channelsMu      sync.Mutex
 	userCmdArg      string
 	tuiPages        *tview.Pages
 	userInputBox    *tview.InputField
 	KeepAliveTimer  *time.Ticker
 }
 
+// NewClient loads the client's key pair from cfg.KeyPath, creating it on
+// first run. Servers tie the username to this key, so it must persist.
 func NewClient(cfg *ClientConfig) Client {
-	priv, pub, err := crypto.GenerateRSAKeyPair()
+	keys, err := crypto.LoadOrGenerateRSAKeyPair(cfg.KeyPath)
 	if err != nil {
-		cfg.Logger.Fatalf("could not generate key RSA pair for client: %v", err)
+		cfg.Logger.Fatalf("could not load RSA key pair for client: %v", err)
 	}
-	cfg.RSAKeyPair = crypto.RSAKeys{
-		PrivateKey: priv,
-		PublicKey:  pub,
-	}
-
-	aesKey, err := crypto.GenerateAESSecretKey()
-	if err != nil {
-		cfg.Logger.Fatalf("could not generate AES key for client: %v", err)
-	}
-	cfg.ClientAESKey = aesKey
+	cfg.RSAKeyPair = keys
 
 	return Client{
-		cfg:           cfg,
-		multiMessages: make(map[int]encoding.MsgProtocol),
+		cfg: cfg,
 	}
 }
@@ -1,10 +1,15 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"maps"
-	"os"
+	"slices"
+	"strconv"
 	"strings"
+
+	"github.com/MatthewTully/simple-chat-server/internal/crypto"
+	"github.com/MatthewTully/simple-chat-server/internal/encoding"
 )
 
 type userCommand struct {
@@ -30,11 +35,41 @@ func getUserCommands() map[string]userCommand {
 			description: "Close the application",
 			callback:    exitApplication,
 		},
+		"\\join": {
+			name:        "\\join",
+			description: "Join a channel, or switch to it if already joined",
+			callback:    joinChannel,
+		},
+		"\\leave": {
+			name:        "\\leave",
+			description: "Leave a channel, the current one if none is given",
+			callback:    leaveChannel,
+		},
+		"\\channels": {
+			name:        "\\channels",
+			description: "List the channels on the server",
+			callback:    listChannels,
+		},
+		"\\history": {
+			name:        "\\history",
+			description: "Load older messages of the current channel, optionally how many",
+			callback:    loadHistory,
+		},
 		"\\list-user-commands": {
 			name:        "\\list-user-commands",
 			description: "List available commands",
 			callback:    listUserCommands,
 		},
+		"\\trust": {
+			name:        "\\trust",
+			description: "Trust the changed key of the last server and reconnect",
+			callback:    trustChangedServerKey,
+		},
+		"\\verify": {
+			name:        "\\verify",
+			description: "Show the safety number to compare with a user, or mark them verified with confirm",
+			callback:    verifyUser,
+		},
 		"\\whisper": {
 			name:        "\\whisper",
 			description: "Send a message directly to a user",
@@ -55,41 +90,124 @@ func getHostCommands() map[string]userCommand {
 			description: "Disconnect user and add their IP to the blacklist",
 			callback:    banUser,
 		},
+		"\\invite": {
+			name:        "\\invite",
+			description: "Create an invite token, optionally with a number of uses and how long it lasts",
+			callback:    createInvite,
+		},
+		"\\invites": {
+			name:        "\\invites",
+			description: "List invites and their status, or revoke one with revoke {token}",
+			callback:    listInvites,
+		},
+		"\\queues": {
+			name:        "\\queues",
+			description: "Show how many messages are waiting to be sent to each user",
+			callback:    listQueues,
+		},
 	}
 }
 
 func kickUser(c *Client) {
-	if !c.Host {
+	if !c.IsAdmin() {
 		return
 	}
-	usr := c.userCmdArg
+	usr := strings.TrimSpace(c.userCmdArg)
 	if usr == c.cfg.Username {
 		c.PushToChatView("Cannot kick yourself")
 		return
 	}
-	c.PushToChatView(fmt.Sprintf("Kicking %v", usr))
 	c.cfg.Logger.Printf("Kicking Usr %v", usr)
-	c.HostServer.CloseConnectionForUser(usr)
+	c.sendAdminCommand("kick", usr)
 }
 
 func banUser(c *Client) {
-	if !c.Host {
+	if !c.IsAdmin() {
 		return
 	}
-	usr := c.userCmdArg
+	usr := strings.TrimSpace(c.userCmdArg)
 	if usr == c.cfg.Username {
 		c.PushToChatView("Cannot ban yourself")
 		return
 	}
-	c.HostServer.BanUser(usr)
+	c.sendAdminCommand("ban", usr)
+}
+
+func createInvite(c *Client) {
+	if !c.IsAdmin() {
+		return
+	}
+	c.sendAdminCommand("invite", strings.Fields(c.userCmdArg)...)
+}
+
+func listInvites(c *Client) {
+	if !c.IsAdmin() {
+		return
+	}
+	action, token, _ := strings.Cut(c.userCmdArg, " ")
+	if action == "revoke" {
+		c.sendAdminCommand("revoke", strings.TrimSpace(token))
+		return
+	}
+	c.sendAdminCommand("invites")
+}
+
+func listQueues(c *Client) {
+	if !c.IsAdmin() {
+		return
+	}
+	c.sendAdminCommand("queues")
 }
 
 func connectToServer(c *Client) {
-	srvAddr := c.userCmdArg
+	srvAddr, password, _ := strings.Cut(c.userCmdArg, " ")
+	srvAddr, invite, _ := strings.Cut(srvAddr, "#")
 	c.PushToChatView(fmt.Sprintf("Attempting to connect to %v", srvAddr))
-	c.Connect(srvAddr)
+	err := c.Connect(srvAddr, encoding.AuthPayload{Password: password, Invite: invite})
+	if err != nil {
+		if errors.Is(err, ErrPasswordRequired) {
+			c.PushToChatView(fmt.Sprintf("%v requires a password", srvAddr))
+			c.promptForPassword(srvAddr)
+			return
+		}
+		if errors.Is(err, ErrHostKeyChanged) {
+			c.changedHostArg = c.userCmdArg
+			c.PushToChatView("[red]WARNING: THE SERVER KEY HAS CHANGED![white]")
+			c.PushToChatView(fmt.Sprintf("[red]%v[white]", err))
+			c.PushToChatView("[red]Someone could be intercepting your connection. If you are sure the server changed its key, use \\trust to accept it.[white]")
+			return
+		}
+		c.PushToChatView(fmt.Sprintf("[red]Could not connect to %v: %v[white]", srvAddr, err))
+		return
+	}
 	c.tuiPages.HidePage("home-page")
-	c.PushToChatView(fmt.Sprintf("Successfully connected to %v\n", srvAddr))
+	c.PushToChatView(fmt.Sprintf("Successfully connected to %v", srvAddr))
+	if c.newServerKey {
+		c.PushToChatView(fmt.Sprintf("[yellow]WARNING: first connection to %v, its key has not been verified.[white]", srvAddr))
+		c.PushToChatView(fmt.Sprintf("[yellow]Server key fingerprint is %v. Check it with the server owner, it will be pinned for future connections.[white]", c.ServerKeyPrint))
+	}
+	c.PushToChatView(fmt.Sprintf("Using protocol version %d (capabilities: %v)\n", c.ProtocolVersion, c.Capabilities))
+}
+
+func trustChangedServerKey(c *Client) {
+	changed := c.changedHostKey
+	if changed.addr == "" {
+		c.PushToChatView("No changed server key to trust")
+		return
+	}
+	err := c.TrustServerKey(changed.addr, changed.fingerprint)
+	if err != nil {
+		c.PushToChatView(fmt.Sprintf("[red]Could not trust key: %v[white]", err))
+		return
+	}
+	c.changedHostKey = knownHost{}
+	c.PushToChatView(fmt.Sprintf("Now trusting key %v for %v", changed.fingerprint, changed.addr))
+	c.userCmdArg = c.changedHostArg
+	if c.userCmdArg == "" {
+		c.userCmdArg = changed.addr
+	}
+	c.changedHostArg = ""
+	connectToServer(c)
 }
 
 func disconnectFromServer(c *Client) {
@@ -102,7 +220,7 @@ func disconnectFromServer(c *Client) {
 	c.SendDisconnectionRequest()
 	c.ActiveConn.Close()
 	c.PushToChatView("Successfully disconnected.")
-	c.chatView.Clear()
+	c.clearChatView()
 	c.activeUsersView.Clear()
 	c.showHomePage()
 }
@@ -112,11 +230,10 @@ func exitApplication(c *Client) {
 	disconnectFromServer(c)
 	c.PushToChatView("Closing application")
 	c.TUI.Stop()
-	os.Exit(0)
 }
 
 func listUserCommands(c *Client) {
-	if c.Host {
+	if c.IsAdmin() {
 		c.tuiPages.ShowPage("host-user-commands")
 		return
 	}
@@ -128,17 +245,163 @@ func whisperMsgToUser(c *Client) {
 		c.PushToChatView("No active connections")
 		return
 	}
-	msg := c.userCmdArg
-	if len(msg) > 0 {
-		msg := msg + "\n"
-		c.SendWhisperToServer([]byte(msg))
-		c.PushSentMessageToChatView(msg)
+	if !c.Capabilities.Has(encoding.CapWhisper) {
+		c.PushToChatView("Whispers are not supported by this server")
+		return
+	}
+	to, msg, found := strings.Cut(c.userCmdArg, " ")
+	if !found || len(msg) == 0 {
+		c.PushToChatView("Usage: \\whisper { username } { message }")
+		return
+	}
+	msg = msg + "\n"
+	err := c.SendWhisperToServer(to, []byte(msg))
+	if err != nil {
+		c.PushToChatView(fmt.Sprintf("[red]Could not whisper to %v: %v[white]", to, err))
+		return
+	}
+	c.PushSentMessageToChatView(fmt.Sprintf("[::i](whispered to %v)[::-] %s", to, msg))
+}
+
+func joinChannel(c *Client) {
+	if c.ActiveConn == nil {
+		c.PushToChatView("No active connections")
+		return
+	}
+	channel := strings.TrimSpace(c.userCmdArg)
+	err := encoding.ValidChannelName(channel)
+	if err != nil {
+		c.PushToChatView(fmt.Sprintf("[red]%v[white]", err))
+		return
+	}
+	if slices.Contains(c.JoinedChannels(), channel) {
+		c.SetCurrentChannel(channel)
+		c.PushToChatView(fmt.Sprintf("Now talking in %v", channel))
+		return
+	}
+	err = c.sendChannelRequest(encoding.JoinChannel, channel)
+	if err != nil {
+		c.PushToChatView(fmt.Sprintf("[red]Could not join %v: %v[white]", channel, err))
+	}
+}
+
+func leaveChannel(c *Client) {
+	if c.ActiveConn == nil {
+		c.PushToChatView("No active connections")
+		return
+	}
+	channel := strings.TrimSpace(c.userCmdArg)
+	if channel == "" {
+		channel = c.CurrentChannel()
+	}
+	if !slices.Contains(c.JoinedChannels(), channel) {
+		c.PushToChatView(fmt.Sprintf("You are not in %v", channel))
+		return
+	}
+	err := c.sendChannelRequest(encoding.LeaveChannel, channel)
+	if err != nil {
+		c.PushToChatView(fmt.Sprintf("[red]Could not leave %v: %v[white]", channel, err))
+	}
+}
+
+func listChannels(c *Client) {
+	if c.ActiveConn == nil {
+		c.PushToChatView("No active connections")
+		return
+	}
+	err := c.sendChannelRequest(encoding.ChannelList, "")
+	if err != nil {
+		c.PushToChatView(fmt.Sprintf("[red]Could not list channels: %v[white]", err))
+	}
+}
+
+func loadHistory(c *Client) {
+	if c.ActiveConn == nil {
+		c.PushToChatView("No active connections")
+		return
+	}
+	limit := defaultHistoryPageSize
+	if arg := strings.TrimSpace(c.userCmdArg); arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			c.PushToChatView("Usage: \\history { number of messages }")
+			return
+		}
+		limit = min(n, encoding.MaxHistoryPageSize)
+	}
+	channel := c.CurrentChannel()
+	if channel == "" {
+		c.PushToChatView("You are not in any channel. Use \\join #name to join one.")
+		return
+	}
+	err := c.RequestOlderHistory(channel, limit)
+	if errors.Is(err, errNoOlderHistory) {
+		c.PushToChatView(fmt.Sprintf("No older messages in %v", channel))
+		return
+	}
+	if err != nil {
+		c.PushToChatView(fmt.Sprintf("[red]Could not load history: %v[white]", err))
+	}
+}
+
+func verifyUser(c *Client) {
+	if c.ActiveConn == nil {
+		c.PushToChatView("No active connections")
+		return
+	}
+	username, confirm := strings.CutSuffix(strings.TrimSpace(c.userCmdArg), " confirm")
+	if username == "" {
+		c.PushToChatView("Usage: \\verify {username}, then \\verify {username} confirm once the numbers match")
+		return
+	}
+	if username == c.cfg.Username {
+		c.PushToChatView("Cannot verify yourself")
+		return
+	}
+	usr, ok := c.GetActiveUser(username)
+	if !ok {
+		c.PushToChatView(fmt.Sprintf("%v is not connected", username))
+		return
+	}
+	key, err := crypto.BytesToRSAPublicKey(usr.PublicKey)
+	if err != nil {
+		c.PushToChatView(fmt.Sprintf("[red]Invalid key for %v: %v[white]", username, err))
+		return
 	}
+	vu, err := LoadVerifiedUsers(c.cfg.VerifiedUsersPath)
+	if err != nil {
+		c.PushToChatView(fmt.Sprintf("[red]%v[white]", err))
+		return
+	}
+	fingerprint := activeUserFingerprint(usr)
+
+	if confirm {
+		err = vu.Verify(c.ServerAddr, username, fingerprint)
+		if err != nil {
+			c.PushToChatView(fmt.Sprintf("[red]Could not verify %v: %v[white]", username, err))
+			return
+		}
+		c.PushToChatView(fmt.Sprintf("[green]%v is now verified.[white] You will be warned if their key changes.", username))
+		c.ShowActiveUsers()
+		return
+	}
+
+	number, err := crypto.SafetyNumber(c.cfg.RSAKeyPair.PublicKey, key)
+	if err != nil {
+		c.PushToChatView(fmt.Sprintf("[red]Could not create safety number: %v[white]", err))
+		return
+	}
+	c.PushToChatView(fmt.Sprintf("Safety number with %v: [::b]%v[::-]", username, number))
+	if vu.Status(c.ServerAddr, username, fingerprint) == verified {
+		c.PushToChatView(fmt.Sprintf("%v is already verified.", username))
+		return
+	}
+	c.PushToChatView(fmt.Sprintf("Compare it with %v in person or over a call. If it matches, use \\verify %v confirm.", username, username))
 }
 
 func actionInput(c *Client, usrInput string) {
 	usrCmdMap := getUserCommands()
-	if c.Host {
+	if c.IsAdmin() {
 		maps.Copy(usrCmdMap, getHostCommands())
 	}
 	inputArgs := strings.Fields((usrInput))
@@ -161,6 +424,10 @@ func actionInput(c *Client, usrInput string) {
 		c.PushToChatView("No active connections")
 		return
 	}
+	if c.CurrentChannel() == "" {
+		c.PushToChatView("You are not in any channel. Use \\join #name to join one.")
+		return
+	}
 
 	err := c.SendMessageToServer([]byte(usrInput))
 	if err != nil {
@@ -1,6 +1,9 @@
 package client
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
 
 	"github.com/MatthewTully/simple-chat-server/internal/crypto"
@@ -8,60 +11,162 @@ import (
 	"github.com/MatthewTully/simple-chat-server/internal/server"
 )
 
-func (c *Client) Connect(srvAddr string) error {
-	conn, err := net.Dial("tcp", srvAddr)
+var ErrPasswordRequired = errors.New("server requires a password")
+
+// Connect connects to the server at srvAddr. The password or invite is only
+// sent if the server asks for one, and ErrPasswordRequired is returned if
+// neither is set.
+func (c *Client) Connect(srvAddr string, auth encoding.AuthPayload) error {
+	var conn net.Conn
+	var err error
+	capabilities := encoding.SupportedCapabilities &^ encoding.CapTLSOnly
+	if c.cfg.TLSConfig != nil {
+		conn, err = tls.Dial("tcp", srvAddr, c.cfg.TLSConfig)
+		if c.cfg.TLSOnly {
+			capabilities |= encoding.CapTLSOnly
+		}
+	} else {
+		conn, err = net.Dial("tcp", srvAddr)
+	}
 	if err != nil {
 		c.cfg.Logger.Printf("Could not connect to %v: %v\n", srvAddr, err)
 		return err
 	}
 
-	err = c.SendHandshake(conn)
+	fr := encoding.NewFrameReader(conn)
+	fw := encoding.NewFrameWriter(conn)
+
+	err = c.SendHandshake(fw, capabilities)
 	if err != nil {
 		conn.Close()
 		return err
 	}
-	res, err := c.AwaitHandshakeResponse(conn)
+	res, err := c.AwaitHandshakeResponse(fr)
 	if err != nil {
 		conn.Close()
 		return err
 	}
-	key, err := crypto.BytesToRSAPublicKey(res.Data[:res.MsgSize])
+	key, err := crypto.BytesToRSAPublicKey(res.PublicKey)
 	if err != nil {
 		conn.Close()
 		return err
 	}
-	c.ServerPubKey = key
-
-	err = c.SendAESKey(conn)
+	newHost, err := c.CheckServerKey(srvAddr, key)
 	if err != nil {
 		conn.Close()
 		return err
 	}
+	c.ServerPubKey = key
+	c.ProtocolVersion = res.MaxVersion
+	// Never accept a capability that was not offered, such as dropping the
+	// app-layer encryption.
+	c.Capabilities = res.Capabilities & capabilities
+	if res.PasswordRequired && auth.Password == "" && auth.Invite == "" {
+		conn.Close()
+		return ErrPasswordRequired
+	}
 
-	aes, err := c.AwaitServerKey(conn)
+	keys, err := c.ExchangeSessionKeys(fr, fw)
 	if err != nil {
 		conn.Close()
 		return err
 	}
-	c.ServerAESKey = aes
+	// Only pin the key once the server has proven it holds the private half.
+	c.newServerKey = newHost
+	if newHost {
+		err = c.TrustServerKey(srvAddr, c.ServerKeyPrint)
+		if err != nil {
+			c.cfg.Logger.Println(err)
+		}
+	}
+	if c.Capabilities.Has(encoding.CapTLSOnly) {
+		c.session = crypto.NewPlaintextSession()
+	} else {
+		c.session = crypto.NewSession(keys, false)
+	}
+	if res.PasswordRequired {
+		err = c.Authenticate(fr, fw, auth)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	c.ServerAddr = srvAddr
+	c.resetChannels()
 	c.ActiveConn = conn
+	c.frameReader = fr
+	c.frameWriter = fw
+	c.reassembler = encoding.NewReassembler(encoding.DefaultReassemblyTimeout, encoding.DefaultMaxPendingBytes)
 	go c.ProcessMessage()
 	return nil
 }
 
-func (c *Client) SendDisconnectionRequest() {
-	toSend, err := encoding.PrepBytesForSending([]byte{}, encoding.RequestDisconnect, c.cfg.Username, c.cfg.UserColour, c.cfg.ClientAESKey)
+// Authenticate sends the server password or invite as the first message over
+// the encrypted channel, and waits for the server to accept it.
+func (c *Client) Authenticate(fr *encoding.FrameReader, fw *encoding.FrameWriter, auth encoding.AuthPayload) error {
+	data, err := encoding.EncodeAuth(auth)
+	if err != nil {
+		return err
+	}
+	toSend := encoding.PrepPacketsForSending(data, encoding.Authenticate, c.cfg.Username, c.cfg.UserColour)
+	err = fw.WriteSealedFrames(c.session.Encrypt, toSend...)
+	if err != nil {
+		return fmt.Errorf("failed to send password to server: %v", err)
+	}
+
+	frame, err := fr.ReadFrame()
 	if err != nil {
-		c.cfg.Logger.Printf("error creating packet to send: %v", err)
+		return fmt.Errorf("no response to password from server: %v", err)
 	}
-	c.cfg.Logger.Printf("SendDisconnectionRequest: len %v\n", len(toSend))
-	_, err = c.ActiveConn.Write(toSend)
+	decPayload, err := c.session.Decrypt(frame)
+	if err != nil {
+		return fmt.Errorf("error decrypting response to password: %v", err)
+	}
+	p, err := encoding.DecodeMsgPacket(decPayload)
+	if err != nil {
+		return err
+	}
+	switch p.MessageType {
+	case encoding.Authenticate:
+		return nil
+	case encoding.ErrorMessage:
+		return fmt.Errorf("%s", p.Data)
+	}
+	return fmt.Errorf("unexpected %v in response to password", p.MessageType)
+}
+
+func (c *Client) SendDisconnectionRequest() {
+	toSend := encoding.PrepPacketsForSending([]byte{}, encoding.RequestDisconnect, c.cfg.Username, c.cfg.UserColour)
+	c.cfg.Logger.Printf("SendDisconnectionRequest: frames %v\n", len(toSend))
+	err := c.SendPackets(toSend)
 	if err != nil {
 		c.cfg.Logger.Printf("failed to send to server %s: %v", c.ActiveConn.RemoteAddr().String(), err)
 	}
 }
 
+// SendPackets encrypts the packets and writes them under the frame writer's
+// lock, so their sequence numbers reach the server in order.
+func (c *Client) SendPackets(packets [][]byte) error {
+	return c.frameWriter.WriteSealedFrames(c.session.Encrypt, packets...)
+}
+
 func (c *Client) SetAsHost(srv *server.Server) {
 	c.Host = true
 	c.HostServer = srv
 }
+
+// IsAdmin reports whether the server lets this client send admin commands.
+func (c *Client) IsAdmin() bool {
+	return c.ActiveConn != nil && c.Capabilities.Has(encoding.CapAdmin)
+}
+
+func (c *Client) sendAdminCommand(command string, args ...string) {
+	data, err := encoding.EncodeAdminCommand(encoding.AdminCommandPayload{Command: command, Args: args})
+	if err == nil {
+		toSend := encoding.PrepPacketsForSending(data, encoding.AdminCommand, c.cfg.Username, c.cfg.UserColour)
+		err = c.SendPackets(toSend)
+	}
+	if err != nil {
+		c.PushToChatView(fmt.Sprintf("[red]Could not send %v command: %v[white]", command, err))
+	}
+}
@@ -1,120 +1,228 @@
 package client
 
 import (
-	"bytes"
-	"encoding/binary"
+	"crypto/ecdh"
+	"crypto/rsa"
+	"errors"
 	"fmt"
-	"net"
 
 	"github.com/MatthewTully/simple-chat-server/internal/crypto"
 	"github.com/MatthewTully/simple-chat-server/internal/encoding"
 )
 
-func (c *Client) SendHandshake(conn net.Conn) error {
+func (c *Client) SendHandshake(fw *encoding.FrameWriter, capabilities encoding.Capability) error {
 	pubKeyBytes, err := crypto.RSAPublicKeyToBytes(c.cfg.RSAKeyPair.PublicKey)
 	if err != nil {
 		c.cfg.Logger.Printf("%v", err)
 		return err
 	}
-	handshake, err := encoding.PrepHandshakeForSending(pubKeyBytes, c.cfg.Username, c.cfg.UserColour)
+	handshake, err := encoding.PrepHandshakeForSending(encoding.HandshakeProtocol{
+		MessageType:  encoding.RequestConnect,
+		MinVersion:   encoding.MinProtocolVersion,
+		MaxVersion:   encoding.MaxProtocolVersion,
+		Capabilities: capabilities,
+		Username:     c.cfg.Username,
+		UserColour:   c.cfg.UserColour,
+		PublicKey:    pubKeyBytes,
+	})
 	if err != nil {
 		return fmt.Errorf("error creating packet to send: %v", err)
 	}
 	c.cfg.Logger.Printf("SendHandshake: len %v\n", len(handshake))
-	_, err = conn.Write(handshake)
+	err = fw.WriteFrame(handshake)
 	if err != nil {
-		c.cfg.Logger.Printf("failed to send to server %s: %v\n", conn.RemoteAddr().String(), err)
-		return fmt.Errorf("failed to send to server %s: %v", conn.RemoteAddr().String(), err)
+		c.cfg.Logger.Printf("failed to send handshake to server: %v\n", err)
+		return fmt.Errorf("failed to send handshake to server: %v", err)
 	}
 	return nil
 }
 
-func (c *Client) SendAESKey(conn net.Conn) error {
-	packet, err := encoding.PrepAESForSending(c.cfg.ClientAESKey, c.ServerPubKey, c.cfg.RSAKeyPair)
+func (c *Client) SendKeyExchange(fw *encoding.FrameWriter, eph *ecdh.PrivateKey, serverEph []byte) error {
+	ephBytes := eph.PublicKey().Bytes()
+	sig, err := crypto.RSASign(crypto.ClientKeyExchangeData(serverEph, ephBytes, c.cfg.Username), c.cfg.RSAKeyPair.PrivateKey)
 	if err != nil {
-		return fmt.Errorf("failed to prepare AES Packet to send to server %s: %v", c.ActiveConn.RemoteAddr().String(), err)
+		return fmt.Errorf("failed to sign key exchange: %v", err)
 	}
-	c.cfg.Logger.Printf("SendAESKey: len %v\n", len(packet))
-	c.cfg.Logger.Printf("SendAESKey: packet %v\n", packet)
-	_, err = conn.Write(packet)
+	packet, err := encoding.PrepHandshakeForSending(encoding.HandshakeProtocol{
+		MessageType:  encoding.KeyExchange,
+		Username:     c.cfg.Username,
+		UserColour:   c.cfg.UserColour,
+		EphemeralKey: ephBytes,
+		Signature:    sig,
+	})
 	if err != nil {
-		c.cfg.Logger.Printf("failed to send to server %s: %v\n", conn.RemoteAddr().String(), err)
-		return fmt.Errorf("failed to send to server %s: %v", conn.RemoteAddr().String(), err)
+		return fmt.Errorf("failed to prepare key exchange to send to server: %v", err)
+	}
+	c.cfg.Logger.Printf("SendKeyExchange: len %v\n", len(packet))
+	err = fw.WriteFrame(packet)
+	if err != nil {
+		c.cfg.Logger.Printf("failed to send key exchange to server: %v\n", err)
+		return fmt.Errorf("failed to send key exchange to server: %v", err)
 	}
 	return nil
 }
 
-func (c *Client) AwaitHandshakeResponse(conn net.Conn) (encoding.MsgProtocol, error) {
+func (c *Client) AwaitHandshakeResponse(fr *encoding.FrameReader) (encoding.HandshakeProtocol, error) {
 	for {
-		buf := make([]byte, encoding.MaxPacketSize)
-		nr, err := conn.Read(buf)
+		frame, err := fr.ReadFrame()
 		if err != nil {
 			if err.Error() != "EOF" {
 				c.cfg.Logger.Printf("error reading from conn: %v\n", err)
 			}
-			return encoding.MsgProtocol{}, err
+			return encoding.HandshakeProtocol{}, err
 		}
-		if nr == 0 {
-			continue
-		}
-		data := buf[0:nr]
 
-		sd := bytes.Split(data, encoding.HeaderPattern[:])
-		if len(sd) == 0 {
-			return encoding.MsgProtocol{}, fmt.Errorf("incorrect Message length")
+		dataPacket, err := encoding.DecodeHandshakePacket(frame)
+		if err != nil {
+			return encoding.HandshakeProtocol{}, err
 		}
-		packetLen := binary.BigEndian.Uint16(sd[1][4:])
-		packet := sd[1][encoding.HeaderSize : packetLen+encoding.HeaderSize]
-		buffer := bytes.NewBuffer(packet)
-		dataPacket := encoding.DecodeMsgPacket(buffer)
-		if dataPacket.MessageType == encoding.RequestConnect {
+		switch dataPacket.MessageType {
+		case encoding.ErrorMessage:
+			return encoding.HandshakeProtocol{}, fmt.Errorf("%s", dataPacket.Error)
+		case encoding.RequestConnect:
+			if dataPacket.MaxVersion < encoding.MinProtocolVersion || dataPacket.MaxVersion > encoding.MaxProtocolVersion {
+				return encoding.HandshakeProtocol{}, fmt.Errorf("%w %d selected by server, supported versions are %v", encoding.ErrUnsupportedVersion, dataPacket.MaxVersion, encoding.VersionRange(encoding.MinProtocolVersion, encoding.MaxProtocolVersion))
+			}
 			c.cfg.Logger.Print("handshake complete")
 			return dataPacket, nil
 		}
 	}
 }
 
-func (c *Client) AwaitServerKey(conn net.Conn) ([]byte, error) {
+func (c *Client) AwaitKeyExchange(fr *encoding.FrameReader) ([]byte, error) {
+	cliPubBytes, err := crypto.RSAPublicKeyToBytes(c.cfg.RSAKeyPair.PublicKey)
+	if err != nil {
+		return nil, err
+	}
 	for {
-		buf := make([]byte, encoding.MaxPacketSize)
-		nr, err := conn.Read(buf)
+		frame, err := fr.ReadFrame()
 		if err != nil {
 			if err.Error() != "EOF" {
 				c.cfg.Logger.Printf("error reading from conn: %v\n", err)
 			}
 			return nil, err
 		}
-		if nr == 0 {
-			continue
+
+		dataPacket, err := encoding.DecodeHandshakePacket(frame)
+		if err != nil {
+			return nil, err
 		}
-		data := buf[0:nr]
-		c.cfg.Logger.Printf("nr=%v\n", nr)
-		c.cfg.Logger.Printf("data=%v\n", data)
-		sd := bytes.Split(data, encoding.HeaderPattern[:])
-		if len(sd) == 0 {
-			return nil, fmt.Errorf("incorrect Message length")
+		switch dataPacket.MessageType {
+		case encoding.ErrorMessage:
+			return nil, fmt.Errorf("%s", dataPacket.Error)
+		case encoding.KeyExchange:
+			err = crypto.RSAVerify(crypto.ServerKeyExchangeData(dataPacket.EphemeralKey, cliPubBytes), dataPacket.Signature, c.ServerPubKey)
+			if err != nil {
+				c.cfg.Logger.Printf("error verifying key exchange: %v", err)
+				return nil, fmt.Errorf("server key exchange signature is not valid")
+			}
+			c.cfg.Logger.Print("Key exchange received")
+			return dataPacket.EphemeralKey, nil
+		}
+	}
+}
+
+// ExchangeSessionKeys runs an ephemeral X25519 exchange with the server, see
+// server.ExchangeSessionKeys.
+func (c *Client) ExchangeSessionKeys(fr *encoding.FrameReader, fw *encoding.FrameWriter) (crypto.SessionKeys, error) {
+	serverEph, err := c.AwaitKeyExchange(fr)
+	if err != nil {
+		return crypto.SessionKeys{}, err
+	}
+	eph, err := crypto.GenerateX25519Key()
+	if err != nil {
+		return crypto.SessionKeys{}, fmt.Errorf("could not generate ephemeral key: %v", err)
+	}
+	err = c.SendKeyExchange(fw, eph, serverEph)
+	if err != nil {
+		return crypto.SessionKeys{}, err
+	}
+	return crypto.DeriveSessionKeys(eph, serverEph, serverEph, eph.PublicKey().Bytes())
+}
+
+// CheckServerKey checks the server's key against the fingerprint pinned for
+// the address in known hosts. It returns true if the server has not been
+// seen before. When hosting, the key must be the one of the local server.
+func (c *Client) CheckServerKey(srvAddr string, key *rsa.PublicKey) (bool, error) {
+	fingerprint, err := crypto.RSAPublicKeyFingerprint(key)
+	if err != nil {
+		return false, err
+	}
+	c.ServerKeyPrint = fingerprint
+
+	if c.Host && c.HostServer != nil {
+		if !c.HostServer.PublicKey().Equal(key) {
+			return false, fmt.Errorf("%w: key does not match the hosted server", ErrHostKeyChanged)
 		}
-		encPacket := sd[1]
-		packetLen := binary.BigEndian.Uint16(encPacket[4:])
+		return false, nil
+	}
 
-		payload := encPacket[encoding.HeaderSize : packetLen+encoding.HeaderSize]
-		buffer := bytes.NewBuffer(payload)
-		dataPacket := encoding.DecodeAESPacket(buffer)
+	kh, err := LoadKnownHosts(c.cfg.KnownHostsPath)
+	if err != nil {
+		return false, err
+	}
+	newHost, err := kh.Check(srvAddr, fingerprint)
+	if errors.Is(err, ErrHostKeyChanged) {
+		c.changedHostKey = knownHost{addr: srvAddr, fingerprint: fingerprint}
+	}
+	return newHost, err
+}
 
-		decPayload, err := crypto.RSADecrypt(dataPacket.Data[:dataPacket.MsgSize], c.cfg.RSAKeyPair.PrivateKey)
+func (c *Client) TrustServerKey(srvAddr, fingerprint string) error {
+	kh, err := LoadKnownHosts(c.cfg.KnownHostsPath)
+	if err != nil {
+		return err
+	}
+	return kh.Trust(srvAddr, fingerprint)
+}
+
+// StartRekey asks the server to run a fresh key exchange over the encrypted
+// channel, see crypto.Session.
+func (c *Client) StartRekey() {
+	eph, err := c.session.StartRekey()
+	if err != nil {
+		c.cfg.Logger.Printf("could not start rekey: %v", err)
+		return
+	}
+	c.cfg.Logger.Print("Starting rekey")
+	c.sendRekey(encoding.RekeyPayload{Phase: encoding.RekeyRequest, EphemeralKey: eph})
+}
+
+func (c *Client) ActionRekey(data []byte) {
+	rekey, err := encoding.DecodeRekey(data)
+	if err != nil {
+		c.cfg.Logger.Println(err)
+		return
+	}
+	switch rekey.Phase {
+	case encoding.RekeyRequest:
+		eph, err := c.session.RespondToRekey(rekey.EphemeralKey)
 		if err != nil {
-			c.cfg.Logger.Printf("error Decrypting payload: %v", err)
-			return nil, err
+			c.cfg.Logger.Printf("ignoring rekey request: %v", err)
+			return
 		}
-		err = crypto.RSAVerify(decPayload, dataPacket.Sig[:dataPacket.SigSize], c.ServerPubKey)
+		c.sendRekey(encoding.RekeyPayload{Phase: encoding.RekeyResponse, EphemeralKey: eph})
+	case encoding.RekeyResponse:
+		err = c.session.CompleteRekey(rekey.EphemeralKey)
 		if err != nil {
-			c.cfg.Logger.Printf("error verifying payload: %v", err)
-			return nil, err
+			c.cfg.Logger.Printf("could not complete rekey: %v", err)
+			return
 		}
+		c.sendRekey(encoding.RekeyPayload{Phase: encoding.RekeyDone})
+		c.cfg.Logger.Print("Rekey complete")
+	case encoding.RekeyDone:
+		c.cfg.Logger.Print("Rekey complete")
+	}
+}
 
-		if dataPacket.MessageType == encoding.SendAESKey {
-			c.cfg.Logger.Print("AES Key Received complete")
-			return decPayload, nil
-		}
+func (c *Client) sendRekey(rekey encoding.RekeyPayload) {
+	data, err := encoding.EncodeRekey(rekey)
+	if err != nil {
+		c.cfg.Logger.Println(err)
+		return
+	}
+	err = c.SendPackets(encoding.PrepPacketsForSending(data, encoding.Rekey, c.cfg.Username, c.cfg.UserColour))
+	if err != nil {
+		c.cfg.Logger.Printf("failed to send rekey to server: %v", err)
 	}
 }
@@ -1,9 +1,11 @@
 package client
 
 import (
-	"bytes"
-	"encoding/binary"
+	"crypto/rsa"
+	"errors"
 	"fmt"
+	"io"
+	"sort"
 	"strings"
 	"time"
 
@@ -16,23 +18,48 @@ func (c *Client) ActionMessageType(p encoding.MsgProtocol, data []byte) {
 	case encoding.Message:
 		c.cfg.Logger.Printf("Message type received: Message\n")
 		c.chatView.Write(data)
+	case encoding.ChatMessage:
+		c.cfg.Logger.Printf("Message type received: Chat Message\n")
+		record, err := encoding.DecodeChatRecord(data)
+		if err != nil {
+			c.cfg.Logger.Println(err)
+			return
+		}
+		c.ShowChatRecord(p.Channel, record)
+	case encoding.HistoryPage:
+		c.cfg.Logger.Printf("Message type received: History Page\n")
+		c.ShowHistoryPage(p.Channel, data)
 	case encoding.ErrorMessage:
 		c.cfg.Logger.Printf("Message type received: Error Message\n")
 		msg := []byte("[red]Error: ")
 		msg = append(msg, data...)
 		msg = append(msg, []byte("[white]")...)
 		c.chatView.Write(msg)
+	case encoding.Rekey:
+		c.cfg.Logger.Printf("Message type received: Rekey\n")
+		c.ActionRekey(data)
+	case encoding.WhisperMessage:
+		c.cfg.Logger.Printf("Message type received: Whisper\n")
+		c.ShowWhisper(p, data)
 	case encoding.ServerActiveUsers:
 		c.cfg.Logger.Printf("Message type received: Active Users\n")
-		c.activeUsersView.Clear()
-		activeUsr := strings.Split(string(data), ";")
-		for _, usr := range activeUsr {
-			c.activeUsersView.Write([]byte(usr + "\n"))
+		activeUsers, err := encoding.DecodeActiveUsers(data)
+		if err != nil {
+			c.cfg.Logger.Println(err)
+			return
 		}
+		c.SetActiveUsers(activeUsers)
+		c.ShowActiveUsers()
+	case encoding.ChannelMembers:
+		c.cfg.Logger.Printf("Message type received: Channel Members\n")
+		c.ActionChannelMembers(p.Channel, data)
+	case encoding.ChannelList:
+		c.cfg.Logger.Printf("Message type received: Channel List\n")
+		c.ShowChannelList(data)
 	case encoding.RequestDisconnect:
 		c.cfg.Logger.Printf("Message type received: Request Disconnect\n")
 		c.ActiveConn.Close()
-		c.chatView.Clear()
+		c.clearChatView()
 		c.PushToChatView("You have been disconnected.")
 		c.activeUsersView.Clear()
 		c.KeepAliveTimer.Stop()
@@ -45,111 +72,46 @@ func (c *Client) ProcessMessage() {
 	c.processChannel = make(chan []byte)
 	ticker := time.NewTicker(c.cfg.KeepAlivePing)
 	c.KeepAliveTimer = ticker
-	overFlow := []byte{}
-	var data []byte
 	go c.AwaitMessage()
 	for {
 		select {
 		case <-ticker.C:
 			//keep alive
 			c.SendKeepAlive()
-		case buf := <-c.processChannel:
-			nr := len(buf)
-			c.cfg.Logger.Printf("in chan, Buf read = %v\n", buf)
-			if len(overFlow) > 0 {
-				c.cfg.Logger.Printf("Using overflow\n")
-				data = append(overFlow, buf[0:nr]...)
-				overFlow = []byte{}
-				c.cfg.Logger.Printf("data with overflow and buf = %v\n", data)
-			} else {
-				data = buf[0:nr]
+			if c.session.NeedsRekey(time.Now()) {
+				c.StartRekey()
+			}
+		case frame := <-c.processChannel:
+			decPayload, err := c.session.Decrypt(frame)
+			if errors.Is(err, crypto.ErrOutOfOrderFrame) {
+				// TCP keeps frames in order, so a frame has been dropped or
+				// injected and the sequence can't be recovered.
+				c.cfg.Logger.Printf("SECURITY: closing connection, frame from server out of sequence: %v", err)
+				c.PushToChatView("[red]A message from the server arrived out of sequence, so the connection has been closed.[white]")
+				c.ActiveConn.Close()
+				continue
+			}
+			if errors.Is(err, crypto.ErrReplayedFrame) {
+				c.cfg.Logger.Printf("SECURITY: rejected frame from server: %v", err)
+				continue
+			}
+			if err != nil {
+				c.cfg.Logger.Printf("error Decrypting payload: %v", err)
+				continue
 			}
 
-			sd := bytes.Split(data, encoding.HeaderPattern[:])
-
-			for i, p := range sd {
-				c.cfg.Logger.Printf("%v: %v\n", i, p)
-				switch {
-				case i == 0 && len(p) > 0:
-					c.cfg.Logger.Println("tail end of the previous message. add to overflow")
-					overFlow = append(overFlow, p...)
-					continue
-				case i == 1:
-					if len(p) < encoding.AESEncryptHeaderSize {
-						c.cfg.Logger.Printf("packet is not the full message. add to overflow\n")
-						overFlow = append(overFlow, encoding.HeaderPattern[:]...)
-						overFlow = append(overFlow, p...)
-						continue
-					}
-					c.cfg.Logger.Printf("decode header\n")
-
-					payloadSize := binary.BigEndian.Uint16(p[0:])
-
-					if len(p) < int(payloadSize) {
-						c.cfg.Logger.Printf("packet is not the full message. add to overflow\n")
-						overFlow = append(overFlow, encoding.HeaderPattern[:]...)
-						overFlow = append(overFlow, p...)
-						continue
-					}
-					payload := p[encoding.AESEncryptHeaderSize : payloadSize+encoding.AESEncryptHeaderSize]
-
-					if (payloadSize + encoding.AESEncryptHeaderSize) > uint16(nr) {
-						c.cfg.Logger.Printf("add remaining bytes to overflow for next read: %v\n", p[payloadSize+encoding.AESEncryptHeaderSize:])
-						overFlow = p[payloadSize+encoding.AESEncryptHeaderSize:]
-						overFlow = append(overFlow, p[payloadSize+encoding.AESEncryptHeaderSize:]...)
-					}
-
-					decPayload, err := crypto.AESDecrypt(payload, c.ServerAESKey)
-					if err != nil {
-						c.cfg.Logger.Printf("error Decrypting payload: %v", err)
-						continue
-					}
-
-					packetNum := binary.BigEndian.Uint16(decPayload[0:])
-					numPackets := binary.BigEndian.Uint16(decPayload[2:])
-					packetLen := binary.BigEndian.Uint16(decPayload[4:])
-
-					if len(decPayload) < int(packetLen) {
-						c.cfg.Logger.Printf("error, decrypted payload is not the full message")
-						continue
-					}
-					packet := decPayload[encoding.HeaderSize : packetLen+encoding.HeaderSize]
-
-					buffer := bytes.NewBuffer(packet)
-					dataPacket := encoding.DecodeMsgPacket(buffer)
-					if numPackets == 1 {
-						c.ActionMessageType(dataPacket, dataPacket.Data[:dataPacket.MsgSize])
-					} else {
-						c.multiMessages[int(packetNum)] = dataPacket
-						if len(c.multiMessages) == int(numPackets) {
-							newProtocol := encoding.MsgProtocol{}
-							mergedData := []byte{}
-							for i := 1; i <= int(numPackets); i++ {
-								msg := c.multiMessages[i]
-								if i == 1 {
-									newProtocol.MessageType = msg.MessageType
-									newProtocol.Username = msg.Username
-									newProtocol.UsernameSize = msg.UsernameSize
-									newProtocol.UserColour = msg.UserColour
-									newProtocol.UserColourSize = msg.UserColourSize
-									newProtocol.DateTime = msg.DateTime
-								}
-								mergedData = append(mergedData, msg.Data[:msg.MsgSize]...)
-							}
-							c.multiMessages = make(map[int]encoding.MsgProtocol)
-							c.ActionMessageType(newProtocol, mergedData)
-						}
-					}
-					continue
-				case i > 1:
-					c.cfg.Logger.Printf("add extra bytes to overflow for next read: %v\n", p[:])
-					overFlow = append(overFlow, encoding.HeaderPattern[:]...)
-					overFlow = append(overFlow, p...)
-					continue
-				default:
-					continue
-				}
-
+			dataPacket, err := encoding.DecodeMsgPacket(decPayload)
+			if err != nil {
+				c.cfg.Logger.Printf("error decoding packet: %v", err)
+				continue
+			}
+			msg, complete, err := c.reassembler.Add(dataPacket, time.Now())
+			if err != nil {
+				c.cfg.Logger.Printf("error reassembling message: %v", err)
+				continue
+			}
+			if complete {
+				c.ActionMessageType(msg, msg.Data)
 			}
 		}
 
@@ -158,30 +120,24 @@ func (c *Client) ProcessMessage() {
 
 func (c *Client) AwaitMessage() {
 	for {
-		buf := make([]byte, encoding.MaxPacketSize)
-		var data []byte
 		conn := c.ActiveConn
 		if conn == nil {
-			c.chatView.Clear()
+			c.clearChatView()
 			c.PushToChatView("Connection has been lost, or no active connection.")
 			c.activeUsersView.Clear()
 			c.showHomePage()
 			return
 		}
 
-		c.cfg.Logger.Printf("Buff before read=%v\n", buf)
-		nr, err := conn.Read(buf[:])
-		c.cfg.Logger.Printf("nr=%v\n", nr)
-		data = buf[0:nr]
-		if nr == 0 {
-			c.KeepAliveTimer.Stop()
-			conn.Close()
-			c.PushToChatView("Connection has been lost, please try to reconnect.")
-			c.showHomePage()
-			return
-		}
-
+		frame, err := c.frameReader.ReadFrame()
 		if err != nil {
+			if errors.Is(err, io.EOF) {
+				c.KeepAliveTimer.Stop()
+				conn.Close()
+				c.PushToChatView("Connection has been lost, please try to reconnect.")
+				c.showHomePage()
+				return
+			}
 			if !strings.Contains(err.Error(), "closed network connection") {
 				c.cfg.Logger.Printf("error reading from conn: %v\n", err)
 			}
@@ -190,32 +146,44 @@ func (c *Client) AwaitMessage() {
 			conn.Close()
 			return
 		}
-		c.cfg.Logger.Printf("data read from conn=%v\n", data)
-		c.processChannel <- data
-
+		c.processChannel <- frame
 	}
 }
 
+// SendMessageToServer sends msg to the current channel.
 func (c *Client) SendMessageToServer(msg []byte) error {
-	toSend, err := encoding.PrepBytesForSending(msg, encoding.Message, c.cfg.Username, c.cfg.UserColour, c.cfg.ClientAESKey)
-	if err != nil {
-		return fmt.Errorf("error creating packet to send: %v", err)
-	}
-	c.cfg.Logger.Printf("SendMessageToServer: len %v\n", len(toSend))
-	_, err = c.ActiveConn.Write(toSend)
+	toSend := encoding.PrepChannelPacketsForSending(msg, encoding.Message, c.CurrentChannel(), c.cfg.Username, c.cfg.UserColour)
+	c.cfg.Logger.Printf("SendMessageToServer: frames %v\n", len(toSend))
+	err := c.SendPackets(toSend)
 	if err != nil {
 		return fmt.Errorf("failed to send to server %s: %v", c.ActiveConn.RemoteAddr().String(), err)
 	}
 	return nil
 }
 
-func (c *Client) SendWhisperToServer(msg []byte) error {
-	toSend, err := encoding.PrepBytesForSending(msg, encoding.WhisperMessage, c.cfg.Username, c.cfg.UserColour, c.cfg.ClientAESKey)
+// SendWhisperToServer seals msg for the recipient so the server can only relay
+// it, see crypto.SealWhisper.
+func (c *Client) SendWhisperToServer(to string, msg []byte) error {
+	recipient, ok := c.GetActiveUser(to)
+	if !ok {
+		return fmt.Errorf("%v is not connected", to)
+	}
+	recipientKey, err := crypto.BytesToRSAPublicKey(recipient.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid key for %v: %v", to, err)
+	}
+	sealed, err := crypto.SealWhisper(msg, c.cfg.Username, to, recipientKey, c.cfg.RSAKeyPair.PrivateKey)
 	if err != nil {
-		return fmt.Errorf("error creating packet to send: %v", err)
+		return err
 	}
-	c.cfg.Logger.Printf("SendWhisperToServer: len %v\n", len(toSend))
-	_, err = c.ActiveConn.Write(toSend)
+	whisper, err := encoding.EncodeWhisper(encoding.WhisperPayload{To: to, Sealed: sealed})
+	if err != nil {
+		return err
+	}
+
+	toSend := encoding.PrepPacketsForSending(whisper, encoding.WhisperMessage, c.cfg.Username, c.cfg.UserColour)
+	c.cfg.Logger.Printf("SendWhisperToServer: frames %v\n", len(toSend))
+	err = c.SendPackets(toSend)
 	if err != nil {
 		return fmt.Errorf("failed to send to server %s: %v", c.ActiveConn.RemoteAddr().String(), err)
 	}
@@ -223,19 +191,139 @@ func (c *Client) SendWhisperToServer(msg []byte) error {
 }
 
 func (c *Client) PushSentMessageToChatView(msg string) {
-	dateTime := time.Now().UTC()
-	msg = fmt.Sprintf("[white]%v[white] [%s]%s ~ [white]%s", dateTime.Format("02/01/06 15:04"), c.cfg.UserColour, c.cfg.Username, msg)
+	msg = fmt.Sprintf("[white]%v[white] [%s]%s ~ [white]%s", formatTimestamp(time.Now()), c.cfg.UserColour, c.cfg.Username, msg)
 	c.chatView.Write([]byte(msg))
 }
 
 func (c *Client) SendKeepAlive() {
-	toSend, err := encoding.PrepBytesForSending([]byte{}, encoding.KeepAlive, c.cfg.Username, c.cfg.UserColour, c.cfg.ClientAESKey)
+	toSend := encoding.PrepPacketsForSending([]byte{}, encoding.KeepAlive, c.cfg.Username, c.cfg.UserColour)
+	c.cfg.Logger.Printf("SendKeepAlive: frames %v\n", len(toSend))
+	err := c.SendPackets(toSend)
 	if err != nil {
-		c.cfg.Logger.Printf("error creating packet to send: %v", err)
+		c.cfg.Logger.Printf("failed to send to server %s: %v", c.ActiveConn.RemoteAddr().String(), err)
 	}
-	c.cfg.Logger.Printf("SendKeepAlive: len %v\n", len(toSend))
-	_, err = c.ActiveConn.Write(toSend)
+}
+
+// ShowWhisper opens a whisper relayed by the server, and shows whether it was
+// signed by the user the server says sent it.
+func (c *Client) ShowWhisper(p encoding.MsgProtocol, data []byte) {
+	whisper, err := encoding.DecodeWhisper(data)
 	if err != nil {
-		c.cfg.Logger.Printf("failed to send to server %s: %v", c.ActiveConn.RemoteAddr().String(), err)
+		c.cfg.Logger.Println(err)
+		return
+	}
+	colour := "white"
+	var senderKey *rsa.PublicKey
+	sender, ok := c.GetActiveUser(whisper.From)
+	if ok {
+		colour = sender.UserColour
+		senderKey, err = crypto.BytesToRSAPublicKey(sender.PublicKey)
+		if err != nil {
+			c.cfg.Logger.Printf("invalid key for %v: %v", whisper.From, err)
+		}
+	}
+
+	msg, verified, err := crypto.OpenWhisper(whisper.Sealed, whisper.From, c.cfg.Username, c.cfg.RSAKeyPair.PrivateKey, senderKey)
+	if err != nil {
+		c.cfg.Logger.Printf("could not open whisper from %v: %v", whisper.From, err)
+		c.PushToChatView(fmt.Sprintf("[red]Received a whisper from %v that could not be decrypted[white]", whisper.From))
+		return
+	}
+	status := "[green](verified)[white]"
+	if !verified {
+		status = "[red](signature not verified)[white]"
+	}
+	out := fmt.Sprintf("[white]%v[white] [%s][::i](whispered)[::-] %v ~[white] %s [:r:i]%s[:-:-]", formatTimestamp(p.DateTime), colour, whisper.From, status, msg)
+	c.chatView.Write([]byte(out))
+}
+
+func (c *Client) SetActiveUsers(users []encoding.ActiveUser) {
+	c.activeUsersMu.Lock()
+	defer c.activeUsersMu.Unlock()
+	c.activeUsers = make(map[string]encoding.ActiveUser, len(users))
+	for _, usr := range users {
+		c.activeUsers[usr.Username] = usr
+	}
+}
+
+// GetActiveUsers returns the active users sorted by username.
+func (c *Client) GetActiveUsers() []encoding.ActiveUser {
+	c.activeUsersMu.Lock()
+	defer c.activeUsersMu.Unlock()
+	users := make([]encoding.ActiveUser, 0, len(c.activeUsers))
+	for _, usr := range c.activeUsers {
+		users = append(users, usr)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users
+}
+
+func (c *Client) GetActiveUser(username string) (encoding.ActiveUser, bool) {
+	c.activeUsersMu.Lock()
+	defer c.activeUsersMu.Unlock()
+	usr, ok := c.activeUsers[username]
+	return usr, ok
+}
+
+// ShowActiveUsers lists the members of the current channel in the active
+// users panel, marking those the client has verified. If a verified user's
+// key has changed, the verification is dropped and the user is warned.
+func (c *Client) ShowActiveUsers() {
+	users := c.GetActiveUsers()
+	vu, err := LoadVerifiedUsers(c.cfg.VerifiedUsersPath)
+	if err != nil {
+		c.cfg.Logger.Println(err)
+	}
+	names := make(map[string]string, len(users))
+	for _, usr := range users {
+		name := usr.Username
+		if usr.Host {
+			name = name + " (host)"
+		}
+		if vu != nil && usr.Username != c.cfg.Username {
+			status, err := vu.Check(c.ServerAddr, usr.Username, activeUserFingerprint(usr))
+			if err != nil {
+				c.cfg.Logger.Println(err)
+			}
+			switch status {
+			case verified:
+				name = name + " [green]✓"
+			case verifiedKeyChanged:
+				c.PushToChatView(fmt.Sprintf("[red]WARNING: the key of %v has changed since you verified them. Someone could be impersonating them. Check the new safety number with \\verify %v.[white]", usr.Username, usr.Username))
+			}
+		}
+		names[usr.Username] = fmt.Sprintf("[%s]%v[white]\n", usr.UserColour, name)
+	}
+
+	c.activeUsersView.Clear()
+	channel := c.CurrentChannel()
+	if channel == "" {
+		c.activeUsersView.SetTitle("  Active Users  ")
+		for _, usr := range users {
+			c.activeUsersView.Write([]byte(names[usr.Username]))
+		}
+		return
+	}
+	c.activeUsersView.SetTitle(fmt.Sprintf("  %v  ", channel))
+	for _, member := range c.GetChannelMembers(channel) {
+		name, ok := names[member]
+		if !ok {
+			name = member + "\n"
+		}
+		c.activeUsersView.Write([]byte(name))
+	}
+}
+
+func activeUserFingerprint(usr encoding.ActiveUser) string {
+	key, err := crypto.BytesToRSAPublicKey(usr.PublicKey)
+	if err != nil {
+		return ""
+	}
+	fingerprint, err := crypto.RSAPublicKeyFingerprint(key)
+	if err != nil {
+		return ""
 	}
+	return fingerprint
 }
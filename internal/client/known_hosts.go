@@ -0,0 +1,92 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+var ErrHostKeyChanged = errors.New("server key has changed")
+
+type knownHost struct {
+	addr        string
+	fingerprint string
+}
+
+// KnownHosts pins the fingerprint of each server's RSA key the first time the
+// client connects to it. The file has one "address fingerprint" pair per line.
+type KnownHosts struct {
+	path  string
+	hosts map[string]string
+}
+
+func LoadKnownHosts(filePath string) (*KnownHosts, error) {
+	kh := &KnownHosts{
+		path:  filePath,
+		hosts: make(map[string]string),
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return kh, nil
+		}
+		return nil, fmt.Errorf("could not read known hosts: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid known hosts entry: %q", line)
+		}
+		kh.hosts[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read known hosts: %v", err)
+	}
+	return kh, nil
+}
+
+// Check compares the fingerprint against the one pinned for the address. It
+// returns true when the address has not been seen before.
+func (kh *KnownHosts) Check(srvAddr, fingerprint string) (bool, error) {
+	pinned, exists := kh.hosts[srvAddr]
+	if !exists {
+		return true, nil
+	}
+	if pinned != fingerprint {
+		return false, fmt.Errorf("%w for %v: expected %v, got %v", ErrHostKeyChanged, srvAddr, pinned, fingerprint)
+	}
+	return false, nil
+}
+
+func (kh *KnownHosts) Trust(srvAddr, fingerprint string) error {
+	kh.hosts[srvAddr] = fingerprint
+	return kh.save()
+}
+
+func (kh *KnownHosts) save() error {
+	addrs := make([]string, 0, len(kh.hosts))
+	for addr := range kh.hosts {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var sb strings.Builder
+	for _, addr := range addrs {
+		sb.WriteString(fmt.Sprintf("%s %s\n", addr, kh.hosts[addr]))
+	}
+	err := os.WriteFile(kh.path, []byte(sb.String()), 0600)
+	if err != nil {
+		return fmt.Errorf("could not write known hosts: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKnownHostsCheck(t *testing.T) {
+	kh, err := LoadKnownHosts(filepath.Join(t.TempDir(), "known_hosts"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err = kh.Trust("127.0.0.1:8144", "SHA256:pinned")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		name          string
+		addr          string
+		fingerprint   string
+		expectedFirst bool
+		expectedErr   error
+	}{
+		{
+			name:          "unknown host",
+			addr:          "127.0.0.1:9000",
+			fingerprint:   "SHA256:other",
+			expectedFirst: true,
+		}, {
+			name:        "matching key",
+			addr:        "127.0.0.1:8144",
+			fingerprint: "SHA256:pinned",
+		}, {
+			name:        "changed key",
+			addr:        "127.0.0.1:8144",
+			fingerprint: "SHA256:other",
+			expectedErr: ErrHostKeyChanged,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			first, err := kh.Check(tc.addr, tc.fingerprint)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Errorf("Expected error %v, Got %v", tc.expectedErr, err)
+			}
+			if first != tc.expectedFirst {
+				t.Errorf("Expected first connection %v, Got %v", tc.expectedFirst, first)
+			}
+		})
+	}
+}
+
+func TestKnownHostsReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	kh, err := LoadKnownHosts(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	kh.Trust("127.0.0.1:8144", "SHA256:old")
+	kh.Trust("example.com:8144", "SHA256:example")
+	// Trusting a changed key replaces the pinned one.
+	kh.Trust("127.0.0.1:8144", "SHA256:new")
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Expected known hosts to be saved: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected known hosts to be readable only by the owner, Got %v", info.Mode().Perm())
+	}
+
+	reloaded, err := LoadKnownHosts(path)
+	if err != nil {
+		t.Fatalf("Unexpected error reloading: %v", err)
+	}
+	for addr, fingerprint := range map[string]string{"127.0.0.1:8144": "SHA256:new", "example.com:8144": "SHA256:example"} {
+		first, err := reloaded.Check(addr, fingerprint)
+		if first || err != nil {
+			t.Errorf("Expected %v to be pinned to %v after reloading, Got first %v (%v)", addr, fingerprint, first, err)
+		}
+	}
+	_, err = reloaded.Check("127.0.0.1:8144", "SHA256:old")
+	if !errors.Is(err, ErrHostKeyChanged) {
+		t.Errorf("Expected the replaced key to be rejected, Got %v", err)
+	}
+
+	os.WriteFile(path, []byte("# comment\n\n127.0.0.1:8144\n"), 0600)
+	_, err = LoadKnownHosts(path)
+	if err == nil {
+		t.Errorf("Expected an entry without a fingerprint to fail to load")
+	}
+}
@@ -9,6 +9,10 @@ import (
 	"github.com/rivo/tview"
 )
 
+// chatLogMaxLines is how many lines the chat log keeps, until older history
+// is loaded into it.
+const chatLogMaxLines = 250
+
 func StartTUI(c *Client) error {
 	app := initView(c)
 	c.TUI = app
@@ -23,12 +27,33 @@ func (c *Client) PushToChatView(msg string) {
 	c.chatView.Write([]byte(msg + "\n"))
 }
 
+// clearChatView empties the chat log, and puts back the line limit that
+// loading older history raises.
+func (c *Client) clearChatView() {
+	c.chatView.Clear()
+	c.chatMaxLines = chatLogMaxLines
+	c.chatView.SetMaxLines(c.chatMaxLines)
+}
+
 func initView(c *Client) *tview.Application {
 	app := tview.NewApplication()
 
 	pages := tview.NewPages()
 
 	chatLog := createChatLogView().SetChangedFunc(c.textViewChangeHandler)
+	chatLog.SetMouseCapture(func(action tview.MouseAction, event *tcell.EventMouse) (tview.MouseAction, *tcell.EventMouse) {
+		if action == tview.MouseScrollUp {
+			c.loadHistoryAtTop()
+		}
+		return action, event
+	})
+	chatLog.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyUp, tcell.KeyPgUp, tcell.KeyHome:
+			c.loadHistoryAtTop()
+		}
+		return event
+	})
 	textBox := createMsgBoxView()
 
 	textBox.SetDoneFunc(func(key tcell.Key) {
@@ -64,7 +89,7 @@ func initView(c *Client) *tview.Application {
 			return
 		}
 		cmds := getUserCommands()
-		if c.Host {
+		if c.IsAdmin() {
 			maps.Copy(cmds, getHostCommands())
 		}
 
@@ -116,6 +141,7 @@ func initView(c *Client) *tview.Application {
 	app.SetFocus(textBox)
 
 	c.chatView = chatLog
+	c.chatMaxLines = chatLogMaxLines
 	c.activeUsersView = activeChatters
 	c.userInputBox = textBox
 
@@ -132,14 +158,41 @@ func (c *Client) showHomePage() {
 	c.TUI.SetFocus(c.userInputBox)
 }
 
+// promptForPassword asks for the server password in a masked field, then
+// connects with it.
+func (c *Client) promptForPassword(srvAddr string) {
+	input := tview.NewInputField().SetLabel("Password: ").SetMaskCharacter('*')
+	input.SetFieldBackgroundColor(tcell.ColorDefault)
+	input.SetBorder(true)
+	input.SetTitle(fmt.Sprintf(" Password for %v ", srvAddr))
+	input.SetDoneFunc(func(key tcell.Key) {
+		c.tuiPages.RemovePage("password-prompt")
+		c.TUI.SetFocus(c.userInputBox)
+		if key == tcell.KeyEnter && input.GetText() != "" {
+			c.userCmdArg = fmt.Sprintf("%v %v", srvAddr, input.GetText())
+			connectToServer(c)
+		}
+	})
+
+	prompt := tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(input, 3, 1, true).
+			AddItem(nil, 0, 1, false), 50, 1, true).
+		AddItem(nil, 0, 1, false)
+	c.tuiPages.AddPage("password-prompt", prompt, true, true)
+	c.TUI.SetFocus(input)
+}
+
 func createTextView() tview.TextView {
 	return *tview.NewTextView().SetDynamicColors(true).SetRegions(true)
 }
 
 func createChatLogView() *tview.TextView {
 	chatLog := createTextView()
-	chatLog.SetTitle("  Chat Log  ") //TODO get from config
-	chatLog.SetMaxLines(250)         //TODO get from config //Need to experiment here, see what its like with limit, without, and if should have scrollable or not
+	chatLog.SetTitle("  Chat Log  ")     //TODO get from config
+	chatLog.SetMaxLines(chatLogMaxLines) //TODO get from config //Need to experiment here, see what its like with limit, without, and if should have scrollable or not
 	chatLog.SetBorder(true)
 	chatLog.SetDynamicColors(true)
 	return &chatLog
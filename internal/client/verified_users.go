@@ -0,0 +1,93 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+type verifyStatus int
+
+const (
+	unverified verifyStatus = iota
+	verified
+	verifiedKeyChanged
+)
+
+// VerifiedUsers records the key fingerprint of each user the client has
+// compared safety numbers with, by server address and username. Usernames are
+// only unique per server.
+type VerifiedUsers struct {
+	path  string
+	users map[string]map[string]string
+}
+
+func LoadVerifiedUsers(filePath string) (*VerifiedUsers, error) {
+	v := &VerifiedUsers{
+		path:  filePath,
+		users: make(map[string]map[string]string),
+	}
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return v, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read verified users: %v", err)
+	}
+	err = json.Unmarshal(data, &v.users)
+	if err != nil {
+		return nil, fmt.Errorf("could not read verified users: %v", err)
+	}
+	return v, nil
+}
+
+// Status compares the fingerprint against the one the user was verified with.
+func (v *VerifiedUsers) Status(srvAddr, username, fingerprint string) verifyStatus {
+	verifiedPrint, exists := v.users[srvAddr][username]
+	if !exists {
+		return unverified
+	}
+	if verifiedPrint != fingerprint {
+		return verifiedKeyChanged
+	}
+	return verified
+}
+
+// Check is Status, but forgets the verification if the user's key has changed,
+// so they are shown as unverified until they are verified again.
+func (v *VerifiedUsers) Check(srvAddr, username, fingerprint string) (verifyStatus, error) {
+	status := v.Status(srvAddr, username, fingerprint)
+	if status == verifiedKeyChanged {
+		return status, v.Forget(srvAddr, username)
+	}
+	return status, nil
+}
+
+func (v *VerifiedUsers) Verify(srvAddr, username, fingerprint string) error {
+	if v.users[srvAddr] == nil {
+		v.users[srvAddr] = make(map[string]string)
+	}
+	v.users[srvAddr][username] = fingerprint
+	return v.save()
+}
+
+func (v *VerifiedUsers) Forget(srvAddr, username string) error {
+	delete(v.users[srvAddr], username)
+	if len(v.users[srvAddr]) == 0 {
+		delete(v.users, srvAddr)
+	}
+	return v.save()
+}
+
+func (v *VerifiedUsers) save() error {
+	data, err := json.MarshalIndent(v.users, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not write verified users: %v", err)
+	}
+	err = os.WriteFile(v.path, data, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write verified users: %v", err)
+	}
+	return nil
+}
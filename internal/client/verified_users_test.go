@@ -0,0 +1,65 @@
+package client
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifiedUsersKeyChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "verified_users")
+	vu, err := LoadVerifiedUsers(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err = vu.Verify("127.0.0.1:8144", "alice", "SHA256:old")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err = vu.Verify("example.com:8144", "alice", "SHA256:old")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		name        string
+		fingerprint string
+		expected    verifyStatus
+	}{
+		{
+			name:        "same key",
+			fingerprint: "SHA256:old",
+			expected:    verified,
+		}, {
+			name:        "changed key",
+			fingerprint: "SHA256:new",
+			expected:    verifiedKeyChanged,
+		}, {
+			name:        "changed key is forgotten",
+			fingerprint: "SHA256:new",
+			expected:    unverified,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			status, err := vu.Check("127.0.0.1:8144", "alice", tc.fingerprint)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if status != tc.expected {
+				t.Errorf("Expected status %v, Got %v", tc.expected, status)
+			}
+		})
+	}
+
+	reloaded, err := LoadVerifiedUsers(path)
+	if err != nil {
+		t.Fatalf("Unexpected error reloading: %v", err)
+	}
+	if status := reloaded.Status("127.0.0.1:8144", "alice", "SHA256:old"); status != unverified {
+		t.Errorf("Expected the forgotten verification to stay forgotten after reloading, Got %v", status)
+	}
+	if status := reloaded.Status("example.com:8144", "alice", "SHA256:old"); status != verified {
+		t.Errorf("Expected alice to still be verified on the other server, Got %v", status)
+	}
+}
@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+)
+
+const (
+	X25519KeySize = 32
+
+	serverKeyExchangeLabel = "simple-chat-server key exchange: server"
+	clientKeyExchangeLabel = "simple-chat-server key exchange: client"
+	clientToServerInfo     = "simple-chat-server client to server"
+	serverToClientInfo     = "simple-chat-server server to client"
+)
+
+// SessionKeys holds the AES-GCM keys for a single connection. Each direction
+// has its own key so a frame can never be reflected back to its sender.
+type SessionKeys struct {
+	ClientToServer []byte
+	ServerToClient []byte
+}
+
+func GenerateX25519Key() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// DeriveSessionKeys runs X25519 with the peer's ephemeral public key and
+// expands the shared secret with HKDF-SHA256. Both ephemeral keys are used as
+// the salt so the keys are bound to this exchange.
+func DeriveSessionKeys(priv *ecdh.PrivateKey, peerPublic, serverEph, clientEph []byte) (SessionKeys, error) {
+	peer, err := ecdh.X25519().NewPublicKey(peerPublic)
+	if err != nil {
+		return SessionKeys{}, fmt.Errorf("invalid ephemeral key: %v", err)
+	}
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return SessionKeys{}, err
+	}
+
+	salt := append(append([]byte{}, serverEph...), clientEph...)
+	return SessionKeys{
+		ClientToServer: hkdf(sha256.New, shared, salt, []byte(clientToServerInfo), AESKeySize),
+		ServerToClient: hkdf(sha256.New, shared, salt, []byte(serverToClientInfo), AESKeySize),
+	}, nil
+}
+
+// ServerKeyExchangeData is the payload the server signs with its RSA key. It
+// binds the server's ephemeral key to the identity of the client it is for.
+func ServerKeyExchangeData(serverEph, clientIdentity []byte) []byte {
+	data := []byte(serverKeyExchangeLabel)
+	data = append(data, serverEph...)
+	return append(data, clientIdentity...)
+}
+
+// ClientKeyExchangeData is the payload the client signs with its RSA key.
+// Signing the server's fresh ephemeral key proves the client holds its
+// private key now, rather than replaying an old exchange, and the username
+// binds that proof to the name it is connecting as.
+func ClientKeyExchangeData(serverEph, clientEph []byte, username string) []byte {
+	data := []byte(clientKeyExchangeLabel)
+	data = append(data, serverEph...)
+	data = append(data, clientEph...)
+	return append(data, username...)
+}
+
+// hkdf implements RFC 5869 extract-then-expand.
+func hkdf(h func() hash.Hash, secret, salt, info []byte, length int) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, h().Size())
+	}
+	extract := hmac.New(h, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	out := []byte{}
+	prev := []byte{}
+	for i := byte(1); len(out) < length; i++ {
+		expand := hmac.New(h, prk)
+		expand.Write(prev)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		prev = expand.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:length]
+}
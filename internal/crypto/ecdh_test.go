@@ -0,0 +1,58 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestHKDF(t *testing.T) {
+	// RFC 5869 test case 1
+	secret := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	expected := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"
+
+	got := hex.EncodeToString(hkdf(sha256.New, secret, salt, info, 42))
+	if got != expected {
+		t.Errorf("Expected %v, Got %v", expected, got)
+	}
+}
+
+func TestDeriveSessionKeys(t *testing.T) {
+	serverPriv, err := GenerateX25519Key()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	clientPriv, err := GenerateX25519Key()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	serverEph := serverPriv.PublicKey().Bytes()
+	clientEph := clientPriv.PublicKey().Bytes()
+
+	serverKeys, err := DeriveSessionKeys(serverPriv, clientEph, serverEph, clientEph)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	clientKeys, err := DeriveSessionKeys(clientPriv, serverEph, serverEph, clientEph)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(serverKeys.ClientToServer, clientKeys.ClientToServer) || !bytes.Equal(serverKeys.ServerToClient, clientKeys.ServerToClient) {
+		t.Errorf("Expected both sides to derive the same keys")
+	}
+	if bytes.Equal(serverKeys.ClientToServer, serverKeys.ServerToClient) {
+		t.Errorf("Expected a different key for each direction")
+	}
+	if len(serverKeys.ClientToServer) != AESKeySize {
+		t.Errorf("Expected key size %d, Got %d", AESKeySize, len(serverKeys.ClientToServer))
+	}
+
+	_, err = DeriveSessionKeys(serverPriv, []byte("short"), serverEph, clientEph)
+	if err == nil {
+		t.Errorf("Expected error for invalid peer key")
+	}
+}
@@ -11,6 +11,9 @@ import (
 	"io"
 )
 
+// aesOverhead is the nonce and tag AESEncrypt adds to the payload.
+const aesOverhead = 12 + 16
+
 func RSAEncrypt(data []byte, key *rsa.PublicKey) ([]byte, error) {
 	rand := rand.Reader
 	hash := sha256.New()
@@ -47,6 +50,16 @@ func RSAVerify(payload, sigBytes []byte, key *rsa.PublicKey) error {
 }
 
 func AESEncrypt(payload, aesKey []byte) ([]byte, error) {
+	return AESEncryptWithAAD(payload, aesKey, nil)
+}
+
+func AESDecrypt(payload, aesKey []byte) ([]byte, error) {
+	return AESDecryptWithAAD(payload, aesKey, nil)
+}
+
+// AESEncryptWithAAD seals payload with AES-GCM. The additional data is
+// authenticated but not encrypted or included in the output.
+func AESEncryptWithAAD(payload, aesKey, additionalData []byte) ([]byte, error) {
 	ciBlock, err := aes.NewCipher(aesKey)
 	if err != nil {
 		return nil, err
@@ -61,10 +74,10 @@ func AESEncrypt(payload, aesKey []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return gcm.Seal(iv, iv, payload, nil), nil
+	return gcm.Seal(iv, iv, payload, additionalData), nil
 }
 
-func AESDecrypt(payload, aesKey []byte) ([]byte, error) {
+func AESDecryptWithAAD(payload, aesKey, additionalData []byte) ([]byte, error) {
 	ciBlock, err := aes.NewCipher(aesKey)
 	if err != nil {
 		return nil, err
@@ -80,6 +93,6 @@ func AESDecrypt(payload, aesKey []byte) ([]byte, error) {
 	}
 
 	iv, cipherBytes := payload[:ivSize], payload[ivSize:]
-	return gcm.Open(nil, iv, cipherBytes, nil)
+	return gcm.Open(nil, iv, cipherBytes, additionalData)
 
 }
@@ -3,12 +3,17 @@ package crypto
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
 )
 
 const (
-	bitSize        = 2048
-	AESKeySize     = 32
-	EncodedKeySize = 256
+	bitSize    = 2048
+	AESKeySize = 32
 )
 
 type RSAKeys struct {
@@ -39,3 +44,99 @@ func GenerateAESSecretKey() ([]byte, error) {
 	}
 	return keyBytes, nil
 }
+
+// LoadOrGenerateRSAKeyPair reads a PEM encoded private key from filePath. If
+// the file does not exist, a new key pair is generated and saved there,
+// readable only by the owner.
+func LoadOrGenerateRSAKeyPair(filePath string) (RSAKeys, error) {
+	keyBytes, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return generateAndSaveRSAKeyPair(filePath)
+	}
+	if err != nil {
+		return RSAKeys{}, fmt.Errorf("could not read key file: %v", err)
+	}
+
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(filePath)
+		if err != nil {
+			return RSAKeys{}, fmt.Errorf("could not read key file: %v", err)
+		}
+		if fi.Mode().Perm()&0077 != 0 {
+			return RSAKeys{}, fmt.Errorf("permissions %v for key file %v are too open, it should only be accessible by the owner", fi.Mode().Perm(), filePath)
+		}
+	}
+
+	priv, err := BytesToRSAPrivateKey(keyBytes)
+	if err != nil {
+		return RSAKeys{}, fmt.Errorf("could not load key from %v: %v", filePath, err)
+	}
+	return RSAKeys{
+		PrivateKey: priv,
+		PublicKey:  &priv.PublicKey,
+	}, nil
+}
+
+func generateAndSaveRSAKeyPair(filePath string) (RSAKeys, error) {
+	priv, pub, err := GenerateRSAKeyPair()
+	if err != nil {
+		return RSAKeys{}, err
+	}
+	keyBytes, err := RSAPrivateKeyToBytes(priv)
+	if err != nil {
+		return RSAKeys{}, err
+	}
+
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return RSAKeys{}, fmt.Errorf("could not create key file: %v", err)
+	}
+	_, err = f.Write(keyBytes)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filePath)
+		return RSAKeys{}, fmt.Errorf("could not write key file: %v", err)
+	}
+	return RSAKeys{
+		PrivateKey: priv,
+		PublicKey:  pub,
+	}, nil
+}
+
+func RSAPrivateKeyToBytes(privKey *rsa.PrivateKey) ([]byte, error) {
+	marshPriv, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: marshPriv}), nil
+}
+
+func BytesToRSAPrivateKey(privBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(privBytes)
+	if block == nil {
+		return nil, fmt.Errorf("invalid key bytes")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid key bytes: %v", err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		err = key.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key: %v", err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("invalid key type")
+	}
+}
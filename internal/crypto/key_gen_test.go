@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestLoadOrGenerateRSAKeyPair(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "server_key")
+
+	generated, err := LoadOrGenerateRSAKeyPair(keyPath)
+	if err != nil {
+		t.Fatalf("Unexpected error generating key: %v", err)
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(keyPath)
+		if err != nil {
+			t.Fatalf("Expected key file to be created: %v", err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("Expected key file permissions 0600, Got %v", fi.Mode().Perm())
+		}
+	}
+
+	loaded, err := LoadOrGenerateRSAKeyPair(keyPath)
+	if err != nil {
+		t.Fatalf("Unexpected error loading key: %v", err)
+	}
+	if !loaded.PrivateKey.Equal(generated.PrivateKey) {
+		t.Errorf("Expected loaded key to match the generated key")
+	}
+
+	expected, _ := RSAPublicKeyFingerprint(generated.PublicKey)
+	got, _ := RSAPublicKeyFingerprint(loaded.PublicKey)
+	if got != expected {
+		t.Errorf("Expected fingerprint %v, Got %v", expected, got)
+	}
+
+	if runtime.GOOS != "windows" {
+		os.Chmod(keyPath, 0644)
+		_, err = LoadOrGenerateRSAKeyPair(keyPath)
+		if err == nil {
+			t.Errorf("Expected error loading key file readable by others")
+		}
+	}
+}
+
+func TestBytesToRSAPrivateKeyInvalid(t *testing.T) {
+	_, err := BytesToRSAPrivateKey([]byte("not a key"))
+	if err == nil {
+		t.Errorf("Expected error decoding invalid key")
+	}
+}
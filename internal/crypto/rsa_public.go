@@ -2,7 +2,9 @@ package crypto
 
 import (
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 )
@@ -33,3 +35,14 @@ func BytesToRSAPublicKey(pubBytes []byte) (*rsa.PublicKey, error) {
 		return nil, fmt.Errorf("invalid key type")
 	}
 }
+
+// RSAPublicKeyFingerprint returns the SHA-256 fingerprint of the key's PKIX
+// encoding, in the same "SHA256:<base64>" form ssh uses.
+func RSAPublicKeyFingerprint(pubKey *rsa.PublicKey) (string, error) {
+	marshPub, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(marshPub)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
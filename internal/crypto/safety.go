@@ -0,0 +1,51 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	safetyNumberLabel  = "simple-chat-server safety number"
+	safetyNumberGroups = 6
+)
+
+// SafetyNumber derives a code from two users' public keys for them to compare
+// out of band, such as in person or over a call. Both users get the same code
+// whichever order the keys are given in, and it changes if either key does.
+// The code is 30 digits, in groups of 5.
+func SafetyNumber(a, b *rsa.PublicKey) (string, error) {
+	aDer, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return "", err
+	}
+	bDer, err := x509.MarshalPKIXPublicKey(b)
+	if err != nil {
+		return "", err
+	}
+	aSum := sha256.Sum256(aDer)
+	bSum := sha256.Sum256(bDer)
+	first, second := aSum[:], bSum[:]
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+
+	h := sha256.New()
+	h.Write([]byte(safetyNumberLabel))
+	h.Write(first)
+	h.Write(second)
+	digest := h.Sum(nil)
+
+	groups := make([]string, safetyNumberGroups)
+	for i := range groups {
+		// Each group is 5 bytes of the digest, reduced to 5 digits.
+		chunk := append([]byte{0, 0, 0}, digest[i*5:i*5+5]...)
+		groups[i] = fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk)%100000)
+	}
+	return strings.Join(groups, " "), nil
+}
@@ -0,0 +1,44 @@
+package crypto
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestSafetyNumber(t *testing.T) {
+	alice, _, err := GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	bob, _, err := GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mallory, _, err := GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	aliceView, err := SafetyNumber(&alice.PublicKey, &bob.PublicKey)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	bobView, err := SafetyNumber(&bob.PublicKey, &alice.PublicKey)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if aliceView != bobView {
+		t.Errorf("Expected both users to see the same number, Got %v and %v", aliceView, bobView)
+	}
+	if !regexp.MustCompile(`^\d{5}( \d{5}){5}$`).MatchString(aliceView) {
+		t.Errorf("Expected 6 groups of 5 digits, Got %v", aliceView)
+	}
+
+	intercepted, err := SafetyNumber(&alice.PublicKey, &mallory.PublicKey)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if intercepted == aliceView {
+		t.Errorf("Expected a different key to change the number")
+	}
+}
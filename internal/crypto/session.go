@@ -0,0 +1,277 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRekeyAfterFrames = 100000
+	DefaultRekeyAfter       = 60 * time.Minute
+
+	SequenceSize = 8
+)
+
+var (
+	ErrRekeyInProgress = errors.New("rekey already in progress")
+	ErrReplayedFrame   = errors.New("replayed frame")
+	ErrOutOfOrderFrame = errors.New("out of order frame")
+)
+
+// Session encrypts and decrypts the frames of one connection, and rotates its
+// keys with an in-band X25519 exchange. A rekey takes three messages:
+//
+//	initiator -> request (eph)   under the old keys
+//	responder -> response (eph)  under the old keys
+//	initiator -> done            under the new keys
+//
+// The initiator switches to the new keys when it reads the response. The
+// responder holds them as next keys and switches the first time a frame
+// decrypts with them, so it never sends a frame the initiator cannot read yet.
+// The previous receive key is kept so frames encrypted just before a switch
+// still decrypt.
+//
+// Each frame starts with a sequence number for its direction, which carries
+// on across rekeys. The sequence number and the frame length header are
+// authenticated as GCM additional data, and Decrypt only accepts the next
+// number in sequence, so frames cannot be replayed, dropped or reordered.
+// Frames must be written in the order they were encrypted, see
+// encoding.FrameWriter.WriteSealedFrames.
+type Session struct {
+	RekeyAfterFrames uint64
+	RekeyAfter       time.Duration
+
+	mu          sync.Mutex
+	plaintext   bool
+	isServer    bool
+	keys        SessionKeys
+	prevRecv    []byte
+	next        *SessionKeys
+	pending     *ecdh.PrivateKey
+	frames      uint64
+	established time.Time
+	sendSeq     uint64
+	recvSeq     uint64
+}
+
+func NewSession(keys SessionKeys, isServer bool) *Session {
+	return &Session{
+		RekeyAfterFrames: DefaultRekeyAfterFrames,
+		RekeyAfter:       DefaultRekeyAfter,
+		isServer:         isServer,
+		keys:             keys,
+		established:      time.Now(),
+	}
+}
+
+// NewPlaintextSession passes frames through unchanged. It is only for
+// connections where TLS already encrypts the transport and both sides have
+// agreed to turn off the app-layer encryption.
+func NewPlaintextSession() *Session {
+	return &Session{plaintext: true}
+}
+
+func (s *Session) sendKey() []byte {
+	if s.isServer {
+		return s.keys.ServerToClient
+	}
+	return s.keys.ClientToServer
+}
+
+func recvKey(keys SessionKeys, isServer bool) []byte {
+	if isServer {
+		return keys.ClientToServer
+	}
+	return keys.ServerToClient
+}
+
+// frameAdditionalData is the frame length header, as the frame writer will
+// send it, followed by the sequence number.
+func frameAdditionalData(frameSize int, seq []byte) []byte {
+	aad := binary.BigEndian.AppendUint32(nil, uint32(frameSize))
+	return append(aad, seq...)
+}
+
+// Encrypt seals the payload as the next frame in sequence.
+func (s *Session) Encrypt(payload []byte) ([]byte, error) {
+	if s.plaintext {
+		return payload, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq := binary.BigEndian.AppendUint64(nil, s.sendSeq)
+	frameSize := SequenceSize + aesOverhead + len(payload)
+	sealed, err := AESEncryptWithAAD(payload, s.sendKey(), frameAdditionalData(frameSize, seq))
+	if err != nil {
+		return nil, err
+	}
+	s.sendSeq++
+	s.frames++
+	return append(seq, sealed...), nil
+}
+
+// Decrypt tries the current receive key, then the next keys of a rekey this
+// side is responding to, then the previous receive key. Authentic frames that
+// are not next in sequence return ErrReplayedFrame or ErrOutOfOrderFrame.
+func (s *Session) Decrypt(frame []byte) ([]byte, error) {
+	if s.plaintext {
+		return frame, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(frame) < SequenceSize {
+		return nil, fmt.Errorf("frame smaller than sequence number")
+	}
+	seq := binary.BigEndian.Uint64(frame[:SequenceSize])
+	aad := frameAdditionalData(len(frame), frame[:SequenceSize])
+	sealed := frame[SequenceSize:]
+
+	payload, err := AESDecryptWithAAD(sealed, recvKey(s.keys, s.isServer), aad)
+	usedNext := false
+	if err != nil && s.next != nil {
+		var nextErr error
+		payload, nextErr = AESDecryptWithAAD(sealed, recvKey(*s.next, s.isServer), aad)
+		if nextErr == nil {
+			err = nil
+			usedNext = true
+		}
+	}
+	if err != nil && s.prevRecv != nil {
+		var prevErr error
+		payload, prevErr = AESDecryptWithAAD(sealed, s.prevRecv, aad)
+		if prevErr == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if seq < s.recvSeq {
+		return nil, fmt.Errorf("%w: sequence %d, expected %d", ErrReplayedFrame, seq, s.recvSeq)
+	}
+	if seq > s.recvSeq {
+		return nil, fmt.Errorf("%w: sequence %d, expected %d", ErrOutOfOrderFrame, seq, s.recvSeq)
+	}
+	s.recvSeq++
+	s.frames++
+	if usedNext {
+		s.switchKeys(*s.next)
+	}
+	return payload, nil
+}
+
+// NeedsRekey reports whether enough frames or time have passed under the
+// current keys, and no rekey is already under way.
+func (s *Session) NeedsRekey(now time.Time) bool {
+	if s.plaintext {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending != nil || s.next != nil {
+		return false
+	}
+	return s.frames >= s.RekeyAfterFrames || now.Sub(s.established) >= s.RekeyAfter
+}
+
+// StartRekey begins a rekey and returns the ephemeral key to send in the
+// request.
+func (s *Session) StartRekey() ([]byte, error) {
+	if s.plaintext {
+		return nil, fmt.Errorf("cannot rekey a plaintext session")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending != nil || s.next != nil {
+		return nil, ErrRekeyInProgress
+	}
+	eph, err := GenerateX25519Key()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate ephemeral key: %v", err)
+	}
+	s.pending = eph
+	return eph.PublicKey().Bytes(), nil
+}
+
+// RespondToRekey derives the next keys for a rekey started by the peer and
+// returns the ephemeral key to send in the response. If both sides start a
+// rekey at once, the server's request wins.
+func (s *Session) RespondToRekey(peerEph []byte) ([]byte, error) {
+	if s.plaintext {
+		return nil, fmt.Errorf("cannot rekey a plaintext session")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending != nil {
+		if s.isServer {
+			return nil, ErrRekeyInProgress
+		}
+		s.pending = nil
+	}
+	eph, err := GenerateX25519Key()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate ephemeral key: %v", err)
+	}
+	next, err := s.deriveNext(eph, peerEph)
+	if err != nil {
+		return nil, err
+	}
+	s.next = &next
+	return eph.PublicKey().Bytes(), nil
+}
+
+// CompleteRekey switches to the new keys once the peer has responded.
+func (s *Session) CompleteRekey(peerEph []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == nil {
+		return fmt.Errorf("no rekey in progress")
+	}
+	next, err := s.deriveNext(s.pending, peerEph)
+	if err != nil {
+		return err
+	}
+	s.pending = nil
+	s.switchKeys(next)
+	return nil
+}
+
+// deriveNext mixes the current keys into the new shared secret, so the new
+// keys depend on every exchange made on the connection.
+func (s *Session) deriveNext(eph *ecdh.PrivateKey, peerEph []byte) (SessionKeys, error) {
+	peer, err := ecdh.X25519().NewPublicKey(peerEph)
+	if err != nil {
+		return SessionKeys{}, fmt.Errorf("invalid ephemeral key: %v", err)
+	}
+	shared, err := eph.ECDH(peer)
+	if err != nil {
+		return SessionKeys{}, err
+	}
+
+	serverEph, clientEph := peerEph, eph.PublicKey().Bytes()
+	if s.isServer {
+		serverEph, clientEph = clientEph, serverEph
+	}
+	salt := append(append([]byte{}, serverEph...), clientEph...)
+	secret := append(append(shared, s.keys.ClientToServer...), s.keys.ServerToClient...)
+	return SessionKeys{
+		ClientToServer: hkdf(sha256.New, secret, salt, []byte(clientToServerInfo), AESKeySize),
+		ServerToClient: hkdf(sha256.New, secret, salt, []byte(serverToClientInfo), AESKeySize),
+	}, nil
+}
+
+func (s *Session) switchKeys(next SessionKeys) {
+	s.prevRecv = recvKey(s.keys, s.isServer)
+	s.keys = next
+	s.next = nil
+	s.frames = 0
+	s.established = time.Now()
+}
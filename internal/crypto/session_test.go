@@ -0,0 +1,170 @@
+package crypto
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/MatthewTully/simple-chat-server/internal/encoding"
+)
+
+func newTestSessions(t *testing.T) (*Session, *Session) {
+	c2s, err := GenerateAESSecretKey()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s2c, err := GenerateAESSecretKey()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	keys := SessionKeys{ClientToServer: c2s, ServerToClient: s2c}
+	return NewSession(keys, true), NewSession(keys, false)
+}
+
+func mustDecrypt(t *testing.T, from, to *Session, msg string) {
+	t.Helper()
+	frame, err := from.Encrypt([]byte(msg))
+	if err != nil {
+		t.Fatalf("Unexpected error encrypting: %v", err)
+	}
+	got, err := to.Decrypt(frame)
+	if err != nil {
+		t.Fatalf("Unexpected error decrypting %q: %v", msg, err)
+	}
+	if string(got) != msg {
+		t.Errorf("Expected %v, Got %v", msg, string(got))
+	}
+}
+
+func TestSessionRekey(t *testing.T) {
+	server, client := newTestSessions(t)
+	mustDecrypt(t, server, client, "before rekey")
+
+	serverEph, err := server.StartRekey()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	clientEph, err := client.RespondToRekey(serverEph)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The client keeps sending under the old keys until it sees the new ones.
+	mustDecrypt(t, client, server, "in between")
+
+	oldKeys := server.keys
+	err = server.CompleteRekey(clientEph)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(server.keys.ServerToClient) == string(oldKeys.ServerToClient) {
+		t.Fatalf("Expected keys to change")
+	}
+	mustDecrypt(t, client, server, "still old keys")
+	mustDecrypt(t, server, client, "done")
+	mustDecrypt(t, client, server, "after rekey")
+
+	if string(client.keys.ClientToServer) != string(server.keys.ClientToServer) {
+		t.Errorf("Expected both sides to derive the same keys")
+	}
+}
+
+func TestSessionSequence(t *testing.T) {
+	server, client := newTestSessions(t)
+	first, err := client.Encrypt([]byte("first"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	second, err := client.Encrypt([]byte("second"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	third, err := client.Encrypt([]byte("third"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	_, err = server.Decrypt(second)
+	if !errors.Is(err, ErrOutOfOrderFrame) {
+		t.Errorf("Expected %v, Got %v", ErrOutOfOrderFrame, err)
+	}
+	_, err = server.Decrypt(first)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = server.Decrypt(first)
+	if !errors.Is(err, ErrReplayedFrame) {
+		t.Errorf("Expected %v, Got %v", ErrReplayedFrame, err)
+	}
+
+	tampered := append([]byte{}, third...)
+	tampered[SequenceSize-1] = 1
+	_, err = server.Decrypt(tampered)
+	if err == nil || errors.Is(err, ErrOutOfOrderFrame) || errors.Is(err, ErrReplayedFrame) {
+		t.Errorf("Expected frame with a changed sequence number to fail authentication, Got %v", err)
+	}
+	_, err = server.Decrypt(second)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestSessionRekeyCollision(t *testing.T) {
+	server, client := newTestSessions(t)
+	serverEph, err := server.StartRekey()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	clientEph, err := client.StartRekey()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	_, err = server.RespondToRekey(clientEph)
+	if !errors.Is(err, ErrRekeyInProgress) {
+		t.Errorf("Expected server to ignore the client's request, Got %v", err)
+	}
+	reply, err := client.RespondToRekey(serverEph)
+	if err != nil {
+		t.Fatalf("Expected client to give way to the server, Got %v", err)
+	}
+	err = server.CompleteRekey(reply)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mustDecrypt(t, server, client, "done")
+	mustDecrypt(t, client, server, "after rekey")
+}
+
+func TestSessionNeedsRekey(t *testing.T) {
+	server, client := newTestSessions(t)
+	server.RekeyAfterFrames = 3
+	now := time.Now()
+	if server.NeedsRekey(now) {
+		t.Errorf("Expected new session not to need a rekey")
+	}
+	for range 3 {
+		mustDecrypt(t, server, client, "msg")
+	}
+	if !server.NeedsRekey(now) {
+		t.Errorf("Expected rekey after %d frames", server.RekeyAfterFrames)
+	}
+	if !client.NeedsRekey(now.Add(DefaultRekeyAfter)) {
+		t.Errorf("Expected rekey after %v", DefaultRekeyAfter)
+	}
+	server.StartRekey()
+	if server.NeedsRekey(now) {
+		t.Errorf("Expected no rekey while one is in progress")
+	}
+}
+
+func TestSessionOverhead(t *testing.T) {
+	server, _ := newTestSessions(t)
+	payload := []byte("hello")
+	frame, err := server.Encrypt(payload)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(frame)-len(payload) > encoding.MaxSealOverhead {
+		t.Errorf("Expected sealing to add at most %d bytes, Got %d", encoding.MaxSealOverhead, len(frame)-len(payload))
+	}
+}
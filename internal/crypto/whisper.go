@@ -0,0 +1,88 @@
+package crypto
+
+import (
+	"crypto/rsa"
+	"encoding/binary"
+	"fmt"
+)
+
+const whisperLabel = "simple-chat-server whisper"
+
+// SealWhisper encrypts a whisper so only the recipient can read it. A fresh
+// AES key is wrapped with the recipient's RSA key, and the sender signs the
+// wrapped key and ciphertext along with both usernames, so the server relaying
+// it can neither read it nor pass it off as coming from someone else.
+//
+// The sealed whisper is: len(wrapped key) | wrapped key | len(sig) | sig | ciphertext
+func SealWhisper(msg []byte, from, to string, recipient *rsa.PublicKey, sender *rsa.PrivateKey) ([]byte, error) {
+	aesKey, err := GenerateAESSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := RSAEncrypt(aesKey, recipient)
+	if err != nil {
+		return nil, fmt.Errorf("could not wrap whisper key: %v", err)
+	}
+	cipherText, err := AESEncrypt(msg, aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt whisper: %v", err)
+	}
+	sig, err := RSASign(whisperSignedData(from, to, wrappedKey, cipherText), sender)
+	if err != nil {
+		return nil, fmt.Errorf("could not sign whisper: %v", err)
+	}
+
+	sealed := binary.BigEndian.AppendUint16(nil, uint16(len(wrappedKey)))
+	sealed = append(sealed, wrappedKey...)
+	sealed = binary.BigEndian.AppendUint16(sealed, uint16(len(sig)))
+	sealed = append(sealed, sig...)
+	return append(sealed, cipherText...), nil
+}
+
+// OpenWhisper decrypts a whisper sealed with SealWhisper. If the sender's key
+// is nil or the signature does not match, the message is still returned but
+// verified is false.
+func OpenWhisper(sealed []byte, from, to string, recipient *rsa.PrivateKey, sender *rsa.PublicKey) (msg []byte, verified bool, err error) {
+	wrappedKey, rest, err := readWhisperField(sealed)
+	if err != nil {
+		return nil, false, err
+	}
+	sig, cipherText, err := readWhisperField(rest)
+	if err != nil {
+		return nil, false, err
+	}
+
+	aesKey, err := RSADecrypt(wrappedKey, recipient)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not unwrap whisper key: %v", err)
+	}
+	msg, err = AESDecrypt(cipherText, aesKey)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not decrypt whisper: %v", err)
+	}
+
+	if sender != nil {
+		verified = RSAVerify(whisperSignedData(from, to, wrappedKey, cipherText), sig, sender) == nil
+	}
+	return msg, verified, nil
+}
+
+func whisperSignedData(from, to string, wrappedKey, cipherText []byte) []byte {
+	data := []byte(whisperLabel)
+	for _, field := range [][]byte{[]byte(from), []byte(to), wrappedKey} {
+		data = binary.BigEndian.AppendUint16(data, uint16(len(field)))
+		data = append(data, field...)
+	}
+	return append(data, cipherText...)
+}
+
+func readWhisperField(b []byte) ([]byte, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, fmt.Errorf("sealed whisper is truncated")
+	}
+	size := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+size {
+		return nil, nil, fmt.Errorf("sealed whisper is truncated")
+	}
+	return b[2 : 2+size], b[2+size:], nil
+}
@@ -0,0 +1,59 @@
+package crypto
+
+import (
+	"testing"
+)
+
+func TestSealWhisper(t *testing.T) {
+	alice, _, err := GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	bob, _, err := GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	msg := []byte("meet me at noon")
+
+	sealed, err := SealWhisper(msg, "alice", "bob", &bob.PublicKey, alice)
+	if err != nil {
+		t.Fatalf("Unexpected error sealing whisper: %v", err)
+	}
+
+	t.Run("recipient can open and verify", func(t *testing.T) {
+		got, verified, err := OpenWhisper(sealed, "alice", "bob", bob, &alice.PublicKey)
+		if err != nil {
+			t.Fatalf("Unexpected error opening whisper: %v", err)
+		}
+		if string(got) != string(msg) {
+			t.Errorf("Expected %v, Got %v", string(msg), string(got))
+		}
+		if !verified {
+			t.Errorf("Expected signature to verify")
+		}
+	})
+
+	t.Run("other users cannot open", func(t *testing.T) {
+		_, _, err := OpenWhisper(sealed, "alice", "bob", alice, &alice.PublicKey)
+		if err == nil {
+			t.Errorf("Expected error opening whisper sealed for another user")
+		}
+	})
+
+	t.Run("changed sender is not verified", func(t *testing.T) {
+		_, verified, err := OpenWhisper(sealed, "mallory", "bob", bob, &alice.PublicKey)
+		if err != nil {
+			t.Fatalf("Unexpected error opening whisper: %v", err)
+		}
+		if verified {
+			t.Errorf("Expected signature not to verify for a different sender")
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		_, _, err := OpenWhisper(sealed[:100], "alice", "bob", bob, &alice.PublicKey)
+		if err == nil {
+			t.Errorf("Expected error opening truncated whisper")
+		}
+	})
+}
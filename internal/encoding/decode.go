@@ -1,33 +1,79 @@
 package encoding
 
 import (
-	"bytes"
-	"encoding/gob"
-	"log"
+	"encoding/binary"
+	"errors"
+	"time"
 )
 
-func DecodeMsgPacket(buffer *bytes.Buffer) MsgProtocol {
+var errShortPacket = errors.New("packet is not the full message")
 
-	var packet MsgProtocol
-	dec := gob.NewDecoder(buffer)
-
-	err := dec.Decode(&packet)
-	if err != nil {
-		log.Print(err)
+func DecodeMsgPacket(packet []byte) (MsgProtocol, error) {
+	if len(packet) == 0 {
+		return MsgProtocol{}, errShortPacket
+	}
+	p := MsgProtocol{
+		MessageType: MessageType(packet[0]),
 	}
-	return packet
+	r := packetReader{buf: packet[1:]}
 
+	p.MessageID = r.uvarint()
+	p.PacketNum = uint16(r.uvarint())
+	p.NumPackets = uint16(r.uvarint())
+	p.DateTime = time.UnixMilli(r.varint()).UTC()
+	p.Username = string(r.lengthPrefixed())
+	p.UserColour = string(r.lengthPrefixed())
+	p.Channel = string(r.lengthPrefixed())
+	p.Data = r.lengthPrefixed()
+	if r.err != nil {
+		return MsgProtocol{}, r.err
+	}
+	return p, nil
 }
 
-func DecodeAESPacket(buffer *bytes.Buffer) AESProtocol {
+// packetReader reads the fields written by encodeMsgPacket. The first error
+// is kept and all later reads return zero values.
+type packetReader struct {
+	buf []byte
+	err error
+}
 
-	var packet AESProtocol
-	dec := gob.NewDecoder(buffer)
+func (r *packetReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errShortPacket
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
 
-	err := dec.Decode(&packet)
-	if err != nil {
-		log.Print(err)
+func (r *packetReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errShortPacket
+		return 0
 	}
-	return packet
+	r.buf = r.buf[n:]
+	return v
+}
 
+func (r *packetReader) lengthPrefixed() []byte {
+	size := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if size > uint64(len(r.buf)) {
+		r.err = errShortPacket
+		return nil
+	}
+	field := r.buf[:size]
+	r.buf = r.buf[size:]
+	return field
 }
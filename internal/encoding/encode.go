@@ -2,11 +2,10 @@ package encoding
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"time"
 	"unsafe"
-
-	"github.com/MatthewTully/simple-chat-server/internal/crypto"
 )
 
 func encodePacket(packet any) (*bytes.Buffer, error) {
@@ -21,6 +20,34 @@ func encodePacket(packet any) (*bytes.Buffer, error) {
 
 }
 
+// encodeMsgPacket writes the envelope as
+//
+//	type(1) | messageID(uvarint) | packetNum(uvarint) | numPackets(uvarint) |
+//	unix millis(varint) | len(uvarint) username | len(uvarint) colour |
+//	len(uvarint) channel | len(uvarint) data
+//
+// so a KeepAlive costs a handful of bytes rather than a full data array.
+func encodeMsgPacket(p MsgProtocol) []byte {
+	size := 1 + 2*binary.MaxVarintLen64 + 2*binary.MaxVarintLen16 + 4*binary.MaxVarintLen32 + len(p.Username) + len(p.UserColour) + len(p.Channel) + len(p.Data)
+	buf := make([]byte, 0, size)
+
+	buf = append(buf, byte(p.MessageType))
+	buf = binary.AppendUvarint(buf, p.MessageID)
+	buf = binary.AppendUvarint(buf, uint64(p.PacketNum))
+	buf = binary.AppendUvarint(buf, uint64(p.NumPackets))
+	buf = binary.AppendVarint(buf, p.DateTime.UnixMilli())
+	buf = appendLengthPrefixed(buf, []byte(p.Username))
+	buf = appendLengthPrefixed(buf, []byte(p.UserColour))
+	buf = appendLengthPrefixed(buf, []byte(p.Channel))
+	buf = appendLengthPrefixed(buf, p.Data)
+	return buf
+}
+
+func appendLengthPrefixed(buf, field []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(field)))
+	return append(buf, field...)
+}
+
 func packageMessageString(msg string) []MsgProtocol {
 	msgBytes := []byte(msg)
 	return packageMessageBytes(msgBytes)
@@ -35,31 +62,10 @@ func packageMessageBytes(msg []byte) []MsgProtocol {
 		protocolSlice = append(protocolSlice, tmpSlice...)
 		lengthMessage = len(msg)
 	}
-	var m [MaxMessageSize]byte
-	copy(m[:], msg)
 	newProtocol := MsgProtocol{
 		DateTime: time.Now().UTC(),
-		Data:     m,
-		MsgSize:  uint16(lengthMessage),
+		Data:     msg,
 	}
 	protocolSlice = append(protocolSlice, newProtocol)
 	return protocolSlice
 }
-
-func packageAESBytes(msg []byte, sig []byte) AESProtocol {
-	lengthMessage := uint16(len(msg))
-	lengthSig := uint16(len(sig))
-
-	var m [crypto.EncodedKeySize]byte
-	var s [crypto.EncodedKeySize]byte
-	copy(m[:], msg)
-	copy(s[:], sig)
-	newProtocol := AESProtocol{
-		DateTime: time.Now().UTC(),
-		Data:     m,
-		MsgSize:  lengthMessage,
-		Sig:      s,
-		SigSize:  lengthSig,
-	}
-	return newProtocol
-}
@@ -3,9 +3,12 @@ package encoding
 import (
 	"bytes"
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/MatthewTully/simple-chat-server/internal/crypto"
 )
 
 const (
@@ -56,14 +59,11 @@ func TestPackageMessageBytes(t *testing.T) {
 				t.Errorf("Expected %v structs in slice. Got %v\n", tc.expectedTotal, len(got))
 			}
 			for i, protocols := range got {
-				if len(protocols.Data) != MaxMessageSize {
-					t.Errorf("Expected data size to be %v, Got %v\n", MaxMessageSize, len(protocols.Data))
-				}
-				if tc.expectedMsgSize[i] != protocols.MsgSize {
-					t.Errorf("Expected protocol data size to be to be %v, Got (%v)\n", tc.expectedMsgSize[i], protocols.MsgSize)
+				if tc.expectedMsgSize[i] != uint16(len(protocols.Data)) {
+					t.Errorf("Expected protocol data size to be to be %v, Got (%v)\n", tc.expectedMsgSize[i], len(protocols.Data))
 				}
-				if string(protocols.Data[:protocols.MsgSize]) != tc.expectedString[i] {
-					t.Errorf("Expected protocol data [%v] %v to Equal %v\n", i, string(protocols.Data[:protocols.MsgSize]), tc.expectedString[i])
+				if string(protocols.Data) != tc.expectedString[i] {
+					t.Errorf("Expected protocol data [%v] %v to Equal %v\n", i, string(protocols.Data), tc.expectedString[i])
 				}
 			}
 		})
@@ -95,7 +95,7 @@ func TestPackageMessageString(t *testing.T) {
 			}
 			var sb strings.Builder
 			for _, protocols := range got {
-				sb.Write(protocols.Data[:protocols.MsgSize])
+				sb.Write(protocols.Data)
 			}
 			reconstructedMsg := sb.String()
 			if tc.input != reconstructedMsg {
@@ -106,38 +106,183 @@ func TestPackageMessageString(t *testing.T) {
 	}
 }
 
-func TestEncodePacket(t *testing.T) {
-	var userNameArr, userColourArr [32]byte
-
-	usernameSlice := []byte("TestUser")
-	userColourSlice := []byte("green")
-	copy(userNameArr[:], usernameSlice)
-	copy(userColourArr[:], userColourSlice)
-
-	dataPacket := MsgProtocol{
-		MessageType:    KeepAlive,
-		DateTime:       time.Now().UTC(),
-		Data:           [MaxMessageSize]byte{},
-		MsgSize:        0,
-		Username:       userNameArr,
-		UsernameSize:   uint16(len(usernameSlice)),
-		UserColour:     userColourArr,
-		UserColourSize: uint16(len(userColourSlice)),
+func TestEncodeMsgPacket(t *testing.T) {
+	cases := []struct {
+		name   string
+		packet MsgProtocol
+	}{
+		{
+			name: "keep alive",
+			packet: MsgProtocol{
+				MessageType: KeepAlive,
+				PacketNum:   1,
+				NumPackets:  1,
+				DateTime:    time.Now().UTC().Truncate(time.Millisecond),
+				Username:    "TestUser",
+				UserColour:  "green",
+				Data:        []byte{},
+			},
+		}, {
+			name: "full chunk of a multi packet message",
+			packet: MsgProtocol{
+				MessageType: Message,
+				MessageID:   NewMessageID(),
+				PacketNum:   2,
+				NumPackets:  300,
+				DateTime:    time.Now().UTC().Truncate(time.Millisecond),
+				Username:    "TestUser",
+				UserColour:  "green",
+				Data:        []byte(longTestString[:MaxMessageSize]),
+			},
+		}, {
+			name: "channel message",
+			packet: MsgProtocol{
+				MessageType: Message,
+				MessageID:   NewMessageID(),
+				PacketNum:   1,
+				NumPackets:  1,
+				DateTime:    time.Now().UTC().Truncate(time.Millisecond),
+				Username:    "TestUser",
+				UserColour:  "green",
+				Channel:     "#random",
+				Data:        []byte("hello #random"),
+			},
+		},
 	}
-	encodedPacket, err := encodePacket(dataPacket)
-	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			encodedPacket := encodeMsgPacket(tc.packet)
+			fmt.Printf("Len of packet: %v\n", len(encodedPacket))
+
+			decodedPacket, err := DecodeMsgPacket(encodedPacket)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(decodedPacket, tc.packet) {
+				t.Errorf("decoded packet does not match original packet. Expected %v, Got %v", tc.packet, decodedPacket)
+			}
+
+			for i := range len(encodedPacket) {
+				_, err := DecodeMsgPacket(encodedPacket[:i])
+				if err == nil {
+					t.Errorf("Expected error decoding packet truncated to %d bytes", i)
+				}
+			}
+		})
 	}
+}
 
-	tmp := encodedPacket.Bytes()
-	fmt.Printf("Len of packet: %v\n", len(tmp))
+func TestValidChannelName(t *testing.T) {
+	cases := []struct {
+		name    string
+		channel string
+		valid   bool
+	}{
+		{name: "default", channel: DefaultChannel, valid: true},
+		{name: "no hash", channel: "general", valid: false},
+		{name: "only hash", channel: "#", valid: false},
+		{name: "space", channel: "#two words", valid: false},
+		{name: "too long", channel: "#" + strings.Repeat("a", MaxChannelSize), valid: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidChannelName(tc.channel)
+			if (err == nil) != tc.valid {
+				t.Errorf("Expected valid %v for %q, Got %v", tc.valid, tc.channel, err)
+			}
+		})
+	}
+}
+
+// legacyMsgProtocol is the fixed size envelope used before protocol version 2,
+// kept here to compare wire sizes.
+type legacyMsgProtocol struct {
+	MessageType    MessageType
+	MsgSize        uint16
+	UsernameSize   uint16
+	UserColourSize uint16
+	Username       [32]byte
+	UserColour     [32]byte
+	DateTime       time.Time
+	Data           [MaxMessageSize]byte
+}
+
+func legacyEncode(p MsgProtocol) []byte {
+	legacy := legacyMsgProtocol{
+		MessageType:    p.MessageType,
+		MsgSize:        uint16(len(p.Data)),
+		UsernameSize:   uint16(len(p.Username)),
+		UserColourSize: uint16(len(p.UserColour)),
+		DateTime:       p.DateTime,
+	}
+	copy(legacy.Username[:], p.Username)
+	copy(legacy.UserColour[:], p.UserColour)
+	copy(legacy.Data[:], p.Data)
+	buf, err := encodePacket(legacy)
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
 
-	decodedPacket := DecodeMsgPacket(bytes.NewBuffer(tmp))
-	fmt.Printf("Decoded Packet.MessageType: %v\n", decodedPacket.MessageType)
-	fmt.Printf("Decoded Packet.DateTime: %v\n", decodedPacket.DateTime)
+var benchmarkMessages = []struct {
+	name        string
+	messageType MessageType
+	data        []byte
+}{
+	{"keep-alive", KeepAlive, []byte{}},
+	{"one-char", Message, []byte("k")},
+	{"chat-line", Message, []byte("Hey everyone, is the meeting still on for 3pm?")},
+	{"full-chunk", Message, []byte(longTestString[:MaxMessageSize])},
+}
 
-	if decodedPacket != dataPacket {
-		t.Errorf("decoded packet does not match original packet. Expected %v, Got %v", dataPacket, decodedPacket)
+func BenchmarkEnvelopeSize(b *testing.B) {
+	for _, bm := range benchmarkMessages {
+		p := MsgProtocol{
+			MessageType: bm.messageType,
+			PacketNum:   1,
+			NumPackets:  1,
+			DateTime:    time.Now().UTC(),
+			Username:    "TestUser",
+			UserColour:  "green",
+			Data:        bm.data,
+		}
+		b.Run(bm.name+"/legacy", func(b *testing.B) {
+			var size int
+			for range b.N {
+				// legacy packets were also prefixed with a 6 byte packet header
+				size = len(legacyEncode(p)) + 6
+			}
+			b.ReportMetric(float64(size), "bytes/msg")
+		})
+		b.Run(bm.name+"/compact", func(b *testing.B) {
+			var size int
+			for range b.N {
+				size = len(encodeMsgPacket(p))
+			}
+			b.ReportMetric(float64(size), "bytes/msg")
+		})
 	}
+}
 
+func BenchmarkSealedPackets(b *testing.B) {
+	key := bytes.Repeat([]byte{1}, 32)
+	session := crypto.NewSession(crypto.SessionKeys{ClientToServer: key, ServerToClient: key}, false)
+	for _, bm := range benchmarkMessages {
+		b.Run(bm.name, func(b *testing.B) {
+			var size int
+			for range b.N {
+				size = 0
+				for _, p := range PrepPacketsForSending(bm.data, bm.messageType, "TestUser", "green") {
+					frame, err := session.Encrypt(p)
+					if err != nil {
+						b.Fatal(err)
+					}
+					size += len(frame) + FrameHeaderSize
+				}
+			}
+			b.ReportMetric(float64(size), "wire-bytes/msg")
+		})
+	}
 }
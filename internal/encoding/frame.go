@@ -0,0 +1,148 @@
+package encoding
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	FrameHeaderSize = 4
+	MaxFrameSize    = 64 * 1024
+	// MaxSealOverhead is the most a seal function passed to WriteSealedFrames
+	// may add to a payload: a sequence number, GCM nonce and tag.
+	MaxSealOverhead = 8 + 12 + 16
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame exceeds maximum frame size")
+	ErrWriterFailed  = errors.New("frame writer failed")
+)
+
+// FrameReader reads length-prefixed frames from a stream. Each frame is a
+// 4 byte big endian payload length followed by the payload itself.
+type FrameReader struct {
+	r      *bufio.Reader
+	header [FrameHeaderSize]byte
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{
+		r: bufio.NewReaderSize(r, MaxPacketSize),
+	}
+}
+
+// ReadFrame blocks until a full frame has been read. io.EOF is only returned
+// when the stream ends cleanly on a frame boundary.
+func (fr *FrameReader) ReadFrame() ([]byte, error) {
+	_, err := io.ReadFull(fr.r, fr.header[:])
+	if err != nil {
+		return nil, err
+	}
+	frameSize := binary.BigEndian.Uint32(fr.header[:])
+	if frameSize > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, frameSize)
+	}
+
+	frame := make([]byte, frameSize)
+	_, err = io.ReadFull(fr.r, frame)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+// FrameWriter writes length-prefixed frames to a stream. It is safe for
+// concurrent use, frames from separate calls are never interleaved.
+type FrameWriter struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	err error
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{
+		w: bufio.NewWriterSize(w, MaxPacketSize),
+	}
+}
+
+func (fw *FrameWriter) WriteFrame(frame []byte) error {
+	return fw.WriteFrames(frame)
+}
+
+// WriteFrames writes all frames and flushes them to the underlying writer as
+// a single unit.
+func (fw *FrameWriter) WriteFrames(frames ...[]byte) error {
+	for _, frame := range frames {
+		if len(frame) > MaxFrameSize {
+			return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(frame))
+		}
+	}
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.err != nil {
+		return fw.err
+	}
+	return fw.writeFrames(frames)
+}
+
+// WriteSealedFrames seals each payload with seal while holding the write
+// lock, so frames reach the stream in the order they were sealed. Use it when
+// frames carry sequence numbers. Sizes are checked before anything is sealed,
+// as sealing uses up a sequence number. If sealing or writing fails part way,
+// the peer can no longer follow the sequence, so every later write fails with
+// ErrWriterFailed.
+func (fw *FrameWriter) WriteSealedFrames(seal func([]byte) ([]byte, error), payloads ...[]byte) error {
+	for _, p := range payloads {
+		if len(p)+MaxSealOverhead > MaxFrameSize {
+			return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(p)+MaxSealOverhead)
+		}
+	}
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.err != nil {
+		return fw.err
+	}
+
+	frames := make([][]byte, 0, len(payloads))
+	for _, p := range payloads {
+		frame, err := seal(p)
+		if err != nil {
+			fw.err = fmt.Errorf("%w: could not seal frame: %v", ErrWriterFailed, err)
+			return fw.err
+		}
+		frames = append(frames, frame)
+	}
+	return fw.writeFrames(frames)
+}
+
+// writeFrames writes the frames, and fails the writer if they are not all
+// written, as the peer would see a partial frame.
+func (fw *FrameWriter) writeFrames(frames [][]byte) error {
+	var header [FrameHeaderSize]byte
+	for _, frame := range frames {
+		binary.BigEndian.PutUint32(header[:], uint32(len(frame)))
+		_, err := fw.w.Write(header[:])
+		if err == nil {
+			_, err = fw.w.Write(frame)
+		}
+		if err != nil {
+			fw.err = fmt.Errorf("%w: %w", ErrWriterFailed, err)
+			return fw.err
+		}
+	}
+	err := fw.w.Flush()
+	if err != nil {
+		fw.err = fmt.Errorf("%w: %w", ErrWriterFailed, err)
+		return fw.err
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package encoding
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	cases := []struct {
+		name   string
+		frames [][]byte
+	}{
+		{
+			name:   "single frame",
+			frames: [][]byte{[]byte("hello")},
+		}, {
+			name:   "empty frame",
+			frames: [][]byte{{}},
+		}, {
+			name: "frame containing old header pattern",
+			frames: [][]byte{
+				{0, 0, 27, 0, 5, 19, 93, 255, 255, 255, 1, 2, 3},
+				{0, 0, 27, 0, 5, 19, 93, 255, 255, 255},
+			},
+		}, {
+			name:   "frame larger than read buffer",
+			frames: [][]byte{bytes.Repeat([]byte("a"), MaxPacketSize*3), []byte("b")},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := NewFrameWriter(&buf).WriteFrames(tc.frames...)
+			if err != nil {
+				t.Fatalf("Unexpected error writing frames: %v", err)
+			}
+
+			fr := NewFrameReader(iotest.OneByteReader(&buf))
+			for i, expected := range tc.frames {
+				got, err := fr.ReadFrame()
+				if err != nil {
+					t.Fatalf("Unexpected error reading frame %d: %v", i, err)
+				}
+				if !bytes.Equal(got, expected) {
+					t.Errorf("Frame %d does not match. Expected %v, Got %v", i, expected, got)
+				}
+			}
+			_, err = fr.ReadFrame()
+			if err != io.EOF {
+				t.Errorf("Expected io.EOF after last frame, Got %v", err)
+			}
+		})
+	}
+}
+
+func TestFrameReaderErrors(t *testing.T) {
+	oversized := binary.BigEndian.AppendUint32([]byte{}, MaxFrameSize+1)
+	truncated := binary.BigEndian.AppendUint32([]byte{}, 10)
+	truncated = append(truncated, []byte("short")...)
+
+	cases := []struct {
+		name        string
+		input       []byte
+		expectedErr error
+	}{
+		{
+			name:        "frame over max size",
+			input:       oversized,
+			expectedErr: ErrFrameTooLarge,
+		}, {
+			name:        "stream ends mid frame",
+			input:       truncated,
+			expectedErr: io.ErrUnexpectedEOF,
+		}, {
+			name:        "stream ends mid header",
+			input:       []byte{0, 0},
+			expectedErr: io.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewFrameReader(bytes.NewReader(tc.input)).ReadFrame()
+			if !errors.Is(err, tc.expectedErr) {
+				t.Errorf("Expected error %v, Got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestFrameWriterRejectsOversizedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	err := NewFrameWriter(&buf).WriteFrame(make([]byte, MaxFrameSize+1))
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Expected error %v, Got %v", ErrFrameTooLarge, err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing to be written, Got %d bytes", buf.Len())
+	}
+}
+
+// failingWriter accepts limit bytes, then fails every write.
+type failingWriter struct {
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errors.New("connection reset")
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestWriteSealedFrames(t *testing.T) {
+	sealed := 0
+	seal := func(p []byte) ([]byte, error) {
+		sealed++
+		return append(make([]byte, MaxSealOverhead), p...), nil
+	}
+
+	t.Run("oversized payload is rejected before sealing", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := NewFrameWriter(&buf).WriteSealedFrames(seal, []byte("fits"), make([]byte, MaxFrameSize-MaxSealOverhead+1))
+		if !errors.Is(err, ErrFrameTooLarge) {
+			t.Errorf("Expected error %v, Got %v", ErrFrameTooLarge, err)
+		}
+		if sealed != 0 || buf.Len() != 0 {
+			t.Errorf("Expected nothing to be sealed or written, Got %d sealed and %d bytes", sealed, buf.Len())
+		}
+	})
+
+	t.Run("failed write fails the writer", func(t *testing.T) {
+		fw := NewFrameWriter(&failingWriter{limit: FrameHeaderSize})
+		err := fw.WriteSealedFrames(seal, make([]byte, MaxPacketSize))
+		if !errors.Is(err, ErrWriterFailed) {
+			t.Fatalf("Expected error %v, Got %v", ErrWriterFailed, err)
+		}
+		sealed = 0
+		err = fw.WriteSealedFrames(seal, []byte("after"))
+		if !errors.Is(err, ErrWriterFailed) {
+			t.Errorf("Expected later writes to fail with %v, Got %v", ErrWriterFailed, err)
+		}
+		if sealed != 0 {
+			t.Errorf("Expected nothing to be sealed after the writer failed")
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package encoding
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ProtocolVersion is the current version of the wire protocol. It is raised
+// whenever a change means older peers can no longer talk to this build, and
+// MinProtocolVersion is raised with it until a build can speak more than one
+// version. Peers still negotiate over the range they each support, so a
+// future build can keep accepting older clients.
+const (
+	ProtocolVersion    uint16 = 15
+	MinProtocolVersion        = ProtocolVersion
+	MaxProtocolVersion        = ProtocolVersion
+)
+
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+type Capability uint32
+
+const (
+	CapMultiPacket Capability = 1 << iota
+	CapWhisper
+	// CapTLSOnly turns off the app-layer encryption. It is only offered and
+	// granted over a TLS connection, when both sides are configured to allow
+	// it.
+	CapTLSOnly
+	// CapAdmin lets the user send AdminCommands. It is only granted to the
+	// server's admins.
+	CapAdmin
+)
+
+const SupportedCapabilities = CapMultiPacket | CapWhisper | CapTLSOnly | CapAdmin
+
+var capabilityNames = []struct {
+	cap  Capability
+	name string
+}{
+	{CapMultiPacket, "multi-packet"},
+	{CapWhisper, "whisper"},
+	{CapTLSOnly, "tls-only"},
+	{CapAdmin, "admin"},
+}
+
+func (c Capability) Has(other Capability) bool {
+	return c&other == other
+}
+
+func (c Capability) String() string {
+	names := []string{}
+	for _, n := range capabilityNames {
+		if c.Has(n.cap) {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// HandshakeProtocol is exchanged in the clear before the encrypted channel is
+// set up, for the RequestConnect handshake, the KeyExchange and any error
+// sent before keys exist. It is gob encoded so fields can be added without
+// breaking peers running another protocol version, which lets them be
+// refused cleanly.
+//
+// PasswordRequired is set in the server's response when the client must send
+// an Authenticate message, with a password or invite token, once the
+// encrypted channel is up.
+type HandshakeProtocol struct {
+	MessageType      MessageType
+	MinVersion       uint16
+	MaxVersion       uint16
+	Capabilities     Capability
+	Username         string
+	UserColour       string
+	PublicKey        []byte
+	EphemeralKey     []byte
+	Signature        []byte
+	Error            string
+	PasswordRequired bool
+	DateTime         time.Time
+}
+
+func VersionRange(min, max uint16) string {
+	if min == max {
+		return fmt.Sprintf("%d", min)
+	}
+	return fmt.Sprintf("%d-%d", min, max)
+}
+
+// NegotiateVersion returns the highest protocol version supported by both
+// this build and the remote peer.
+func NegotiateVersion(remoteMin, remoteMax uint16) (uint16, error) {
+	version := min(remoteMax, MaxProtocolVersion)
+	if remoteMin > remoteMax || version < max(remoteMin, MinProtocolVersion) {
+		return 0, fmt.Errorf("%w %v, supported versions are %v", ErrUnsupportedVersion, VersionRange(remoteMin, remoteMax), VersionRange(MinProtocolVersion, MaxProtocolVersion))
+	}
+	return version, nil
+}
+
+func PrepHandshakeForSending(h HandshakeProtocol) ([]byte, error) {
+	h.DateTime = time.Now().UTC()
+	dataPacket, err := encodePacket(h)
+	if err != nil {
+		return nil, err
+	}
+	return dataPacket.Bytes(), nil
+}
+
+func DecodeHandshakePacket(frame []byte) (HandshakeProtocol, error) {
+	var packet HandshakeProtocol
+	dec := gob.NewDecoder(bytes.NewBuffer(frame))
+
+	err := dec.Decode(&packet)
+	if err != nil {
+		return HandshakeProtocol{}, fmt.Errorf("could not decode handshake: %v", err)
+	}
+	return packet, nil
+}
@@ -0,0 +1,91 @@
+package encoding
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	cases := []struct {
+		name            string
+		remoteMin       uint16
+		remoteMax       uint16
+		expectedVersion uint16
+		expectedErr     error
+	}{
+		{
+			name:            "same range",
+			remoteMin:       MinProtocolVersion,
+			remoteMax:       MaxProtocolVersion,
+			expectedVersion: MaxProtocolVersion,
+		}, {
+			name:            "remote supports newer versions",
+			remoteMin:       MinProtocolVersion,
+			remoteMax:       MaxProtocolVersion + 5,
+			expectedVersion: MaxProtocolVersion,
+		}, {
+			name:        "remote too old",
+			remoteMin:   0,
+			remoteMax:   MinProtocolVersion - 1,
+			expectedErr: ErrUnsupportedVersion,
+		}, {
+			name:        "remote too new",
+			remoteMin:   MaxProtocolVersion + 1,
+			remoteMax:   MaxProtocolVersion + 2,
+			expectedErr: ErrUnsupportedVersion,
+		}, {
+			name:        "invalid remote range",
+			remoteMin:   MaxProtocolVersion,
+			remoteMax:   MinProtocolVersion - 1,
+			expectedErr: ErrUnsupportedVersion,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := NegotiateVersion(tc.remoteMin, tc.remoteMax)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Errorf("Expected error %v, Got %v", tc.expectedErr, err)
+			}
+			if got != tc.expectedVersion {
+				t.Errorf("Expected version %v, Got %v", tc.expectedVersion, got)
+			}
+		})
+	}
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	handshake := HandshakeProtocol{
+		MessageType:  RequestConnect,
+		MinVersion:   MinProtocolVersion,
+		MaxVersion:   MaxProtocolVersion,
+		Capabilities: SupportedCapabilities,
+		Username:     "TestUser",
+		UserColour:   "green",
+		PublicKey:    []byte("not a real key"),
+	}
+	frame, err := PrepHandshakeForSending(handshake)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	got, err := DecodeHandshakePacket(frame)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got.MessageType != handshake.MessageType || got.MaxVersion != handshake.MaxVersion || got.Capabilities != handshake.Capabilities {
+		t.Errorf("Decoded handshake does not match. Expected %v, Got %v", handshake, got)
+	}
+	if got.Username != handshake.Username || string(got.PublicKey) != string(handshake.PublicKey) {
+		t.Errorf("Decoded handshake does not match. Expected %v, Got %v", handshake, got)
+	}
+}
+
+func TestCapabilityString(t *testing.T) {
+	if got := Capability(0).String(); got != "none" {
+		t.Errorf("Expected none, Got %v", got)
+	}
+	if got := (CapMultiPacket | CapWhisper).String(); got != "multi-packet, whisper" {
+		t.Errorf("Expected multi-packet, whisper, Got %v", got)
+	}
+}
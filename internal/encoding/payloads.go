@@ -0,0 +1,281 @@
+package encoding
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+)
+
+// ActiveUser is one entry of the ServerActiveUsers list. The public key lets
+// clients seal whispers for the user and verify whispers from them.
+type ActiveUser struct {
+	Username   string
+	UserColour string
+	PublicKey  []byte
+	Host       bool
+}
+
+// WhisperPayload is the data of a WhisperMessage. Sealed is encrypted for the
+// recipient, so the server only relays it. From is set by the server to the
+// authenticated sender.
+type WhisperPayload struct {
+	To     string
+	From   string
+	Sealed []byte
+}
+
+// ChannelInfo is one entry of the ChannelList sent by the server.
+type ChannelInfo struct {
+	Name    string
+	Members int
+}
+
+type RecordType uint8
+
+const (
+	// RecordMessage is a message sent by a user.
+	RecordMessage RecordType = iota + 1
+	// RecordNotice is a notice from the server, such as a user joining.
+	RecordNotice
+)
+
+// ChatRecord is a message in a channel, as the server sends it in a
+// ChatMessage and keeps it in history. Clients decide how to show it.
+type ChatRecord struct {
+	ID     uint64
+	Type   RecordType
+	Sender string
+	Colour string
+	Sent   time.Time
+	Body   []byte
+}
+
+// HistoryRequestPayload is the data of a HistoryRequest, asking for up to
+// Limit records of a channel sent before the record with ID Before.
+type HistoryRequestPayload struct {
+	Before uint64
+	Limit  int
+}
+
+// HistoryPagePayload is the data of a HistoryPage, the records oldest first.
+// Before is 0 for the latest records, sent when joining a channel, or the ID
+// asked for in a HistoryRequest. More is set if there are older records.
+type HistoryPagePayload struct {
+	Before  uint64
+	Records []ChatRecord
+	More    bool
+}
+
+// AdminCommandPayload is the data of an AdminCommand, such as kick with the
+// username as its argument.
+type AdminCommandPayload struct {
+	Command string
+	Args    []string
+}
+
+// AuthPayload is the data of a client's Authenticate message. If Invite is
+// set the server checks it instead of the password.
+type AuthPayload struct {
+	Password string
+	Invite   string
+}
+
+type RekeyPhase uint8
+
+const (
+	RekeyRequest RekeyPhase = iota + 1
+	RekeyResponse
+	RekeyDone
+)
+
+func (p RekeyPhase) String() string {
+	switch p {
+	case RekeyRequest:
+		return "request"
+	case RekeyResponse:
+		return "response"
+	case RekeyDone:
+		return "done"
+	}
+	return fmt.Sprintf("RekeyPhase(%d)", p)
+}
+
+// RekeyPayload is the data of a Rekey message, see crypto.Session for the
+// exchange.
+type RekeyPayload struct {
+	Phase        RekeyPhase
+	EphemeralKey []byte
+}
+
+func EncodeActiveUsers(users []ActiveUser) ([]byte, error) {
+	buf, err := encodePacket(users)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode active users: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeActiveUsers(data []byte) ([]ActiveUser, error) {
+	var users []ActiveUser
+	err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&users)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode active users: %v", err)
+	}
+	return users, nil
+}
+
+func EncodeWhisper(w WhisperPayload) ([]byte, error) {
+	buf, err := encodePacket(w)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode whisper: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeWhisper(data []byte) (WhisperPayload, error) {
+	var w WhisperPayload
+	err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&w)
+	if err != nil {
+		return WhisperPayload{}, fmt.Errorf("could not decode whisper: %v", err)
+	}
+	return w, nil
+}
+
+func EncodeRekey(r RekeyPayload) ([]byte, error) {
+	buf, err := encodePacket(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode rekey: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeRekey(data []byte) (RekeyPayload, error) {
+	var r RekeyPayload
+	err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&r)
+	if err != nil {
+		return RekeyPayload{}, fmt.Errorf("could not decode rekey: %v", err)
+	}
+	return r, nil
+}
+
+func EncodeAuth(a AuthPayload) ([]byte, error) {
+	buf, err := encodePacket(a)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode authentication: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeAuth(data []byte) (AuthPayload, error) {
+	var a AuthPayload
+	err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&a)
+	if err != nil {
+		return AuthPayload{}, fmt.Errorf("could not decode authentication: %v", err)
+	}
+	return a, nil
+}
+
+// EncodeChannelMembers encodes the usernames in a channel, the data of a
+// ChannelMembers message.
+func EncodeChannelMembers(members []string) ([]byte, error) {
+	buf, err := encodePacket(members)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode channel members: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeChannelMembers(data []byte) ([]string, error) {
+	var members []string
+	err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&members)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode channel members: %v", err)
+	}
+	return members, nil
+}
+
+func EncodeChannelList(channels []ChannelInfo) ([]byte, error) {
+	buf, err := encodePacket(channels)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode channel list: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeChannelList(data []byte) ([]ChannelInfo, error) {
+	var channels []ChannelInfo
+	err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&channels)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode channel list: %v", err)
+	}
+	return channels, nil
+}
+
+func EncodeChatRecord(r ChatRecord) ([]byte, error) {
+	buf, err := encodePacket(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode chat record: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeChatRecord(data []byte) (ChatRecord, error) {
+	var r ChatRecord
+	err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&r)
+	if err != nil {
+		return ChatRecord{}, fmt.Errorf("could not decode chat record: %v", err)
+	}
+	return r, nil
+}
+
+func EncodeHistoryRequest(r HistoryRequestPayload) ([]byte, error) {
+	buf, err := encodePacket(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode history request: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeHistoryRequest(data []byte) (HistoryRequestPayload, error) {
+	var r HistoryRequestPayload
+	err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&r)
+	if err != nil {
+		return HistoryRequestPayload{}, fmt.Errorf("could not decode history request: %v", err)
+	}
+	return r, nil
+}
+
+func EncodeHistoryPage(p HistoryPagePayload) ([]byte, error) {
+	buf, err := encodePacket(p)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode history page: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeHistoryPage(data []byte) (HistoryPagePayload, error) {
+	var p HistoryPagePayload
+	err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&p)
+	if err != nil {
+		return HistoryPagePayload{}, fmt.Errorf("could not decode history page: %v", err)
+	}
+	return p, nil
+}
+
+func EncodeAdminCommand(a AdminCommandPayload) ([]byte, error) {
+	buf, err := encodePacket(a)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode admin command: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeAdminCommand(data []byte) (AdminCommandPayload, error) {
+	var a AdminCommandPayload
+	err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&a)
+	if err != nil {
+		return AdminCommandPayload{}, fmt.Errorf("could not decode admin command: %v", err)
+	}
+	return a, nil
+}
@@ -0,0 +1,89 @@
+package encoding
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestActiveUsersRoundTrip(t *testing.T) {
+	users := []ActiveUser{
+		{Username: "alice", UserColour: "red", PublicKey: []byte("alice key"), Host: true},
+		{Username: "bob", UserColour: "blue", PublicKey: []byte("bob key")},
+	}
+	data, err := EncodeActiveUsers(users)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	got, err := DecodeActiveUsers(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, users) {
+		t.Errorf("Expected %v, Got %v", users, got)
+	}
+
+	_, err = DecodeActiveUsers([]byte("[red]alice[white];"))
+	if err == nil {
+		t.Errorf("Expected error decoding the old active users format")
+	}
+}
+
+func TestWhisperRoundTrip(t *testing.T) {
+	whisper := WhisperPayload{To: "bob", From: "alice", Sealed: []byte{1, 2, 3}}
+	data, err := EncodeWhisper(whisper)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	got, err := DecodeWhisper(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, whisper) {
+		t.Errorf("Expected %v, Got %v", whisper, got)
+	}
+}
+
+func TestHistoryRoundTrip(t *testing.T) {
+	records := []ChatRecord{
+		{ID: 1, Type: RecordNotice, Sender: "Chat Server", Colour: "white", Sent: time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC), Body: []byte("User alice has joined #general\n")},
+		{ID: 2, Type: RecordMessage, Sender: "alice", Colour: "red", Sent: time.Date(2024, 5, 1, 9, 31, 0, 0, time.UTC), Body: []byte("hello")},
+	}
+	page := HistoryPagePayload{Before: 3, Records: records, More: true}
+	data, err := EncodeHistoryPage(page)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	got, err := DecodeHistoryPage(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, page) {
+		t.Errorf("Expected %v, Got %v", page, got)
+	}
+
+	request := HistoryRequestPayload{Before: 1, Limit: 50}
+	data, err = EncodeHistoryRequest(request)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	gotRequest, err := DecodeHistoryRequest(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if gotRequest != request {
+		t.Errorf("Expected %v, Got %v", request, gotRequest)
+	}
+
+	data, err = EncodeChatRecord(records[1])
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	record, err := DecodeChatRecord(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(record, records[1]) {
+		t.Errorf("Expected %v, Got %v", records[1], record)
+	}
+}
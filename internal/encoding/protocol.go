@@ -1,164 +1,126 @@
 package encoding
 
 import (
-	"crypto/rsa"
-	"encoding/binary"
-	"log"
+	"fmt"
+	"strings"
 	"time"
-
-	"github.com/MatthewTully/simple-chat-server/internal/crypto"
 )
 
 type MessageType uint8
 
 const (
-	MaxMessageSize                   = 1000
-	MaxPacketSize                    = 1400
-	HeaderSize                       = 6
-	AESEncryptHeaderSize             = 2
-	RequestConnect       MessageType = iota
+	MaxMessageSize  = 1000
+	MaxPacketSize   = 1400
+	MaxUsernameSize = 32
+	MaxChannelSize  = 32
+	// MaxHistoryPageSize is the most records a client can ask for at once.
+	MaxHistoryPageSize = 100
+	DefaultChannel     = "#general"
+)
+
+const (
+	RequestConnect MessageType = iota + 1
 	RequestDisconnect
 	Message
 	KeepAlive
 	WhisperMessage
 	ServerActiveUsers
 	ErrorMessage
-	SendAESKey
+	KeyExchange
+	Rekey
+	Authenticate
+	JoinChannel
+	LeaveChannel
+	ChannelMembers
+	ChannelList
+	ChatMessage
+	HistoryRequest
+	HistoryPage
+	AdminCommand
 )
 
-var HeaderPattern = [...]byte{0, 0, 27, 0, 5, 19, 93, 255, 255, 255}
-
-type AESProtocol struct {
-	MessageType MessageType
-	MsgSize     uint16
-	SigSize     uint16
-	DateTime    time.Time
-	Data        [crypto.EncodedKeySize]byte
-	Sig         [crypto.EncodedKeySize]byte
-}
-
-type MsgProtocol struct {
-	MessageType    MessageType
-	MsgSize        uint16
-	UsernameSize   uint16
-	UserColourSize uint16
-	Username       [32]byte
-	UserColour     [32]byte
-	DateTime       time.Time
-	Data           [MaxMessageSize]byte
-}
-
-func setMsgProtocolUserFields(username, userColour string, p *MsgProtocol) {
-	var userNameArr, userColourArr [32]byte
-
-	usernameSlice := []byte(username)
-	userColourSlice := []byte(userColour)
-	copy(userNameArr[:], usernameSlice)
-	copy(userColourArr[:], userColourSlice)
-
-	p.Username = userNameArr
-	p.UsernameSize = uint16(len(usernameSlice))
-	p.UserColour = userColourArr
-	p.UserColourSize = uint16(len(userColourSlice))
+var messageTypeNames = map[MessageType]string{
+	RequestConnect:    "RequestConnect",
+	RequestDisconnect: "RequestDisconnect",
+	Message:           "Message",
+	KeepAlive:         "KeepAlive",
+	WhisperMessage:    "WhisperMessage",
+	ServerActiveUsers: "ServerActiveUsers",
+	ErrorMessage:      "ErrorMessage",
+	KeyExchange:       "KeyExchange",
+	Rekey:             "Rekey",
+	Authenticate:      "Authenticate",
+	JoinChannel:       "JoinChannel",
+	LeaveChannel:      "LeaveChannel",
+	ChannelMembers:    "ChannelMembers",
+	ChannelList:       "ChannelList",
+	ChatMessage:       "ChatMessage",
+	HistoryRequest:    "HistoryRequest",
+	HistoryPage:       "HistoryPage",
+	AdminCommand:      "AdminCommand",
 }
 
-func PrepHandshakeForSending(msg []byte, sentFrom, colour string) ([]byte, error) {
-	preppedBytes := []byte{}
-
-	toSend := packageMessageBytes(msg)
-	numPackets := uint16(len(toSend))
-	for i, p := range toSend {
-		p.MessageType = RequestConnect
-		setMsgProtocolUserFields(sentFrom, colour, &p)
-		dataPacket, err := encodePacket(p)
-		if err != nil {
-			return nil, err
-		}
-		packetLen := uint16(len(dataPacket.Bytes()))
-		packetNum := uint16(i + 1)
-		for _, i := range HeaderPattern {
-			preppedBytes = append(preppedBytes, i)
-		}
-
-		preppedBytes = binary.BigEndian.AppendUint16(preppedBytes, packetNum)
-		preppedBytes = binary.BigEndian.AppendUint16(preppedBytes, numPackets)
-		preppedBytes = binary.BigEndian.AppendUint16(preppedBytes, packetLen)
-		preppedBytes = append(preppedBytes, dataPacket.Bytes()...)
-
+func (t MessageType) String() string {
+	name, ok := messageTypeNames[t]
+	if !ok {
+		return fmt.Sprintf("MessageType(%d)", t)
 	}
-
-	return preppedBytes, nil
+	return name
 }
 
-func PrepAESForSending(key []byte, receiversPubKey *rsa.PublicKey, keyPair crypto.RSAKeys) ([]byte, error) {
-	preppedBytes := []byte{}
-
-	payloadSig, err := crypto.RSASign(key, keyPair.PrivateKey)
-	if err != nil {
-		log.Fatal(err)
-	}
-	encryptedPayload, err := crypto.RSAEncrypt(key, receiversPubKey)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	toSend := packageAESBytes(encryptedPayload, payloadSig)
-	numPackets := uint16(1)
+// MsgProtocol is the envelope for every message sent over the encrypted
+// channel. Only the bytes in use are sent, see encodeMsgPacket for the wire
+// layout.
+type MsgProtocol struct {
+	MessageType MessageType
+	MessageID   uint64
+	PacketNum   uint16
+	NumPackets  uint16
+	DateTime    time.Time
+	Username    string
+	UserColour  string
+	Channel     string
+	Data        []byte
+}
 
-	toSend.MessageType = SendAESKey
-	dataPacket, err := encodePacket(toSend)
-	if err != nil {
-		return nil, err
+// ValidChannelName checks a channel name is a # followed by up to
+// MaxChannelSize-1 bytes, with no spaces.
+func ValidChannelName(name string) error {
+	if len(name) < 2 || len(name) > MaxChannelSize || !strings.HasPrefix(name, "#") {
+		return fmt.Errorf("channel name must start with # and be between 2 and %d bytes", MaxChannelSize)
 	}
-	packetLen := uint16(len(dataPacket.Bytes()))
-	packetNum := uint16(1)
-	for _, i := range HeaderPattern {
-		preppedBytes = append(preppedBytes, i)
+	if strings.ContainsAny(name, " \t\n") {
+		return fmt.Errorf("channel name cannot contain spaces")
 	}
+	return nil
+}
 
-	preppedBytes = binary.BigEndian.AppendUint16(preppedBytes, packetNum)
-	preppedBytes = binary.BigEndian.AppendUint16(preppedBytes, numPackets)
-	preppedBytes = binary.BigEndian.AppendUint16(preppedBytes, packetLen)
-	preppedBytes = append(preppedBytes, dataPacket.Bytes()...)
-
-	return preppedBytes, nil
+// PrepPacketsForSending splits msg into encoded, unencrypted packets. The
+// packets are encrypted separately for each recipient's session as they are
+// written, see FrameWriter.WriteSealedFrames.
+func PrepPacketsForSending(msg []byte, messageType MessageType, sentFrom, colour string) [][]byte {
+	return PrepChannelPacketsForSending(msg, messageType, "", sentFrom, colour)
 }
 
-func PrepBytesForSending(msg []byte, messageType MessageType, sentFrom, colour string, AESKey []byte) ([]byte, error) {
-	preppedBytes := []byte{}
+// PrepChannelPacketsForSending is PrepPacketsForSending for a message that
+// belongs to a channel.
+func PrepChannelPacketsForSending(msg []byte, messageType MessageType, channel, sentFrom, colour string) [][]byte {
+	packets := [][]byte{}
 
 	toSend := packageMessageBytes(msg)
 	numPackets := uint16(len(toSend))
+	messageID := NewMessageID()
 
 	for i, p := range toSend {
 		p.MessageType = messageType
-		setMsgProtocolUserFields(sentFrom, colour, &p)
-		dataPacket, err := encodePacket(p)
-		if err != nil {
-			return nil, err
-		}
-		packetLen := uint16(len(dataPacket.Bytes()))
-		packetNum := uint16(i + 1)
-		for _, i := range HeaderPattern {
-			preppedBytes = append(preppedBytes, i)
-		}
-
-		payload := []byte{}
-		payload = binary.BigEndian.AppendUint16(payload, packetNum)
-		payload = binary.BigEndian.AppendUint16(payload, numPackets)
-		payload = binary.BigEndian.AppendUint16(payload, packetLen)
-		payload = append(payload, dataPacket.Bytes()...)
-
-		encryptedPayload, err := crypto.AESEncrypt(payload, AESKey)
-		if err != nil {
-			log.Fatal(err)
-		}
-		encLen := uint16(len(encryptedPayload))
-
-		preppedBytes = binary.BigEndian.AppendUint16(preppedBytes, encLen)
-		preppedBytes = append(preppedBytes, encryptedPayload...)
-
+		p.MessageID = messageID
+		p.PacketNum = uint16(i + 1)
+		p.NumPackets = numPackets
+		p.Username = sentFrom
+		p.UserColour = colour
+		p.Channel = channel
+		packets = append(packets, encodeMsgPacket(p))
 	}
 
-	return preppedBytes, nil
+	return packets
 }
@@ -0,0 +1,153 @@
+package encoding
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultReassemblyTimeout = 30 * time.Second
+	DefaultMaxPendingBytes   = 1024 * 1024
+	// packetOverhead is charged against the pending limit for every stored
+	// packet so that empty fragments still count towards it.
+	packetOverhead = 64
+)
+
+var (
+	ErrReassemblyLimit = errors.New("limit for incomplete messages reached")
+	ErrInvalidPacket   = errors.New("invalid packet")
+)
+
+var lastMessageID atomic.Uint64
+
+func init() {
+	var seed [8]byte
+	_, err := rand.Read(seed[:])
+	if err != nil {
+		panic(err)
+	}
+	lastMessageID.Store(binary.BigEndian.Uint64(seed[:]))
+}
+
+// NewMessageID returns an ID that is unique for the lifetime of the process.
+// All packets of a logical message share the same ID.
+func NewMessageID() uint64 {
+	return lastMessageID.Add(1)
+}
+
+type partialMessage struct {
+	started    time.Time
+	numPackets uint16
+	packets    map[uint16]MsgProtocol
+	size       int
+}
+
+// Reassembler rebuilds multi-packet messages. Fragments are keyed by message
+// ID and packet number, so fragments of different messages may interleave.
+// Incomplete messages are dropped once they are older than the timeout, or
+// when storing a fragment would go over the pending byte limit.
+type Reassembler struct {
+	timeout         time.Duration
+	maxPendingBytes int
+	pendingBytes    int
+	pending         map[uint64]*partialMessage
+}
+
+func NewReassembler(timeout time.Duration, maxPendingBytes int) *Reassembler {
+	return &Reassembler{
+		timeout:         timeout,
+		maxPendingBytes: maxPendingBytes,
+		pending:         make(map[uint64]*partialMessage),
+	}
+}
+
+// Add stores a packet and returns the merged message once every packet for
+// its message ID has arrived.
+func (r *Reassembler) Add(p MsgProtocol, now time.Time) (MsgProtocol, bool, error) {
+	r.Expire(now)
+
+	if p.NumPackets <= 1 {
+		return p, true, nil
+	}
+	if p.PacketNum < 1 || p.PacketNum > p.NumPackets {
+		return MsgProtocol{}, false, fmt.Errorf("%w: packet %d of %d", ErrInvalidPacket, p.PacketNum, p.NumPackets)
+	}
+
+	msg, exists := r.pending[p.MessageID]
+	if !exists {
+		msg = &partialMessage{
+			started:    now,
+			numPackets: p.NumPackets,
+			packets:    make(map[uint16]MsgProtocol),
+		}
+		r.pending[p.MessageID] = msg
+	}
+	if msg.numPackets != p.NumPackets {
+		r.drop(p.MessageID)
+		return MsgProtocol{}, false, fmt.Errorf("%w: message %d changed packet count from %d to %d", ErrInvalidPacket, p.MessageID, msg.numPackets, p.NumPackets)
+	}
+	if _, duplicate := msg.packets[p.PacketNum]; duplicate {
+		return MsgProtocol{}, false, fmt.Errorf("%w: duplicate packet %d for message %d", ErrInvalidPacket, p.PacketNum, p.MessageID)
+	}
+
+	size := len(p.Data) + packetOverhead
+	if r.pendingBytes+size > r.maxPendingBytes {
+		r.drop(p.MessageID)
+		return MsgProtocol{}, false, fmt.Errorf("%w: dropped message %d", ErrReassemblyLimit, p.MessageID)
+	}
+	msg.packets[p.PacketNum] = p
+	msg.size += size
+	r.pendingBytes += size
+
+	if len(msg.packets) < int(msg.numPackets) {
+		return MsgProtocol{}, false, nil
+	}
+
+	first := msg.packets[1]
+	merged := MsgProtocol{
+		MessageType: first.MessageType,
+		MessageID:   first.MessageID,
+		PacketNum:   1,
+		NumPackets:  1,
+		DateTime:    first.DateTime,
+		Username:    first.Username,
+		UserColour:  first.UserColour,
+		Channel:     first.Channel,
+		Data:        make([]byte, 0, msg.size),
+	}
+	for i := uint16(1); i <= msg.numPackets; i++ {
+		merged.Data = append(merged.Data, msg.packets[i].Data...)
+	}
+	r.drop(p.MessageID)
+	return merged, true, nil
+}
+
+// Expire drops incomplete messages whose first packet arrived more than the
+// timeout before now. It returns the number of messages dropped.
+func (r *Reassembler) Expire(now time.Time) int {
+	dropped := 0
+	for id, msg := range r.pending {
+		if now.Sub(msg.started) > r.timeout {
+			r.drop(id)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+func (r *Reassembler) PendingBytes() int {
+	return r.pendingBytes
+}
+
+func (r *Reassembler) drop(messageID uint64) {
+	msg, exists := r.pending[messageID]
+	if !exists {
+		return
+	}
+	r.pendingBytes -= msg.size
+	delete(r.pending, messageID)
+}
@@ -0,0 +1,149 @@
+package encoding
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func splitForTest(msg string, messageID uint64) []MsgProtocol {
+	packets := packageMessageString(msg)
+	for i := range packets {
+		packets[i].MessageID = messageID
+		packets[i].PacketNum = uint16(i + 1)
+		packets[i].NumPackets = uint16(len(packets))
+	}
+	return packets
+}
+
+func TestReassemblerInterleaved(t *testing.T) {
+	first := splitForTest(longTestString, 1)
+	second := splitForTest("2. "+longTestString, 2)
+	now := time.Now()
+	r := NewReassembler(DefaultReassemblyTimeout, DefaultMaxPendingBytes)
+
+	order := []MsgProtocol{first[0], second[0], second[1], first[1]}
+	completed := []string{}
+	for _, p := range order {
+		msg, complete, err := r.Add(p, now)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if complete {
+			completed = append(completed, string(msg.Data))
+		}
+	}
+
+	if len(completed) != 2 {
+		t.Fatalf("Expected 2 completed messages, Got %d", len(completed))
+	}
+	if completed[0] != "2. "+longTestString {
+		t.Errorf("Expected second message to complete first, Got %v", completed[0])
+	}
+	if completed[1] != longTestString {
+		t.Errorf("Expected first message to complete last, Got %v", completed[1])
+	}
+	if r.PendingBytes() != 0 {
+		t.Errorf("Expected no pending bytes, Got %d", r.PendingBytes())
+	}
+}
+
+func TestReassemblerSinglePacket(t *testing.T) {
+	r := NewReassembler(DefaultReassemblyTimeout, DefaultMaxPendingBytes)
+	p := splitForTest("short", 1)[0]
+	msg, complete, err := r.Add(p, time.Now())
+	if err != nil || !complete {
+		t.Fatalf("Expected single packet to complete immediately, Got complete=%v err=%v", complete, err)
+	}
+	if string(msg.Data) != "short" {
+		t.Errorf("Expected short, Got %v", string(msg.Data))
+	}
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	r := NewReassembler(time.Second, DefaultMaxPendingBytes)
+	packets := splitForTest(longTestString, 1)
+	now := time.Now()
+
+	_, _, err := r.Add(packets[0], now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if dropped := r.Expire(now.Add(2 * time.Second)); dropped != 1 {
+		t.Errorf("Expected 1 message to expire, Got %d", dropped)
+	}
+	if r.PendingBytes() != 0 {
+		t.Errorf("Expected no pending bytes after expiry, Got %d", r.PendingBytes())
+	}
+
+	_, complete, err := r.Add(packets[1], now.Add(2*time.Second))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if complete {
+		t.Errorf("Expected message missing its expired packet to stay incomplete")
+	}
+}
+
+func TestReassemblerLimits(t *testing.T) {
+	cases := []struct {
+		name        string
+		packets     []MsgProtocol
+		limit       int
+		expectedErr error
+	}{
+		{
+			name:        "over pending byte limit",
+			packets:     splitForTest(longTestString, 1)[:1],
+			limit:       MaxMessageSize / 2,
+			expectedErr: ErrReassemblyLimit,
+		}, {
+			name: "duplicate packet",
+			packets: []MsgProtocol{
+				splitForTest(longTestString, 1)[0],
+				splitForTest(longTestString, 1)[0],
+			},
+			limit:       DefaultMaxPendingBytes,
+			expectedErr: ErrInvalidPacket,
+		}, {
+			name: "packet number out of range",
+			packets: []MsgProtocol{
+				{MessageID: 1, PacketNum: 3, NumPackets: 2},
+			},
+			limit:       DefaultMaxPendingBytes,
+			expectedErr: ErrInvalidPacket,
+		}, {
+			name: "packet count changes",
+			packets: []MsgProtocol{
+				{MessageID: 1, PacketNum: 1, NumPackets: 2},
+				{MessageID: 1, PacketNum: 2, NumPackets: 3},
+			},
+			limit:       DefaultMaxPendingBytes,
+			expectedErr: ErrInvalidPacket,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewReassembler(DefaultReassemblyTimeout, tc.limit)
+			var err error
+			for _, p := range tc.packets {
+				_, _, err = r.Add(p, time.Now())
+			}
+			if !errors.Is(err, tc.expectedErr) {
+				t.Errorf("Expected error %v, Got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestNewMessageIDUnique(t *testing.T) {
+	seen := make(map[uint64]bool)
+	for range 1000 {
+		id := NewMessageID()
+		if seen[id] {
+			t.Fatalf("Message ID %d returned twice", id)
+		}
+		seen[id] = true
+	}
+}
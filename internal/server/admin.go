@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MatthewTully/simple-chat-server/internal/encoding"
+)
+
+// IsAdmin reports whether the user may send admin commands. The host user is
+// always an admin.
+func (s *Server) IsAdmin(username string) bool {
+	return (s.cfg.HostUser != "" && username == s.cfg.HostUser) || slices.Contains(s.Admins, username)
+}
+
+// ActionAdminCommand runs a command from an admin, and replies to them with
+// the result.
+func (s *Server) ActionAdminCommand(username string, data []byte) error {
+	if !s.IsAdmin(username) {
+		s.cfg.Logger.Printf("SECURITY: admin command from %v, who is not an admin", username)
+		return s.SendErrorToClient(username, "You are not an admin of this server.\n")
+	}
+	cmd, err := encoding.DecodeAdminCommand(data)
+	if err != nil {
+		return err
+	}
+	s.cfg.Logger.Printf("Admin command from %v: %v %v", username, cmd.Command, strings.Join(cmd.Args, " "))
+
+	reply, err := s.runAdminCommand(username, cmd)
+	if err != nil {
+		return s.SendErrorToClient(username, fmt.Sprintf("%v\n", err))
+	}
+	return s.SentMessageToClient(username, []byte(reply))
+}
+
+func (s *Server) runAdminCommand(username string, cmd encoding.AdminCommandPayload) (string, error) {
+	arg := func(i int) string {
+		if i < len(cmd.Args) {
+			return cmd.Args[i]
+		}
+		return ""
+	}
+
+	switch cmd.Command {
+	case "kick":
+		target := arg(0)
+		if target == username {
+			return "", fmt.Errorf("cannot kick yourself")
+		}
+		if _, ok := s.IsActiveUser(target); !ok {
+			return "", fmt.Errorf("%v is not connected", target)
+		}
+		s.CloseConnectionForUser(target)
+		return fmt.Sprintf("Kicked %v\n", target), nil
+	case "ban":
+		target := arg(0)
+		if target == username {
+			return "", fmt.Errorf("cannot ban yourself")
+		}
+		if !s.BanUser(target) {
+			return "", fmt.Errorf("%v is not connected", target)
+		}
+		return fmt.Sprintf("Banned %v\n", target), nil
+	case "invite":
+		// Invites are only checked in place of a password.
+		if s.Password == "" {
+			return "", fmt.Errorf("invites require a server password")
+		}
+		uses := DefaultInviteUses
+		ttl := DefaultInviteTTL
+		if arg(0) != "" {
+			n, err := strconv.Atoi(arg(0))
+			if err != nil {
+				return "", fmt.Errorf("invalid number of uses %q", arg(0))
+			}
+			uses = n
+		}
+		if arg(1) != "" {
+			d, err := time.ParseDuration(arg(1))
+			if err != nil {
+				return "", fmt.Errorf("invalid duration %q, use a duration like 30m or 24h", arg(1))
+			}
+			ttl = d
+		}
+		invite, err := s.Invites.Issue(uses, ttl, time.Now())
+		if err != nil {
+			return "", fmt.Errorf("could not create invite: %v", err)
+		}
+		return fmt.Sprintf("Invite %v created, for %d use(s) until %v\nUsers can join with \\connect {server address}#%v\n", invite.Token, invite.MaxUses, invite.Expires.Format(time.DateTime), invite.Token), nil
+	case "invites":
+		invites := s.Invites.List()
+		if len(invites) == 0 {
+			return "No invites\n", nil
+		}
+		now := time.Now()
+		var sb strings.Builder
+		for _, invite := range invites {
+			joined := "no one yet"
+			if len(invite.JoinedBy) > 0 {
+				joined = strings.Join(invite.JoinedBy, ", ")
+			}
+			sb.WriteString(fmt.Sprintf("%v - %v, used %d/%d, expires %v, joined by %v\n", invite.Token, invite.Status(now), invite.Uses, invite.MaxUses, invite.Expires.Format(time.DateTime), joined))
+		}
+		return sb.String(), nil
+	case "queues":
+		var sb strings.Builder
+		for _, stats := range s.OutboundQueueStats() {
+			sb.WriteString(fmt.Sprintf("%v - %d queued, at most %d, %d dropped\n", stats.Username, stats.Depth, stats.MaxDepth, stats.Dropped))
+		}
+		return sb.String(), nil
+	case "revoke":
+		if !s.Invites.Revoke(arg(0)) {
+			return "", fmt.Errorf("no invite %v", arg(0))
+		}
+		return fmt.Sprintf("Invite %v revoked\n", arg(0)), nil
+	}
+	return "", fmt.Errorf("unknown admin command %q", cmd.Command)
+}
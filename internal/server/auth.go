@@ -0,0 +1,117 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MatthewTully/simple-chat-server/internal/encoding"
+)
+
+const (
+	DefaultMaxAuthFailures = 3
+	DefaultAuthLockout     = time.Minute
+)
+
+var (
+	ErrWrongPassword       = errors.New("wrong password")
+	ErrTooManyAuthFailures = errors.New("too many failed password attempts, try again later")
+)
+
+// AuthLimiter counts failed password attempts per IP. Once an IP reaches
+// MaxFailures it is refused until Lockout has passed since its last failure.
+type AuthLimiter struct {
+	MaxFailures int
+	Lockout     time.Duration
+	failures    map[string]authFailures
+	mu          sync.Mutex
+}
+
+type authFailures struct {
+	count int
+	last  time.Time
+}
+
+func NewAuthLimiter(maxFailures int, lockout time.Duration) *AuthLimiter {
+	return &AuthLimiter{
+		MaxFailures: maxFailures,
+		Lockout:     lockout,
+		failures:    make(map[string]authFailures),
+	}
+}
+
+// Allowed reports whether the IP may try a password, and forgets its failures
+// once the lockout has passed.
+func (l *AuthLimiter) Allowed(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, exists := l.failures[ip]
+	if !exists {
+		return true
+	}
+	if now.Sub(f.last) >= l.Lockout {
+		delete(l.failures, ip)
+		return true
+	}
+	return f.count < l.MaxFailures
+}
+
+func (l *AuthLimiter) Fail(ip string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f := l.failures[ip]
+	f.count++
+	f.last = now
+	l.failures[ip] = f
+}
+
+func (l *AuthLimiter) Succeed(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, ip)
+}
+
+// AwaitAuthentication reads the user's Authenticate message, the first
+// message over the encrypted channel, and checks the invite token or the
+// server password. The user is sent an Authenticate message back if it is
+// accepted.
+func (s *Server) AwaitAuthentication(cu *ConnectedUser) error {
+	frame, err := cu.frameReader.ReadFrame()
+	if err != nil {
+		return fmt.Errorf("could not read authentication: %w", err)
+	}
+	decPayload, err := cu.session.Decrypt(frame)
+	if err != nil {
+		return fmt.Errorf("could not decrypt authentication: %v", err)
+	}
+	p, err := encoding.DecodeMsgPacket(decPayload)
+	if err != nil {
+		return fmt.Errorf("could not decode authentication: %v", err)
+	}
+	if p.MessageType != encoding.Authenticate || p.NumPackets != 1 {
+		return fmt.Errorf("expected %v, got %v", encoding.Authenticate, p.MessageType)
+	}
+	auth, err := encoding.DecodeAuth(p.Data)
+	if err != nil {
+		return err
+	}
+
+	if auth.Invite != "" {
+		err = s.Invites.Redeem(auth.Invite, cu.userInfo.Username, time.Now())
+		if err != nil {
+			return err
+		}
+		cu.invite = auth.Invite
+	} else {
+		// Compare digests so the time taken does not depend on the length.
+		got := sha256.Sum256([]byte(auth.Password))
+		want := sha256.Sum256([]byte(s.Password))
+		if subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+			return ErrWrongPassword
+		}
+	}
+	return SendMessage(cu, encoding.PrepPacketsForSending(nil, encoding.Authenticate, s.cfg.ServerName, "white"))
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/MatthewTully/simple-chat-server/internal/encoding"
+)
+
+const (
+	DefaultMaxChannels     = 100
+	DefaultMaxUserChannels = 10
+)
+
+// Channel is a chat room on the server. Messages sent to a channel only go to
+// its members, and each channel has its own history in the server's
+// HistoryStore. Channels other than the default are created when first joined
+// and removed once empty.
+type Channel struct {
+	Name    string
+	Members map[string]bool
+}
+
+func NewChannel(name string) *Channel {
+	return &Channel{
+		Name:    name,
+		Members: make(map[string]bool),
+	}
+}
+
+func (s *Server) IsChannelMember(channel, username string) bool {
+	s.rwmu.RLock()
+	defer s.rwmu.RUnlock()
+	ch, exists := s.Channels[channel]
+	return exists && ch.Members[username]
+}
+
+// ChannelMembers returns the usernames in the channel, sorted.
+func (s *Server) ChannelMembers(channel string) []string {
+	s.rwmu.RLock()
+	defer s.rwmu.RUnlock()
+	return s.channelMembers(channel)
+}
+
+func (s *Server) channelMembers(channel string) []string {
+	members := []string{}
+	ch, exists := s.Channels[channel]
+	if !exists {
+		return members
+	}
+	for username := range ch.Members {
+		members = append(members, username)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func (s *Server) ListChannels() []encoding.ChannelInfo {
+	s.rwmu.RLock()
+	defer s.rwmu.RUnlock()
+	channels := []encoding.ChannelInfo{}
+	for _, ch := range s.Channels {
+		channels = append(channels, encoding.ChannelInfo{Name: ch.Name, Members: len(ch.Members)})
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Name < channels[j].Name
+	})
+	return channels
+}
+
+// JoinChannel adds the user to the channel, creating it if needed, and tells
+// the channel they have joined.
+func (s *Server) JoinChannel(username, channel string) error {
+	err := s.joinChannel(username, channel)
+	if err != nil {
+		return err
+	}
+	s.ProcessChannelMessage(channel, username, s.noticeRecord(fmt.Sprintf("User %v has joined %v\n", username, channel)))
+	return nil
+}
+
+// joinChannel adds the user to the channel, then sends its members to
+// everyone in it and its history to the user.
+func (s *Server) joinChannel(username, channel string) error {
+	err := encoding.ValidChannelName(channel)
+	if err != nil {
+		return err
+	}
+	s.rwmu.Lock()
+	ch, exists := s.Channels[channel]
+	if exists && ch.Members[username] {
+		s.rwmu.Unlock()
+		return fmt.Errorf("already in %v", channel)
+	}
+	if s.MaxUserChannels > 0 && s.joinedChannels(username) >= s.MaxUserChannels {
+		s.rwmu.Unlock()
+		return fmt.Errorf("cannot join %v, you are already in %d channels. Leave one first", channel, s.MaxUserChannels)
+	}
+	if !exists {
+		if s.MaxChannels > 0 && len(s.Channels) >= s.MaxChannels {
+			s.rwmu.Unlock()
+			return fmt.Errorf("cannot create %v, the server already has %d channels", channel, s.MaxChannels)
+		}
+		ch = NewChannel(channel)
+		s.Channels[channel] = ch
+	}
+	ch.Members[username] = true
+	s.rwmu.Unlock()
+
+	s.sendChannelMembers(channel)
+	err = s.SendChannelHistory(username, channel)
+	if err != nil {
+		s.cfg.Logger.Printf("Could not send %v history to user (%v): %v", channel, username, err)
+	}
+	return nil
+}
+
+func (s *Server) LeaveChannel(username, channel string) error {
+	s.rwmu.Lock()
+	ch, exists := s.Channels[channel]
+	if !exists || !ch.Members[username] {
+		s.rwmu.Unlock()
+		return fmt.Errorf("not in %v", channel)
+	}
+	s.removeFromChannel(ch, username)
+	s.rwmu.Unlock()
+
+	// The user is sent the new member list too, so they know they have left.
+	s.sendChannelMembers(channel, username)
+	s.ProcessChannelMessage(channel, username, s.noticeRecord(fmt.Sprintf("User %v has left %v\n", username, channel)))
+	return nil
+}
+
+// leaveAllChannels removes a disconnected user from every channel.
+func (s *Server) leaveAllChannels(username string) {
+	left := []string{}
+	s.rwmu.Lock()
+	for name, ch := range s.Channels {
+		if ch.Members[username] {
+			s.removeFromChannel(ch, username)
+			left = append(left, name)
+		}
+	}
+	s.rwmu.Unlock()
+
+	for _, channel := range left {
+		s.sendChannelMembers(channel)
+	}
+}
+
+// joinedChannels counts the channels the user is in. It must be called with
+// the lock held.
+func (s *Server) joinedChannels(username string) int {
+	joined := 0
+	for _, ch := range s.Channels {
+		if ch.Members[username] {
+			joined++
+		}
+	}
+	return joined
+}
+
+// removeFromChannel must be called with the write lock held. A channel that
+// is removed has its history dropped with it.
+func (s *Server) removeFromChannel(ch *Channel, username string) {
+	delete(ch.Members, username)
+	if len(ch.Members) == 0 && ch.Name != encoding.DefaultChannel {
+		delete(s.Channels, ch.Name)
+		err := s.History.Drop(ch.Name)
+		if err != nil {
+			s.cfg.Logger.Printf("Could not drop %v history: %v", ch.Name, err)
+		}
+	}
+}
+
+// sendChannelMembers sends the channel's member list to its members, and to
+// any extra users given.
+func (s *Server) sendChannelMembers(channel string, extra ...string) {
+	s.rwmu.RLock()
+	defer s.rwmu.RUnlock()
+	members := s.channelMembers(channel)
+	data, err := encoding.EncodeChannelMembers(members)
+	if err != nil {
+		s.cfg.Logger.Println(err)
+		return
+	}
+	toSend := encoding.PrepChannelPacketsForSending(data, encoding.ChannelMembers, channel, s.cfg.ServerName, "white")
+	for _, username := range append(members, extra...) {
+		user, ok := s.LiveConns[username]
+		if !ok {
+			continue
+		}
+		err := SendMessage(user, toSend)
+		if err != nil {
+			s.cfg.Logger.Println(err)
+		}
+	}
+}
+
+// BroadcastToChannel sends the packets to every member of the channel other
+// than the sender.
+func (s *Server) BroadcastToChannel(channel, sentBy string, packets [][]byte) []error {
+	failedAttempts := []error{}
+
+	s.rwmu.RLock()
+	defer s.rwmu.RUnlock()
+
+	ch, exists := s.Channels[channel]
+	if !exists {
+		return []error{fmt.Errorf("channel %v does not exist", channel)}
+	}
+	for username := range ch.Members {
+		if username == sentBy {
+			continue
+		}
+		user, ok := s.LiveConns[username]
+		if !ok {
+			continue
+		}
+		err := SendMessage(user, packets)
+		if err != nil {
+			failedAttempts = append(failedAttempts, err)
+		}
+	}
+	if len(failedAttempts) > 0 {
+		return failedAttempts
+	}
+	return nil
+}
+
+// ProcessChannelMessage adds the record to the channel's history and sends it
+// to the channel's members other than sentBy. Records for a channel that has
+// been removed are dropped, so its history isn't started again.
+func (s *Server) ProcessChannelMessage(channel, sentBy string, record encoding.ChatRecord) {
+	s.rwmu.RLock()
+	_, exists := s.Channels[channel]
+	if exists {
+		s.AddMsgToHistory(channel, record)
+	}
+	s.rwmu.RUnlock()
+	if !exists {
+		return
+	}
+	data, err := encoding.EncodeChatRecord(record)
+	if err != nil {
+		s.cfg.Logger.Println(err)
+		return
+	}
+	toSend := encoding.PrepChannelPacketsForSending(data, encoding.ChatMessage, channel, s.cfg.ServerName, "white")
+	s.cfg.Logger.Printf("ProcessChannelMessage: %v packets %v\n", channel, len(toSend))
+	s.BroadcastToChannel(channel, sentBy, toSend)
+}
+
+func (s *Server) SendChannelList(username string) error {
+	data, err := encoding.EncodeChannelList(s.ListChannels())
+	if err != nil {
+		return err
+	}
+	return s.sendToClient(username, "", data, encoding.ChannelList)
+}
@@ -1,12 +1,15 @@
 package server
 
 import (
-	"bytes"
+	"context"
 	"crypto/rsa"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/MatthewTully/simple-chat-server/internal/crypto"
@@ -19,130 +22,136 @@ type UserInfo struct {
 }
 
 type ConnectedUser struct {
-	conn           net.Conn
-	userInfo       UserInfo
-	multiMessages  map[int]encoding.MsgProtocol
-	processChannel chan []byte
-	keepAliveTimer *time.Timer
-	publicKey      *rsa.PublicKey
-	AESKey         []byte
+	conn            net.Conn
+	frameReader     *encoding.FrameReader
+	frameWriter     *encoding.FrameWriter
+	queue           *outboundQueue
+	userInfo        UserInfo
+	reassembler     *encoding.Reassembler
+	processChannel  chan []byte
+	ctx             context.Context
+	cancel          context.CancelFunc
+	keepAliveTimer  *time.Timer
+	publicKey       *rsa.PublicKey
+	keyFingerprint  string
+	protocolVersion uint16
+	capabilities    encoding.Capability
+	secureChannel   bool
+	session         *crypto.Session
+	invite          string
+	msgCounts       map[encoding.MessageType]uint64
+	msgCountsMu     sync.Mutex
+}
+
+// newConnectedUser wraps a new connection. Its context is cancelled when the
+// connection is closed, which stops all of the connection's goroutines.
+func newConnectedUser(conn net.Conn) *ConnectedUser {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ConnectedUser{
+		conn:        conn,
+		frameReader: encoding.NewFrameReader(conn),
+		frameWriter: encoding.NewFrameWriter(conn),
+		reassembler: encoding.NewReassembler(encoding.DefaultReassemblyTimeout, encoding.DefaultMaxPendingBytes),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
 }
 
 func (cu *ConnectedUser) ProcessMessage(s *Server) {
 	cu.processChannel = make(chan []byte)
 	keepAlive := time.NewTimer(time.Second * 30)
+	defer keepAlive.Stop()
 	cu.keepAliveTimer = keepAlive
-	overFlow := []byte{}
-	var data []byte
+	s.connWG.Add(1)
 	go s.AwaitMessage(cu)
 	for {
 		select {
+		case <-cu.ctx.Done():
+			return
 		case <-keepAlive.C:
 			s.cfg.Logger.Printf("timer triggered for user %v, sending disconnect.", cu.userInfo.Username)
-			s.CloseConnectionForUser(cu.userInfo.Username)
-		case buf := <-cu.processChannel:
-			nr := len(buf)
-			s.cfg.Logger.Printf("in chan, Buf read = %v\n", buf)
-			if len(overFlow) > 0 {
-				s.cfg.Logger.Printf("Using overflow\n")
-				data = append(overFlow, buf[0:nr]...)
-				overFlow = []byte{}
-				s.cfg.Logger.Printf("data with overflow and buf = %v\n", data)
-			} else {
-				data = buf[0:nr]
+			s.CloseConnection(cu)
+		case frame := <-cu.processChannel:
+			decPayload, err := cu.session.Decrypt(frame)
+			if errors.Is(err, crypto.ErrOutOfOrderFrame) {
+				// TCP keeps frames in order, so a frame has been dropped or
+				// injected and the sequence can't be recovered.
+				s.cfg.Logger.Printf("SECURITY: closing connection for user %v (%v): %v", cu.userInfo.Username, cu.conn.RemoteAddr().String(), err)
+				s.CloseConnection(cu)
+				return
 			}
+			if errors.Is(err, crypto.ErrReplayedFrame) {
+				s.cfg.Logger.Printf("SECURITY: rejected frame from user %v (%v): %v", cu.userInfo.Username, cu.conn.RemoteAddr().String(), err)
+				continue
+			}
+			if err != nil {
+				s.cfg.Logger.Printf("error Decrypting payload: %v", err)
+				continue
+			}
+			// Only frames from the user keep the connection alive.
+			keepAlive.Reset(time.Second * 30)
 
-			sd := bytes.Split(data, encoding.HeaderPattern[:])
-
-			for i, p := range sd {
-				s.cfg.Logger.Printf("%v: %v\n", i, p)
-				switch {
-				case i == 0 && len(p) > 0:
-					s.cfg.Logger.Println("tail end of the previous message. add to overflow")
-					overFlow = append(overFlow, p...)
-					continue
-				case i == 1:
-					if len(p) < encoding.AESEncryptHeaderSize {
-						s.cfg.Logger.Printf("packet is not the full message. add to overflow\n")
-						overFlow = append(overFlow, encoding.HeaderPattern[:]...)
-						overFlow = append(overFlow, p...)
-						continue
-					}
-					s.cfg.Logger.Printf("decode header\n")
-
-					payloadSize := binary.BigEndian.Uint16(p[0:])
-
-					if len(p) < int(payloadSize) {
-						s.cfg.Logger.Printf("packet is not the full message. add to overflow\n")
-						overFlow = append(overFlow, encoding.HeaderPattern[:]...)
-						overFlow = append(overFlow, p...)
-						continue
-					}
-					payload := p[encoding.AESEncryptHeaderSize : payloadSize+encoding.AESEncryptHeaderSize]
-
-					if (payloadSize + encoding.AESEncryptHeaderSize) > uint16(nr) {
-						s.cfg.Logger.Printf("add remaining bytes to overflow for next read: %v\n", p[payloadSize+encoding.AESEncryptHeaderSize:])
-						overFlow = p[payloadSize+encoding.AESEncryptHeaderSize:]
-						overFlow = append(overFlow, p[payloadSize+encoding.AESEncryptHeaderSize:]...)
-					}
-
-					decPayload, err := crypto.AESDecrypt(payload, cu.AESKey)
-					if err != nil {
-						s.cfg.Logger.Printf("error Decrypting payload: %v", err)
-						continue
-					}
-
-					packetNum := binary.BigEndian.Uint16(decPayload[0:])
-					numPackets := binary.BigEndian.Uint16(decPayload[2:])
-					packetLen := binary.BigEndian.Uint16(decPayload[4:])
-
-					if len(decPayload) < int(packetLen) {
-						s.cfg.Logger.Printf("error, decrypted payload is not the full message")
-						continue
-					}
-
-					packet := decPayload[encoding.HeaderSize : packetLen+encoding.HeaderSize]
-
-					buffer := bytes.NewBuffer(packet)
-					dataPacket := encoding.DecodeMsgPacket(buffer)
-					if numPackets == 1 {
-						s.ActionMessageType(dataPacket, dataPacket.Data[:dataPacket.MsgSize])
-					} else {
-						cu.multiMessages[int(packetNum)] = dataPacket
-						if len(cu.multiMessages) == int(numPackets) {
-							newProtocol := encoding.MsgProtocol{}
-							mergedData := []byte{}
-							for i := 1; i <= int(numPackets); i++ {
-								msg := cu.multiMessages[i]
-								if i == 1 {
-									newProtocol.MessageType = msg.MessageType
-									newProtocol.Username = msg.Username
-									newProtocol.UsernameSize = msg.UsernameSize
-									newProtocol.UserColour = msg.UserColour
-									newProtocol.UserColourSize = msg.UserColourSize
-									newProtocol.DateTime = msg.DateTime
-								}
-								mergedData = append(mergedData, msg.Data[:msg.MsgSize]...)
-							}
-							cu.multiMessages = make(map[int]encoding.MsgProtocol)
-							s.ActionMessageType(newProtocol, mergedData)
-						}
-					}
-					continue
-				case i > 1:
-					s.cfg.Logger.Printf("add extra bytes to overflow for next read: %v\n", p[:])
-					overFlow = append(overFlow, encoding.HeaderPattern[:]...)
-					overFlow = append(overFlow, p...)
-					continue
-				default:
+			dataPacket, err := encoding.DecodeMsgPacket(decPayload)
+			if err != nil {
+				s.cfg.Logger.Printf("error decoding packet: %v", err)
+				continue
+			}
+			msg, complete, err := cu.reassembler.Add(dataPacket, time.Now())
+			if err != nil {
+				s.cfg.Logger.Printf("error reassembling message: %v", err)
+				continue
+			}
+			if complete {
+				cu.countMessage(msg.MessageType)
+				if msg.MessageType == encoding.Rekey {
+					s.ActionRekey(cu, msg.Data)
 					continue
 				}
-
+				// The sender is whoever authenticated on this connection,
+				// not what the packet claims.
+				msg.Username = cu.userInfo.Username
+				msg.UserColour = cu.userInfo.UserColour
+				s.ActionMessageType(msg, msg.Data)
+			}
+			if cu.session.NeedsRekey(time.Now()) {
+				s.StartRekey(cu)
 			}
 		}
 	}
 }
 
+func (cu *ConnectedUser) countMessage(messageType encoding.MessageType) uint64 {
+	cu.msgCountsMu.Lock()
+	defer cu.msgCountsMu.Unlock()
+	if cu.msgCounts == nil {
+		cu.msgCounts = make(map[encoding.MessageType]uint64)
+	}
+	cu.msgCounts[messageType]++
+	return cu.msgCounts[messageType]
+}
+
+func (cu *ConnectedUser) messageCount(messageType encoding.MessageType) uint64 {
+	cu.msgCountsMu.Lock()
+	defer cu.msgCountsMu.Unlock()
+	return cu.msgCounts[messageType]
+}
+
+// messageCountSummary lists how many messages of each type were received
+// from the user, for the logs.
+func (cu *ConnectedUser) messageCountSummary() string {
+	cu.msgCountsMu.Lock()
+	defer cu.msgCountsMu.Unlock()
+	counts := []string{}
+	for messageType, count := range cu.msgCounts {
+		counts = append(counts, fmt.Sprintf("%v=%d", messageType, count))
+	}
+	if len(counts) == 0 {
+		return "none"
+	}
+	sort.Strings(counts)
+	return strings.Join(counts, ", ")
+}
+
 func (s *Server) IsActiveUser(username string) (*ConnectedUser, bool) {
 	s.rwmu.RLock()
 	defer s.rwmu.RUnlock()
@@ -161,39 +170,70 @@ func (s *Server) GetAllActiveUsers() []UserInfo {
 	return activeUsers
 }
 
-func (s *Server) BroadcastActiveUsers() {
-	activeUsrSlice := []byte{}
-	for _, data := range s.GetAllActiveUsers() {
-		if data.Username == s.cfg.HostUser {
-			data.Username = data.Username + " (host)"
+// GetActiveUserList returns the active users along with their public keys,
+// for clients to seal and verify whispers with.
+func (s *Server) GetActiveUserList() []encoding.ActiveUser {
+	s.rwmu.RLock()
+	defer s.rwmu.RUnlock()
+
+	activeUsers := []encoding.ActiveUser{}
+	for _, user := range s.LiveConns {
+		pubKey, err := crypto.RSAPublicKeyToBytes(user.publicKey)
+		if err != nil {
+			s.cfg.Logger.Printf("could not encode public key for user %v: %v", user.userInfo.Username, err)
+			continue
 		}
-		usrByteSlice := []byte(fmt.Sprintf("[%s]%v[white];", data.UserColour, data.Username))
-		activeUsrSlice = append(activeUsrSlice, usrByteSlice...)
+		activeUsers = append(activeUsers, encoding.ActiveUser{
+			Username:   user.userInfo.Username,
+			UserColour: user.userInfo.UserColour,
+			PublicKey:  pubKey,
+			Host:       user.userInfo.Username == s.cfg.HostUser,
+		})
 	}
-	if len(activeUsrSlice) == 0 {
+	sort.Slice(activeUsers, func(i, j int) bool {
+		return activeUsers[i].Username < activeUsers[j].Username
+	})
+	return activeUsers
+}
+
+func (s *Server) BroadcastActiveUsers() {
+	activeUsers := s.GetActiveUserList()
+	if len(activeUsers) == 0 {
 		return
 	}
-
-	toSend, err := encoding.PrepBytesForSending(activeUsrSlice, encoding.ServerActiveUsers, s.cfg.ServerName, "white", s.cfg.AESKey)
+	activeUsrSlice, err := encoding.EncodeActiveUsers(activeUsers)
 	if err != nil {
-		s.cfg.Logger.Printf("error creating packet to send: %v", err)
+		s.cfg.Logger.Println(err)
+		return
 	}
-	s.cfg.Logger.Printf("Total active users is: %v\n", len(s.GetAllActiveUsers()))
-	s.cfg.Logger.Printf("BroadcastActiveUsers: len %v\n", len(toSend))
+
+	toSend := encoding.PrepPacketsForSending(activeUsrSlice, encoding.ServerActiveUsers, s.cfg.ServerName, "white")
+	s.cfg.Logger.Printf("Total active users is: %v\n", len(activeUsers))
+	s.cfg.Logger.Printf("BroadcastActiveUsers: packets %v\n", len(toSend))
 	s.BroadcastMessage(s.cfg.ServerName, toSend)
 }
 
 func (s *Server) BanUser(username string) bool {
 	user, exists := s.IsActiveUser(username)
 	if exists {
-		ip := strings.Split(user.conn.LocalAddr().String(), ":")[0]
+		ip := remoteHost(user.conn.RemoteAddr())
+		s.rwmu.Lock()
 		s.Blacklist = append(s.Blacklist, ip)
+		s.rwmu.Unlock()
 		s.CloseConnectionForUser(username)
 		return true
 	}
 	return false
 }
 
+// isBanned checks the blacklist under the lock, as admins can ban users while
+// handshakes are running.
+func (s *Server) isBanned(ip string) bool {
+	s.rwmu.RLock()
+	defer s.rwmu.RUnlock()
+	return slices.Contains(s.Blacklist, ip)
+}
+
 func (s *Server) ActionKeepAlive(username string) {
 	user, exists := s.IsActiveUser(username)
 	if !exists {
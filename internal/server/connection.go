@@ -2,7 +2,6 @@ package server
 
 import (
 	"fmt"
-	"net"
 
 	"github.com/MatthewTully/simple-chat-server/internal/encoding"
 )
@@ -12,6 +11,9 @@ func (s *Server) AddToLiveConns(userKey string, conn *ConnectedUser) error {
 	s.rwmu.Lock()
 	defer s.rwmu.Unlock()
 
+	if s.shuttingDown {
+		return fmt.Errorf("could not connect. %v", ErrServerShuttingDown)
+	}
 	if uint(len(s.LiveConns)) >= s.MaxConnectionLimit {
 		return fmt.Errorf("could not connect. Connection limit reached")
 	}
@@ -21,48 +23,80 @@ func (s *Server) AddToLiveConns(userKey string, conn *ConnectedUser) error {
 	}
 
 	s.LiveConns[userKey] = conn
+	conn.queue = newOutboundQueue(s.OutboundQueueSize, s.OverflowPolicy)
+	s.connWG.Add(1)
+	go s.writeMessages(conn)
 	return nil
 }
 
-func (s *Server) NewConnection(newUser ConnectedUser) (*ConnectedUser, error) {
-	err := s.AddToLiveConns(newUser.userInfo.Username, &newUser)
+func (s *Server) NewConnection(newUser *ConnectedUser) (*ConnectedUser, error) {
+	err := s.AddToLiveConns(newUser.userInfo.Username, newUser)
 	if err != nil {
 		return &ConnectedUser{}, err
 	}
 	s.BroadcastActiveUsers()
-	err = s.SendHistory(&newUser)
+	err = s.joinChannel(newUser.userInfo.Username, encoding.DefaultChannel)
 	if err != nil {
-		s.cfg.Logger.Printf("Could not send history to new user (%v): %v", newUser.userInfo.Username, err)
+		s.cfg.Logger.Printf("Could not add new user (%v) to %v: %v", newUser.userInfo.Username, encoding.DefaultChannel, err)
 	}
 	err = s.SentMessageToClient(newUser.userInfo.Username, []byte("Welcome to the server!\n"))
-	s.ProcessGroupMessage(s.cfg.ServerName, []byte(fmt.Sprintf("User %v has joined the server!\n", newUser.userInfo.Username)))
+	s.ProcessChannelMessage(encoding.DefaultChannel, s.cfg.ServerName, s.noticeRecord(fmt.Sprintf("User %v has joined the server!\n", newUser.userInfo.Username)))
 	if err != nil {
 		s.cfg.Logger.Println(err.Error())
 	}
-	return &newUser, nil
+	return newUser, nil
 }
 
-func (s *Server) DenyConnection(conn net.Conn, errMsg string) {
-	errByte := []byte(errMsg)
-	toSend, err := encoding.PrepBytesForSending(errByte, encoding.ErrorMessage, s.cfg.ServerName, "white", s.cfg.AESKey)
-	if err != nil {
-		s.cfg.Logger.Printf("error creating packet to send: %v", err)
+func (s *Server) DenyConnection(cu *ConnectedUser, errMsg string) {
+	var err error
+	if cu.secureChannel {
+		toSend := encoding.PrepPacketsForSending([]byte(errMsg), encoding.ErrorMessage, s.cfg.ServerName, "white")
+		err = SendMessage(cu, toSend)
+	} else {
+		var toSend []byte
+		toSend, err = encoding.PrepHandshakeForSending(encoding.HandshakeProtocol{
+			MessageType: encoding.ErrorMessage,
+			MinVersion:  encoding.MinProtocolVersion,
+			MaxVersion:  encoding.MaxProtocolVersion,
+			Username:    s.cfg.ServerName,
+			UserColour:  "white",
+			Error:       errMsg,
+		})
+		if err != nil {
+			s.cfg.Logger.Printf("error creating packet to send: %v", err)
+		}
+		err = cu.frameWriter.WriteFrame(toSend)
 	}
-	_, err = conn.Write(toSend)
 	if err != nil {
 		s.cfg.Logger.Println(err)
 	}
-	conn.Close()
+	cu.conn.Close()
+	cu.cancel()
 }
 
+// CloseConnection disconnects the user and stops their connection's
+// goroutines. It does nothing if the connection is already closed. While the
+// server is shutting down, the rest of the room is not told the user left.
 func (s *Server) CloseConnection(user *ConnectedUser) {
 	s.rwmu.Lock()
+	if s.LiveConns[user.userInfo.Username] != user {
+		s.rwmu.Unlock()
+		return
+	}
 	delete(s.LiveConns, user.userInfo.Username)
+	shuttingDown := s.shuttingDown
 	s.rwmu.Unlock()
 	s.SendDisconnectionNotification(user)
-	user.conn.Close()
-	s.cfg.Logger.Printf("Connection closed for user %v", user.userInfo.Username)
-	s.ProcessGroupMessage(s.cfg.ServerName, []byte(fmt.Sprintf("User %v has left the server!\n", user.userInfo.Username)))
+	// The writer closes the connection once the queue is empty.
+	user.queue.close()
+	user.cancel()
+	queue := user.queue.stats()
+	s.cfg.Logger.Printf("Connection closed for user %v. Messages received: %v. Outbound queue max depth %d, dropped %d", user.userInfo.Username, user.messageCountSummary(), queue.MaxDepth, queue.Dropped)
+	s.leaveAllChannels(user.userInfo.Username)
+	if shuttingDown {
+		return
+	}
+	s.ProcessChannelMessage(encoding.DefaultChannel, s.cfg.ServerName, s.noticeRecord(fmt.Sprintf("User %v has left the server!\n", user.userInfo.Username)))
 	s.BroadcastActiveUsers()
 }
 
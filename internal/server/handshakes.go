@@ -0,0 +1,64 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHandshakeTimeout     = 10 * time.Second
+	DefaultMaxPendingHandshakes = 64
+	DefaultMaxPendingPerIP      = 4
+)
+
+var (
+	ErrHandshakeTimedOut      = errors.New("cannot connect to server: Connection timed out")
+	ErrTooManyPending         = errors.New("too many connections waiting to join")
+	ErrTooManyPendingFromAddr = errors.New("too many connections waiting to join from this address")
+)
+
+// PendingHandshakes counts the connections that have not finished their
+// handshake, in total and per IP, so clients that never finish one cannot
+// use up the server's connections.
+type PendingHandshakes struct {
+	MaxPending int
+	MaxPerIP   int
+	total      int
+	perIP      map[string]int
+	mu         sync.Mutex
+}
+
+func NewPendingHandshakes(maxPending, maxPerIP int) *PendingHandshakes {
+	return &PendingHandshakes{
+		MaxPending: maxPending,
+		MaxPerIP:   maxPerIP,
+		perIP:      make(map[string]int),
+	}
+}
+
+// Start counts a new handshake from the IP, unless it would go over either
+// limit. Every successful Start must be followed by a Done.
+func (p *PendingHandshakes) Start(ip string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.total >= p.MaxPending {
+		return ErrTooManyPending
+	}
+	if p.perIP[ip] >= p.MaxPerIP {
+		return ErrTooManyPendingFromAddr
+	}
+	p.total++
+	p.perIP[ip]++
+	return nil
+}
+
+func (p *PendingHandshakes) Done(ip string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total--
+	p.perIP[ip]--
+	if p.perIP[ip] <= 0 {
+		delete(p.perIP, ip)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/MatthewTully/simple-chat-server/internal/encoding"
+)
+
+// maxHistoryMessageSize caps the history sent in one message, well under what
+// a client will hold for a message being reassembled.
+const maxHistoryMessageSize = encoding.DefaultMaxPendingBytes / 2
+
+// HistoryStore keeps the message history of each channel. Messages are
+// stored as given, with the ID of the record they hold so history can be
+// paged through.
+type HistoryStore interface {
+	// Append adds a message to the end of the channel's history.
+	Append(channel string, id uint64, msg []byte) error
+	// Recent returns up to limit of the channel's messages sent before the
+	// message with ID before, oldest first. If before is 0 it returns the
+	// latest messages, and if before is not in the history, none.
+	Recent(channel string, before uint64, limit int) ([][]byte, error)
+	// Drop is called when the channel is removed, and may forget its
+	// history.
+	Drop(channel string) error
+	Close() error
+}
+
+type memoryEntry struct {
+	id  uint64
+	msg []byte
+}
+
+// MemoryHistory keeps the latest messages of each channel in memory, up to
+// maxSize per channel. It is lost when the server stops.
+type MemoryHistory struct {
+	maxSize  uint
+	channels map[string][]memoryEntry
+	mu       sync.Mutex
+}
+
+func NewMemoryHistory(maxSize uint) *MemoryHistory {
+	return &MemoryHistory{
+		maxSize:  maxSize,
+		channels: make(map[string][]memoryEntry),
+	}
+}
+
+func (h *MemoryHistory) Append(channel string, id uint64, msg []byte) error {
+	if h.maxSize == 0 {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	history := h.channels[channel]
+	if len(history) >= int(h.maxSize) {
+		history = history[1:]
+	}
+	h.channels[channel] = append(history, memoryEntry{id: id, msg: msg})
+	return nil
+}
+
+func (h *MemoryHistory) Recent(channel string, before uint64, limit int) ([][]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	history := h.channels[channel]
+	if before != 0 {
+		end := slices.IndexFunc(history, func(e memoryEntry) bool {
+			return e.id == before
+		})
+		if end < 0 {
+			return [][]byte{}, nil
+		}
+		history = history[:end]
+	}
+	if len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	recent := make([][]byte, 0, len(history))
+	for _, entry := range history {
+		recent = append(recent, entry.msg)
+	}
+	return recent, nil
+}
+
+func (h *MemoryHistory) Drop(channel string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.channels, channel)
+	return nil
+}
+
+func (h *MemoryHistory) Close() error {
+	return nil
+}
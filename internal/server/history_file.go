@@ -0,0 +1,395 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSegmentSize = 4 << 20
+	DefaultSyncEvery   = time.Second
+
+	segmentExt       = ".log"
+	recordHeaderSize = 8
+	// recordBodyMinSize is the time, ID and channel length.
+	recordBodyMinSize = 18
+)
+
+type SyncPolicy int
+
+const (
+	// SyncNone leaves flushing writes to disk to the OS.
+	SyncNone SyncPolicy = iota
+	// SyncEveryWrite fsyncs after every message.
+	SyncEveryWrite
+	// SyncPeriodic fsyncs on the first message after SyncEvery has passed
+	// since the last sync.
+	SyncPeriodic
+)
+
+func ParseSyncPolicy(policy string) (SyncPolicy, error) {
+	switch strings.ToLower(policy) {
+	case "", "none":
+		return SyncNone, nil
+	case "always":
+		return SyncEveryWrite, nil
+	case "periodic":
+		return SyncPeriodic, nil
+	}
+	return SyncNone, fmt.Errorf("unknown sync policy %q, expected none, always or periodic", policy)
+}
+
+// FileHistoryOptions configure a FileHistory. Retention is applied a whole
+// segment at a time, so up to a segment more than the limits may be kept, but
+// messages older than MaxAge are never returned. Zero values mean no limit.
+type FileHistoryOptions struct {
+	SegmentSize int64
+	Sync        SyncPolicy
+	SyncEvery   time.Duration
+	MaxRecords  int
+	MaxAge      time.Duration
+	MaxBytes    int64
+}
+
+// segment is one of the store's files. Its records are indexed in memory so
+// reading history only reads the messages that are returned.
+type segment struct {
+	id     uint64
+	path   string
+	size   int64
+	index  []recordIndex
+	newest time.Time
+}
+
+// recordIndex locates a record's message in its segment.
+type recordIndex struct {
+	sent      time.Time
+	id        uint64
+	channel   string
+	msgOffset int64
+	msgLen    int
+}
+
+type historyRecord struct {
+	sent    time.Time
+	id      uint64
+	channel string
+	msg     []byte
+}
+
+// FileHistory is an append-only HistoryStore kept in numbered segment files
+// in a directory. Each record is
+//
+//	len(u32) | crc32(u32) | unix nanos(i64) | id(u64) | len(u16) channel | msg
+//
+// where len and the checksum cover everything after the header. A record
+// that was only partly written when the server stopped is cut off when the
+// store is next opened.
+type FileHistory struct {
+	dir      string
+	opts     FileHistoryOptions
+	segments []*segment
+	active   *os.File
+	lastSync time.Time
+	mu       sync.Mutex
+}
+
+func OpenFileHistory(dir string, opts FileHistoryOptions) (*FileHistory, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if opts.SyncEvery <= 0 {
+		opts.SyncEvery = DefaultSyncEvery
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("could not create history directory: %v", err)
+	}
+	h := &FileHistory{
+		dir:      dir,
+		opts:     opts,
+		lastSync: time.Now(),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read history directory: %v", err)
+	}
+	for _, entry := range entries {
+		id, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), segmentExt), 10, 64)
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), segmentExt) || err != nil {
+			continue
+		}
+		seg, err := recoverSegment(filepath.Join(dir, entry.Name()), id)
+		if err != nil {
+			return nil, err
+		}
+		h.segments = append(h.segments, seg)
+	}
+	sort.Slice(h.segments, func(i, j int) bool {
+		return h.segments[i].id < h.segments[j].id
+	})
+
+	if len(h.segments) == 0 {
+		err = h.newSegment(1)
+	} else {
+		err = h.openActive()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return h, h.applyRetention(time.Now())
+}
+
+// recoverSegment indexes a segment's records, and truncates it after the last
+// complete one.
+func recoverSegment(path string, id uint64) (*segment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read history segment: %v", err)
+	}
+	index, valid := decodeRecords(data)
+	if valid < len(data) {
+		err = os.Truncate(path, int64(valid))
+		if err != nil {
+			return nil, fmt.Errorf("could not truncate partial record in %v: %v", path, err)
+		}
+	}
+	seg := &segment{id: id, path: path, size: int64(valid), index: index}
+	if len(index) > 0 {
+		seg.newest = index[len(index)-1].sent
+	}
+	return seg, nil
+}
+
+func (h *FileHistory) segmentPath(id uint64) string {
+	return filepath.Join(h.dir, fmt.Sprintf("%010d%s", id, segmentExt))
+}
+
+func (h *FileHistory) newSegment(id uint64) error {
+	seg := &segment{id: id, path: h.segmentPath(id)}
+	h.segments = append(h.segments, seg)
+	return h.openActive()
+}
+
+func (h *FileHistory) openActive() error {
+	seg := h.segments[len(h.segments)-1]
+	f, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open history segment: %v", err)
+	}
+	h.active = f
+	return nil
+}
+
+func (h *FileHistory) Append(channel string, id uint64, msg []byte) error {
+	now := time.Now()
+	record := encodeRecord(historyRecord{sent: now, id: id, channel: channel, msg: msg})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seg := h.segments[len(h.segments)-1]
+	if len(seg.index) > 0 && seg.size+int64(len(record)) > h.opts.SegmentSize {
+		err := h.rotate()
+		if err != nil {
+			return err
+		}
+		seg = h.segments[len(h.segments)-1]
+	}
+
+	_, err := h.active.Write(record)
+	if err != nil {
+		// Cut off any part of the record that was written, so later records
+		// aren't appended after it.
+		truncErr := os.Truncate(seg.path, seg.size)
+		if truncErr != nil {
+			return fmt.Errorf("could not write history: %v, and could not truncate the partial record: %v", err, truncErr)
+		}
+		return fmt.Errorf("could not write history: %v", err)
+	}
+	seg.index = append(seg.index, recordIndex{
+		sent:      now,
+		id:        id,
+		channel:   channel,
+		msgOffset: seg.size + int64(len(record)-len(msg)),
+		msgLen:    len(msg),
+	})
+	seg.size += int64(len(record))
+	seg.newest = now
+
+	if h.opts.Sync == SyncEveryWrite || (h.opts.Sync == SyncPeriodic && now.Sub(h.lastSync) >= h.opts.SyncEvery) {
+		err = h.active.Sync()
+		if err != nil {
+			return fmt.Errorf("could not sync history: %v", err)
+		}
+		h.lastSync = now
+	}
+	return h.applyRetention(now)
+}
+
+func (h *FileHistory) rotate() error {
+	err := h.active.Sync()
+	if err != nil {
+		return fmt.Errorf("could not sync history: %v", err)
+	}
+	err = h.active.Close()
+	if err != nil {
+		return fmt.Errorf("could not close history segment: %v", err)
+	}
+	return h.newSegment(h.segments[len(h.segments)-1].id + 1)
+}
+
+// applyRetention removes the oldest segments while the store is over its
+// limits. The active segment is always kept.
+func (h *FileHistory) applyRetention(now time.Time) error {
+	totalRecords := 0
+	var totalBytes int64
+	for _, seg := range h.segments {
+		totalRecords += len(seg.index)
+		totalBytes += seg.size
+	}
+	for len(h.segments) > 1 {
+		oldest := h.segments[0]
+		tooMany := h.opts.MaxRecords > 0 && totalRecords-len(oldest.index) >= h.opts.MaxRecords
+		tooOld := h.opts.MaxAge > 0 && now.Sub(oldest.newest) > h.opts.MaxAge
+		tooBig := h.opts.MaxBytes > 0 && totalBytes > h.opts.MaxBytes
+		if !tooMany && !tooOld && !tooBig {
+			return nil
+		}
+		err := os.Remove(oldest.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not remove old history segment: %v", err)
+		}
+		totalRecords -= len(oldest.index)
+		totalBytes -= oldest.size
+		h.segments = h.segments[1:]
+	}
+	return nil
+}
+
+func (h *FileHistory) Recent(channel string, before uint64, limit int) ([][]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cutoff time.Time
+	if h.opts.MaxAge > 0 {
+		cutoff = time.Now().Add(-h.opts.MaxAge)
+	}
+
+	// Segments are read newest first, so the record with ID before is found
+	// before any that are older than it.
+	found := before == 0
+	recent := [][]byte{}
+	for i := len(h.segments) - 1; i >= 0 && len(recent) < limit; i-- {
+		seg := h.segments[i]
+		matches := []recordIndex{}
+		for j := len(seg.index) - 1; j >= 0 && len(recent)+len(matches) < limit; j-- {
+			entry := seg.index[j]
+			if !found {
+				found = entry.id == before
+				continue
+			}
+			if entry.channel == channel && !entry.sent.Before(cutoff) {
+				matches = append(matches, entry)
+			}
+		}
+		msgs, err := seg.readMessages(matches)
+		if err != nil {
+			return nil, err
+		}
+		recent = append(recent, msgs...)
+	}
+	slices.Reverse(recent)
+	return recent, nil
+}
+
+func (seg *segment) readMessages(entries []recordIndex) ([][]byte, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read history segment: %v", err)
+	}
+	defer f.Close()
+	msgs := make([][]byte, 0, len(entries))
+	for _, entry := range entries {
+		msg := make([]byte, entry.msgLen)
+		_, err = f.ReadAt(msg, entry.msgOffset)
+		if err != nil {
+			return nil, fmt.Errorf("could not read history segment: %v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// Drop keeps the channel's history, as the store is meant to outlast channels
+// and restarts. It is there again if the channel is created again, until
+// retention removes it.
+func (h *FileHistory) Drop(channel string) error {
+	return nil
+}
+
+func (h *FileHistory) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err := h.active.Sync()
+	if err != nil {
+		return fmt.Errorf("could not sync history: %v", err)
+	}
+	return h.active.Close()
+}
+
+func encodeRecord(r historyRecord) []byte {
+	body := binary.BigEndian.AppendUint64(nil, uint64(r.sent.UnixNano()))
+	body = binary.BigEndian.AppendUint64(body, r.id)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(r.channel)))
+	body = append(body, r.channel...)
+	body = append(body, r.msg...)
+
+	record := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	record = binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(body))
+	return append(record, body...)
+}
+
+// decodeRecords indexes records until the end of data or the first partial or
+// corrupt record, and returns the length of data that holds complete ones.
+func decodeRecords(data []byte) ([]recordIndex, int) {
+	index := []recordIndex{}
+	offset := 0
+	for len(data)-offset >= recordHeaderSize {
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		sum := binary.BigEndian.Uint32(data[offset+4:])
+		start := offset + recordHeaderSize
+		if size < recordBodyMinSize || size > len(data)-start {
+			break
+		}
+		body := data[start : start+size]
+		if crc32.ChecksumIEEE(body) != sum {
+			break
+		}
+		channelEnd := recordBodyMinSize + int(binary.BigEndian.Uint16(body[16:]))
+		if channelEnd > size {
+			break
+		}
+		index = append(index, recordIndex{
+			sent:      time.Unix(0, int64(binary.BigEndian.Uint64(body))),
+			id:        binary.BigEndian.Uint64(body[8:]),
+			channel:   string(body[recordBodyMinSize:channelEnd]),
+			msgOffset: int64(start + channelEnd),
+			msgLen:    size - channelEnd,
+		})
+		offset = start + size
+	}
+	return index, offset
+}
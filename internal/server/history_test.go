@@ -0,0 +1,268 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MatthewTully/simple-chat-server/internal/encoding"
+)
+
+// appendTestHistory appends count messages to the channel, and returns their
+// IDs.
+func appendTestHistory(t *testing.T, h HistoryStore, channel string, count int) []uint64 {
+	t.Helper()
+	ids := []uint64{}
+	for i := range count {
+		id := encoding.NewMessageID()
+		err := h.Append(channel, id, []byte(fmt.Sprintf("%v %d", channel, i)))
+		if err != nil {
+			t.Fatalf("could not append history: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestFileHistory(t *testing.T) {
+	t.Run("history is kept across reopening", func(t *testing.T) {
+		dir := t.TempDir()
+		h, err := OpenFileHistory(dir, FileHistoryOptions{Sync: SyncEveryWrite})
+		if err != nil {
+			t.Fatalf("could not open history: %v", err)
+		}
+		appendTestHistory(t, h, "#general", 5)
+		appendTestHistory(t, h, "#random", 2)
+		h.Close()
+
+		h, err = OpenFileHistory(dir, FileHistoryOptions{})
+		if err != nil {
+			t.Fatalf("could not reopen history: %v", err)
+		}
+		defer h.Close()
+		recent, err := h.Recent("#general", 0, 3)
+		if err != nil {
+			t.Fatalf("could not read history: %v", err)
+		}
+		expected := []string{"#general 2", "#general 3", "#general 4"}
+		if len(recent) != len(expected) {
+			t.Fatalf("Expected %d messages, Got %d", len(expected), len(recent))
+		}
+		for i, msg := range recent {
+			if string(msg) != expected[i] {
+				t.Errorf("Expected %q at index %d, Got %q", expected[i], i, msg)
+			}
+		}
+		recent, _ = h.Recent("#random", 0, 10)
+		if len(recent) != 2 {
+			t.Errorf("Expected 2 #random messages, Got %d", len(recent))
+		}
+	})
+
+	t.Run("index matches the segment after reopening", func(t *testing.T) {
+		dir := t.TempDir()
+		h, err := OpenFileHistory(dir, FileHistoryOptions{})
+		if err != nil {
+			t.Fatalf("could not open history: %v", err)
+		}
+		appendTestHistory(t, h, "#general", 3)
+		appendTestHistory(t, h, "#random", 2)
+		appended := h.segments[0].index
+		h.Close()
+
+		h, err = OpenFileHistory(dir, FileHistoryOptions{})
+		if err != nil {
+			t.Fatalf("could not reopen history: %v", err)
+		}
+		defer h.Close()
+		recovered := h.segments[0].index
+		if len(recovered) != len(appended) {
+			t.Fatalf("Expected %d indexed records, Got %d", len(appended), len(recovered))
+		}
+		for i := range appended {
+			if !recovered[i].sent.Equal(appended[i].sent) || recovered[i].id != appended[i].id || recovered[i].channel != appended[i].channel ||
+				recovered[i].msgOffset != appended[i].msgOffset || recovered[i].msgLen != appended[i].msgLen {
+				t.Errorf("Expected record %d to be indexed as %+v, Got %+v", i, appended[i], recovered[i])
+			}
+		}
+	})
+
+	t.Run("partial record is truncated", func(t *testing.T) {
+		dir := t.TempDir()
+		h, err := OpenFileHistory(dir, FileHistoryOptions{})
+		if err != nil {
+			t.Fatalf("could not open history: %v", err)
+		}
+		appendTestHistory(t, h, "#general", 3)
+		h.Close()
+
+		path := segmentFiles(t, dir)[0]
+		info, _ := os.Stat(path)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		partial := encodeRecord(historyRecord{sent: time.Now(), channel: "#general", msg: []byte("cut off")})
+		f.Write(partial[:len(partial)-3])
+		f.Close()
+
+		h, err = OpenFileHistory(dir, FileHistoryOptions{})
+		if err != nil {
+			t.Fatalf("could not reopen history: %v", err)
+		}
+		defer h.Close()
+		truncated, _ := os.Stat(path)
+		if truncated.Size() != info.Size() {
+			t.Errorf("Expected segment to be truncated to %d bytes, Got %d", info.Size(), truncated.Size())
+		}
+		appendTestHistory(t, h, "#random", 1)
+		recent, _ := h.Recent("#general", 0, 10)
+		if len(recent) != 3 {
+			t.Errorf("Expected 3 messages after recovery, Got %d", len(recent))
+		}
+		recent, _ = h.Recent("#random", 0, 10)
+		if len(recent) != 1 {
+			t.Errorf("Expected message appended after recovery, Got %d", len(recent))
+		}
+	})
+
+	t.Run("failed write is truncated", func(t *testing.T) {
+		dir := t.TempDir()
+		h, err := OpenFileHistory(dir, FileHistoryOptions{})
+		if err != nil {
+			t.Fatalf("could not open history: %v", err)
+		}
+		defer h.Close()
+		appendTestHistory(t, h, "#general", 3)
+		path := segmentFiles(t, dir)[0]
+		info, _ := os.Stat(path)
+
+		// Leave part of a record behind, and make the next write fail.
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("partial"))
+		f.Close()
+		h.active.Close()
+		h.active, err = os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = h.Append("#general", encoding.NewMessageID(), []byte("not written"))
+		if err == nil {
+			t.Fatalf("Expected the write to fail")
+		}
+		truncated, _ := os.Stat(path)
+		if truncated.Size() != info.Size() {
+			t.Errorf("Expected segment to be truncated to %d bytes, Got %d", info.Size(), truncated.Size())
+		}
+	})
+
+	t.Run("segments rotate and old ones are removed", func(t *testing.T) {
+		dir := t.TempDir()
+		record := len(encodeRecord(historyRecord{channel: "#general", msg: []byte("#general 0")}))
+		h, err := OpenFileHistory(dir, FileHistoryOptions{
+			SegmentSize: int64(record * 5),
+			MaxRecords:  10,
+		})
+		if err != nil {
+			t.Fatalf("could not open history: %v", err)
+		}
+		defer h.Close()
+		appendTestHistory(t, h, "#general", 10)
+		if len(segmentFiles(t, dir)) != 2 {
+			t.Errorf("Expected 2 segments, Got %d", len(segmentFiles(t, dir)))
+		}
+		appendTestHistory(t, h, "#general", 5)
+		if len(segmentFiles(t, dir)) != 2 {
+			t.Errorf("Expected oldest segment to be removed, Got %d segments", len(segmentFiles(t, dir)))
+		}
+		recent, _ := h.Recent("#general", 0, 100)
+		if len(recent) != 10 || string(recent[0]) != "#general 5" {
+			t.Errorf("Expected the newest segments to remain, Got %d messages", len(recent))
+		}
+	})
+
+	t.Run("old messages are not returned", func(t *testing.T) {
+		h, err := OpenFileHistory(t.TempDir(), FileHistoryOptions{MaxAge: 50 * time.Millisecond})
+		if err != nil {
+			t.Fatalf("could not open history: %v", err)
+		}
+		defer h.Close()
+		appendTestHistory(t, h, "#general", 2)
+		time.Sleep(100 * time.Millisecond)
+		appendTestHistory(t, h, "#general", 1)
+		recent, _ := h.Recent("#general", 0, 10)
+		if len(recent) != 1 {
+			t.Errorf("Expected only the newest message, Got %d", len(recent))
+		}
+	})
+}
+
+func TestHistoryPaging(t *testing.T) {
+	fileHistory, err := OpenFileHistory(t.TempDir(), FileHistoryOptions{})
+	if err != nil {
+		t.Fatalf("could not open history: %v", err)
+	}
+	defer fileHistory.Close()
+	stores := map[string]HistoryStore{
+		"memory": NewMemoryHistory(20),
+		"file":   fileHistory,
+	}
+
+	for name, h := range stores {
+		t.Run(name, func(t *testing.T) {
+			ids := appendTestHistory(t, h, "#general", 10)
+			appendTestHistory(t, h, "#random", 3)
+
+			page, err := h.Recent("#general", ids[6], 4)
+			if err != nil {
+				t.Fatalf("could not read history: %v", err)
+			}
+			expected := []string{"#general 2", "#general 3", "#general 4", "#general 5"}
+			if len(page) != len(expected) {
+				t.Fatalf("Expected %d messages, Got %d", len(expected), len(page))
+			}
+			for i, msg := range page {
+				if string(msg) != expected[i] {
+					t.Errorf("Expected %q at index %d, Got %q", expected[i], i, msg)
+				}
+			}
+
+			page, _ = h.Recent("#general", ids[1], 4)
+			if len(page) != 1 || string(page[0]) != "#general 0" {
+				t.Errorf("Expected only the first message before the second, Got %q", page)
+			}
+			page, _ = h.Recent("#general", 12345, 4)
+			if len(page) != 0 {
+				t.Errorf("Expected no messages before an unknown ID, Got %d", len(page))
+			}
+		})
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for input, expected := range map[string]SyncPolicy{"": SyncNone, "always": SyncEveryWrite, "Periodic": SyncPeriodic} {
+		policy, err := ParseSyncPolicy(input)
+		if err != nil || policy != expected {
+			t.Errorf("Expected %q to parse as %v, Got %v (%v)", input, expected, policy, err)
+		}
+	}
+	_, err := ParseSyncPolicy("sometimes")
+	if err == nil {
+		t.Errorf("Expected unknown policy to fail")
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultInviteUses = 1
+	DefaultInviteTTL  = 24 * time.Hour
+	inviteTokenSize   = 16
+	// Only the start of a token is logged, so the log can't be used to join.
+	invitePrefixSize = 8
+)
+
+var ErrInvalidInvite = errors.New("invite is not valid, or has expired")
+
+// Invite lets users join a password protected server without the password.
+// It can be used MaxUses times before it expires.
+type Invite struct {
+	Token    string
+	MaxUses  int
+	Uses     int
+	Created  time.Time
+	Expires  time.Time
+	JoinedBy []string
+}
+
+func invitePrefix(token string) string {
+	if len(token) <= invitePrefixSize {
+		return token
+	}
+	return token[:invitePrefixSize] + "..."
+}
+
+func (i Invite) usable(now time.Time) bool {
+	return i.Uses < i.MaxUses && now.Before(i.Expires)
+}
+
+// Status describes whether the invite can still be used.
+func (i Invite) Status(now time.Time) string {
+	switch {
+	case i.Uses >= i.MaxUses:
+		return "used up"
+	case !now.Before(i.Expires):
+		return "expired"
+	}
+	return "active"
+}
+
+// InviteStore holds the invites issued by the host. Used up and expired
+// invites are kept, so the host can still see who joined with them, until
+// they are revoked.
+type InviteStore struct {
+	invites map[string]*Invite
+	mu      sync.Mutex
+}
+
+func NewInviteStore() *InviteStore {
+	return &InviteStore{
+		invites: make(map[string]*Invite),
+	}
+}
+
+func (s *InviteStore) Issue(maxUses int, ttl time.Duration, now time.Time) (Invite, error) {
+	if maxUses < 1 {
+		return Invite{}, fmt.Errorf("invite must allow at least one use")
+	}
+	if ttl <= 0 {
+		return Invite{}, fmt.Errorf("invite must expire in the future")
+	}
+	b := make([]byte, inviteTokenSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return Invite{}, fmt.Errorf("could not generate invite token: %v", err)
+	}
+	invite := &Invite{
+		Token:   base64.RawURLEncoding.EncodeToString(b),
+		MaxUses: maxUses,
+		Created: now,
+		Expires: now.Add(ttl),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invites[invite.Token] = invite
+	return *invite, nil
+}
+
+// Redeem uses up one use of the invite for username.
+func (s *InviteStore) Redeem(token, username string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invite, exists := s.invites[token]
+	if !exists || !invite.usable(now) {
+		return ErrInvalidInvite
+	}
+	invite.Uses++
+	invite.JoinedBy = append(invite.JoinedBy, username)
+	return nil
+}
+
+// Release gives back a use redeemed by username, for when they could not join
+// after all.
+func (s *InviteStore) Release(token, username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invite, exists := s.invites[token]
+	if !exists {
+		return
+	}
+	i := slices.Index(invite.JoinedBy, username)
+	if i == -1 {
+		return
+	}
+	invite.JoinedBy = slices.Delete(invite.JoinedBy, i, i+1)
+	invite.Uses--
+}
+
+func (s *InviteStore) Revoke(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, exists := s.invites[token]
+	delete(s.invites, token)
+	return exists
+}
+
+// List returns every invite that has not been revoked, oldest first,
+// including those that are used up or expired.
+func (s *InviteStore) List() []Invite {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invites := []Invite{}
+	for _, invite := range s.invites {
+		i := *invite
+		i.JoinedBy = append([]string{}, invite.JoinedBy...)
+		invites = append(invites, i)
+	}
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].Created.Before(invites[j].Created)
+	})
+	return invites
+}
@@ -1,11 +1,11 @@
 package server
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
 	"net"
-	"slices"
-	"strings"
+	"os"
 	"time"
 
 	"github.com/MatthewTully/simple-chat-server/internal/crypto"
@@ -14,6 +14,13 @@ import (
 
 const (
 	network = "tcp"
+	// acceptRetryDelay is how long to wait after Accept fails, so an error
+	// that keeps happening, like running out of file descriptors, doesn't
+	// spin the loop.
+	acceptRetryDelay = 100 * time.Millisecond
+	// denyWriteTimeout is how long telling a user they were refused may take
+	// once their handshake has run out of time.
+	denyWriteTimeout = time.Second
 )
 
 func NewListener(port string) (net.Listener, error) {
@@ -27,77 +34,201 @@ func NewListener(port string) (net.Listener, error) {
 	return listener, nil
 }
 
+// EnableTLS wraps the listener so clients must connect over TLS with the
+// given certificate.
+func (s *Server) EnableTLS(cert tls.Certificate) {
+	s.Listener = tls.NewListener(s.Listener, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+}
+
 func (s *Server) StartListening() {
 	s.cfg.Logger.Printf("Server is listening on %v\n", s.Listener.Addr().String())
 	defer s.Listener.Close()
 	for {
 		conn, err := s.Listener.Accept()
 		if err != nil {
-			log.Fatalln(err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.cfg.Logger.Printf("error accepting connection: %v", err)
+			time.Sleep(acceptRetryDelay)
+			continue
 		}
 
-		conIp := strings.Split(conn.RemoteAddr().String(), ":")[0]
-		if slices.Contains(s.Blacklist, conIp) {
-			s.DenyConnection(conn, "cannot connect to server: IP banned")
+		// Refusing here is done without a reply, as writing one could block
+		// the accept loop.
+		conIp := remoteHost(conn.RemoteAddr())
+		err = s.Handshakes.Start(conIp)
+		if err != nil {
+			s.cfg.Logger.Printf("refusing connection from %v: %v", conn.RemoteAddr().String(), err)
+			conn.Close()
+			continue
+		}
+		if !s.trackConnection() {
+			s.Handshakes.Done(conIp)
+			conn.Close()
+			return
 		}
-
-		c := make(chan ConnectedUser, 1)
 		go func() {
-			cliPub, err := s.AwaitHandshake(conn)
-			if err != nil {
-				s.DenyConnection(conn, err.Error())
-				return
-			}
-			key, err := crypto.BytesToRSAPublicKey(cliPub.Data[:cliPub.MsgSize])
-			if err != nil {
-				s.DenyConnection(conn, err.Error())
-				return
-			}
+			defer s.connWG.Done()
+			s.handleConnection(newConnectedUser(conn), conIp)
+		}()
+	}
+}
 
-			err = s.SendHandshakeResponse(conn)
-			if err != nil {
-				s.DenyConnection(conn, err.Error())
-				return
-			}
+// remoteHost is the IP of addr without the port, which connections are
+// limited and banned by.
+func remoteHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
 
-			cliAES, err := s.AwaitClientAESKey(conn, key)
-			if err != nil {
-				s.DenyConnection(conn, err.Error())
-				return
-			}
+// trackConnection counts a new connection's goroutine for Shutdown to wait
+// on, unless the server is already shutting down.
+func (s *Server) trackConnection() bool {
+	s.rwmu.RLock()
+	defer s.rwmu.RUnlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.connWG.Add(1)
+	return true
+}
 
-			err = s.SendAESKey(conn, key)
-			if err != nil {
-				s.DenyConnection(conn, err.Error())
-				return
-			}
-			newUser := ConnectedUser{
-				conn: conn,
-				userInfo: struct {
-					Username   string
-					UserColour string
-				}{
-					Username:   string(cliPub.Username[:cliPub.UsernameSize]),
-					UserColour: string(cliPub.UserColour[:cliPub.UserColourSize]),
-				},
-				publicKey:     key,
-				AESKey:        cliAES,
-				multiMessages: make(map[int]encoding.MsgProtocol),
-			}
-			c <- newUser
-		}()
+// handleConnection runs the handshake for a new connection, then processes
+// the user's messages until they disconnect.
+func (s *Server) handleConnection(newUser *ConnectedUser, conIp string) {
+	deadline := time.Now().Add(s.HandshakeTimeout)
+	newUser.conn.SetDeadline(deadline)
+	err := s.handshake(newUser, conIp)
+	s.Handshakes.Done(conIp)
+	if err != nil {
+		if time.Now().After(deadline) {
+			// Leave a moment to tell the user why they were refused.
+			newUser.conn.SetWriteDeadline(time.Now().Add(denyWriteTimeout))
+			err = ErrHandshakeTimedOut
+		}
+		s.releaseInvite(newUser)
+		s.DenyConnection(newUser, err.Error())
+		return
+	}
+	newUser.conn.SetDeadline(time.Time{})
 
-		select {
-		case res := <-c:
-			user, err := s.NewConnection(res)
-			if err != nil {
-				s.DenyConnection(conn, err.Error())
-			} else {
-				go user.ProcessMessage(s)
+	user, err := s.NewConnection(newUser)
+	if err != nil {
+		s.releaseInvite(newUser)
+		s.DenyConnection(newUser, err.Error())
+		return
+	}
+	if user.invite != "" {
+		s.cfg.Logger.Printf("user %v joined with invite %v", user.userInfo.Username, invitePrefix(user.invite))
+	}
+	user.ProcessMessage(s)
+}
+
+// releaseInvite gives back the invite the user redeemed, as they were refused
+// after it was accepted.
+func (s *Server) releaseInvite(cu *ConnectedUser) {
+	if cu.invite == "" {
+		return
+	}
+	s.Invites.Release(cu.invite, cu.userInfo.Username)
+	cu.invite = ""
+}
+
+// handshake checks the connection is allowed, agrees the protocol version and
+// session keys with the client, and authenticates the user. The error is the
+// reason given to the user for refusing them.
+func (s *Server) handshake(newUser *ConnectedUser, conIp string) error {
+	conn := newUser.conn
+	if s.isBanned(conIp) {
+		return fmt.Errorf("cannot connect to server: IP banned")
+	}
+	if s.Password != "" && !s.AuthLimiter.Allowed(conIp, time.Now()) {
+		s.cfg.Logger.Printf("refusing connection from %v: %v", conn.RemoteAddr().String(), ErrTooManyAuthFailures)
+		return fmt.Errorf("cannot connect to server: %v", ErrTooManyAuthFailures)
+	}
+
+	handshake, err := s.AwaitHandshake(newUser)
+	if err != nil {
+		return err
+	}
+	version, err := encoding.NegotiateVersion(handshake.MinVersion, handshake.MaxVersion)
+	if err != nil {
+		s.cfg.Logger.Printf("refusing connection from %v: %v", conn.RemoteAddr().String(), err)
+		return fmt.Errorf("cannot connect to server: %v", err)
+	}
+	if len(handshake.Username) == 0 || len(handshake.Username) > encoding.MaxUsernameSize {
+		return fmt.Errorf("cannot connect to server: username must be between 1 and %d bytes", encoding.MaxUsernameSize)
+	}
+	newUser.protocolVersion = version
+	newUser.capabilities = handshake.Capabilities & encoding.SupportedCapabilities
+	if _, isTLS := conn.(*tls.Conn); !isTLS || !s.TLSOnly {
+		newUser.capabilities &^= encoding.CapTLSOnly
+	}
+	if !s.IsAdmin(handshake.Username) {
+		newUser.capabilities &^= encoding.CapAdmin
+	}
+
+	key, err := crypto.BytesToRSAPublicKey(handshake.PublicKey)
+	if err != nil {
+		return err
+	}
+	newUser.publicKey = key
+	newUser.userInfo = UserInfo{
+		Username:   handshake.Username,
+		UserColour: handshake.UserColour,
+	}
+	newUser.keyFingerprint, err = crypto.RSAPublicKeyFingerprint(key)
+	if err != nil {
+		return err
+	}
+	err = s.UserKeys.Check(newUser.userInfo.Username, newUser.keyFingerprint)
+	if err != nil {
+		s.cfg.Logger.Printf("refusing connection from %v: %v", conn.RemoteAddr().String(), err)
+		return fmt.Errorf("cannot connect to server: %v", err)
+	}
+
+	err = s.SendHandshakeResponse(newUser)
+	if err != nil {
+		return err
+	}
+
+	keys, err := s.ExchangeSessionKeys(newUser)
+	if err != nil {
+		return err
+	}
+	if newUser.capabilities.Has(encoding.CapTLSOnly) {
+		newUser.session = crypto.NewPlaintextSession()
+	} else {
+		newUser.session = crypto.NewSession(keys, true)
+		newUser.session.RekeyAfterFrames = s.RekeyAfterFrames
+		newUser.session.RekeyAfter = s.RekeyAfter
+	}
+	newUser.secureChannel = true
+
+	if s.Password != "" {
+		err = s.AwaitAuthentication(newUser)
+		if err != nil {
+			// A client that is too slow hasn't given a wrong password.
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				s.AuthLimiter.Fail(conIp, time.Now())
 			}
-		case <-time.After(30 * time.Second):
-			s.DenyConnection(conn, "cannot connect to server: Connection timed out")
+			s.cfg.Logger.Printf("refusing connection from %v: %v", conn.RemoteAddr().String(), err)
+			return fmt.Errorf("cannot connect to server: %v", err)
 		}
+		s.AuthLimiter.Succeed(conIp)
+	}
 
+	err = s.UserKeys.Claim(newUser.userInfo.Username, newUser.keyFingerprint)
+	if err != nil {
+		s.cfg.Logger.Printf("refusing connection from %v: %v", conn.RemoteAddr().String(), err)
+		return fmt.Errorf("cannot connect to server: %v", err)
 	}
+	return nil
 }
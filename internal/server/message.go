@@ -1,9 +1,12 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net"
-	"strings"
+	"slices"
+	"time"
 
 	"github.com/MatthewTully/simple-chat-server/internal/encoding"
 )
@@ -11,74 +14,109 @@ import (
 func (s *Server) ActionMessageType(p encoding.MsgProtocol, data []byte) error {
 	switch p.MessageType {
 	case encoding.KeepAlive:
-		s.ActionKeepAlive(string(p.Username[:p.UsernameSize]))
+		s.ActionKeepAlive(p.Username)
 	case encoding.Message:
-		sentBy := string(p.Username[:p.UsernameSize])
-		msg := []byte(fmt.Sprintf("[white]%v[white] [%s]%v ~[white] ", p.DateTime.Format("02/01/06 15:04"), string(p.UserColour[:p.UserColourSize]), sentBy))
-		msg = append(msg, data...)
-		s.ProcessGroupMessage(sentBy, msg)
+		sentBy := p.Username
+		channel := p.Channel
+		if channel == "" {
+			channel = encoding.DefaultChannel
+		}
+		if !s.IsChannelMember(channel, sentBy) {
+			s.SendErrorToClient(sentBy, fmt.Sprintf("You are not in %v, use \\join %v to join it.\n", channel, channel))
+			return nil
+		}
+		s.ProcessChannelMessage(channel, sentBy, encoding.ChatRecord{
+			ID:     encoding.NewMessageID(),
+			Type:   encoding.RecordMessage,
+			Sender: sentBy,
+			Colour: p.UserColour,
+			Sent:   time.Now().UTC(),
+			Body:   data,
+		})
+	case encoding.JoinChannel:
+		err := s.JoinChannel(p.Username, p.Channel)
+		if err != nil {
+			s.SendErrorToClient(p.Username, fmt.Sprintf("Could not join %v: %v\n", p.Channel, err))
+		}
+	case encoding.LeaveChannel:
+		err := s.LeaveChannel(p.Username, p.Channel)
+		if err != nil {
+			s.SendErrorToClient(p.Username, fmt.Sprintf("Could not leave %v: %v\n", p.Channel, err))
+		}
+	case encoding.HistoryRequest:
+		err := s.ActionHistoryRequest(p.Username, p.Channel, data)
+		if err != nil {
+			s.cfg.Logger.Printf("could not send %v history to %v: %v", p.Channel, p.Username, err)
+		}
+	case encoding.AdminCommand:
+		err := s.ActionAdminCommand(p.Username, data)
+		if err != nil {
+			s.cfg.Logger.Printf("could not run admin command from %v: %v", p.Username, err)
+		}
+	case encoding.ChannelList:
+		err := s.SendChannelList(p.Username)
+		if err != nil {
+			s.cfg.Logger.Printf("could not send channel list to %v: %v", p.Username, err)
+		}
 	case encoding.WhisperMessage:
-		sentBy := string(p.Username[:p.UsernameSize])
-		baseMsg := string(data)
-		split := strings.Split(baseMsg, " ")
-		toUser := split[0]
-		msg := []byte(fmt.Sprintf("[white]%v[white] [%s][::i](whispered)[::-] %v ~[white] ", p.DateTime.Format("02/01/06 15:04"), string(p.UserColour[:p.UserColourSize]), sentBy))
-		joined := fmt.Sprintf("[:r:i]%v[:-:-]", strings.Join(split, " "))
-		msg = append(msg, []byte(joined)...)
-		s.SentMessageToClient(toUser, msg)
+		err := s.RelayWhisper(p.Username, data)
+		if err != nil {
+			s.cfg.Logger.Printf("could not relay whisper from %v: %v", p.Username, err)
+		}
 	case encoding.RequestDisconnect:
-		s.CloseConnectionForUser(string(p.Username[:p.UsernameSize]))
+		s.CloseConnectionForUser(p.Username)
 	}
 	return fmt.Errorf("could not determine message type. %v", p.MessageType)
 }
 
-func (s *Server) ProcessGroupMessage(sentBy string, msg []byte) {
-	s.AddMsgToHistory(msg)
-	toSend, err := encoding.PrepBytesForSending(msg, encoding.Message, s.cfg.ServerName, "white", s.cfg.AESKey)
-	if err != nil {
-		s.cfg.Logger.Printf("error creating packet to send: %v", err)
-	}
-	s.cfg.Logger.Printf("ProcessGroupMessage: len %v\n", len(toSend))
-	s.BroadcastMessage(sentBy, toSend)
-}
-
 func (s *Server) AwaitMessage(user *ConnectedUser) {
-	defer s.CloseConnectionForUser(user.userInfo.Username)
+	defer s.connWG.Done()
+	defer s.CloseConnection(user)
 	for {
-		buf := make([]byte, encoding.MaxPacketSize)
-		var data []byte
-
-		nr, err := user.conn.Read(buf)
-		s.cfg.Logger.Printf("nr=%v\n", nr)
-
-		data = buf[0:nr]
-
-		if nr == 0 {
-			return
-		}
-
+		frame, err := user.frameReader.ReadFrame()
 		if err != nil {
-			s.cfg.Logger.Printf("Server error\n")
-			if err.Error() != "EOF" {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
 				s.cfg.Logger.Printf("error reading from conn: %v\n", err)
 			}
 			return
 		}
-		s.ActionKeepAlive(user.userInfo.Username)
-		user.processChannel <- data
-
+		select {
+		case user.processChannel <- frame:
+		case <-user.ctx.Done():
+			return
+		}
 	}
 }
 
-func SendMessage(conn net.Conn, msg []byte) error {
-	_, err := conn.Write(msg)
+// SendMessage queues the packets for the user's writer, which encrypts them
+// under the user's own session key, so a frame sent to one user cannot be
+// read by anyone else in the room. They are encrypted under the frame
+// writer's lock so their sequence numbers reach the user in order. Until the
+// user has joined, the packets are written straight away.
+func SendMessage(user *ConnectedUser, packets [][]byte) error {
+	return sendMessage(user, outboundMessage{packets: packets})
+}
+
+// sendControlMessage is SendMessage for messages that must not be dropped
+// when the user's queue is full.
+func sendControlMessage(user *ConnectedUser, packets [][]byte) error {
+	return sendMessage(user, outboundMessage{packets: packets, control: true})
+}
+
+func sendMessage(user *ConnectedUser, msg outboundMessage) error {
+	var err error
+	if user.queue == nil {
+		err = user.frameWriter.WriteSealedFrames(user.session.Encrypt, msg.packets...)
+	} else {
+		err = user.queue.push(msg)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to sent to user %s: %v", conn.RemoteAddr().String(), err)
+		return fmt.Errorf("failed to sent to user %s: %v", user.conn.RemoteAddr().String(), err)
 	}
 	return nil
 }
 
-func (s *Server) BroadcastMessage(sentBy string, message []byte) []error {
+func (s *Server) BroadcastMessage(sentBy string, packets [][]byte) []error {
 	failedAttempts := []error{}
 
 	s.rwmu.RLock()
@@ -86,7 +124,7 @@ func (s *Server) BroadcastMessage(sentBy string, message []byte) []error {
 
 	for users, conns := range s.LiveConns {
 		if users != sentBy {
-			err := SendMessage(conns.conn, message)
+			err := SendMessage(conns, packets)
 			if err != nil {
 				failedAttempts = append(failedAttempts, err)
 			}
@@ -99,60 +137,127 @@ func (s *Server) BroadcastMessage(sentBy string, message []byte) []error {
 }
 
 func (s *Server) SentMessageToClient(client string, msg []byte) error {
+	return s.sendToClient(client, "", msg, encoding.Message)
+}
+
+func (s *Server) SendErrorToClient(client string, msg string) error {
+	return s.sendToClient(client, "", []byte(msg), encoding.ErrorMessage)
+}
+
+func (s *Server) sendToClient(client, channel string, msg []byte, messageType encoding.MessageType) error {
 	s.rwmu.RLock()
 	defer s.rwmu.RUnlock()
 	user, ok := s.LiveConns[client]
 	if !ok {
-		return fmt.Errorf("failed to sent to user %s: User does not exist", user.userInfo.Username)
+		return fmt.Errorf("failed to sent to user %s: User does not exist", client)
 	}
 
-	toSend, err := encoding.PrepBytesForSending(msg, encoding.Message, s.cfg.ServerName, "white", s.cfg.AESKey)
+	toSend := encoding.PrepChannelPacketsForSending(msg, messageType, channel, s.cfg.ServerName, "white")
+	s.cfg.Logger.Printf("sendToClient: packets %v\n", len(toSend))
+	return SendMessage(user, toSend)
+}
+
+// RelayWhisper forwards a whisper to its recipient without opening it, the
+// sealed message can only be read by the recipient.
+func (s *Server) RelayWhisper(sentBy string, data []byte) error {
+	whisper, err := encoding.DecodeWhisper(data)
 	if err != nil {
-		return fmt.Errorf("error creating packet to send: %v", err)
+		return err
 	}
+	whisper.From = sentBy
+	toSend, err := encoding.EncodeWhisper(whisper)
+	if err != nil {
+		return err
+	}
+	err = s.sendToClient(whisper.To, "", toSend, encoding.WhisperMessage)
+	if err != nil {
+		s.SendErrorToClient(sentBy, fmt.Sprintf("Could not whisper to %v, they are not connected.\n", whisper.To))
+		return err
+	}
+	return nil
+}
 
-	s.cfg.Logger.Printf("SentMessageToClient: len %v\n", len(toSend))
-	err = SendMessage(user.conn, toSend)
-	return err
+// ActionHistoryRequest sends the page of history a channel member asked for.
+func (s *Server) ActionHistoryRequest(username, channel string, data []byte) error {
+	req, err := encoding.DecodeHistoryRequest(data)
+	if err != nil {
+		return err
+	}
+	if !s.IsChannelMember(channel, username) {
+		return s.SendErrorToClient(username, fmt.Sprintf("You are not in %v, use \\join %v to join it.\n", channel, channel))
+	}
+	limit := min(max(req.Limit, 1), encoding.MaxHistoryPageSize)
+	return s.SendHistoryPage(username, channel, req.Before, limit)
 }
 
-func (s *Server) SendHistory(user *ConnectedUser) error {
-	if len(s.MsgHistory) > 0 {
-		s.rwmu.RLock()
-		defer s.rwmu.RUnlock()
-		err := s.SentMessageToClient(user.userInfo.Username, []byte("--- Message History ---\n"))
-		if err != nil {
-			return err
-		}
-		for _, msg := range s.MsgHistory {
-			err := s.SentMessageToClient(user.userInfo.Username, msg)
-			if err != nil {
-				return err
-			}
+// SendChannelHistory sends the latest page of the channel's history to the
+// user, on joining the channel.
+func (s *Server) SendChannelHistory(username, channel string) error {
+	return s.SendHistoryPage(username, channel, 0, int(s.MaxMsgHistorySize))
+}
+
+// SendHistoryPage sends the user up to limit records of the channel sent
+// before the record with ID before, or the latest if before is 0. The oldest
+// records are left out if they would make the page too large for the client
+// to reassemble, and the page is marked as having more.
+func (s *Server) SendHistoryPage(username, channel string, before uint64, limit int) error {
+	history, err := s.History.Recent(channel, before, limit+1)
+	if err != nil {
+		return err
+	}
+	page := encoding.HistoryPagePayload{Before: before, Records: []encoding.ChatRecord{}}
+	if len(history) > limit {
+		history = history[1:]
+		page.More = true
+	}
+
+	size := 0
+	for i := len(history) - 1; i >= 0; i-- {
+		if size+len(history[i]) > maxHistoryMessageSize {
+			page.More = true
+			break
 		}
-		err = s.SentMessageToClient(user.userInfo.Username, []byte("\n--- New Messages ---\n"))
+		record, err := encoding.DecodeChatRecord(history[i])
 		if err != nil {
-			return err
+			s.cfg.Logger.Printf("Skipping %v history entry: %v", channel, err)
+			continue
 		}
+		page.Records = append(page.Records, record)
+		size += len(history[i])
 	}
-	return nil
+	slices.Reverse(page.Records)
+
+	data, err := encoding.EncodeHistoryPage(page)
+	if err != nil {
+		return err
+	}
+	return s.sendToClient(username, channel, data, encoding.HistoryPage)
 }
 
-func (s *Server) AddMsgToHistory(msg []byte) {
-	s.rwmu.Lock()
-	defer s.rwmu.Unlock()
-	if len(s.MsgHistory) >= int(s.MaxMsgHistorySize) {
-		s.MsgHistory = s.MsgHistory[1:]
+func (s *Server) AddMsgToHistory(channel string, record encoding.ChatRecord) {
+	data, err := encoding.EncodeChatRecord(record)
+	if err == nil {
+		err = s.History.Append(channel, record.ID, data)
+	}
+	if err != nil {
+		s.cfg.Logger.Printf("Could not add message to %v history: %v", channel, err)
+	}
+}
 
+// noticeRecord is a ChatRecord for a notice from the server.
+func (s *Server) noticeRecord(notice string) encoding.ChatRecord {
+	return encoding.ChatRecord{
+		ID:     encoding.NewMessageID(),
+		Type:   encoding.RecordNotice,
+		Sender: s.cfg.ServerName,
+		Colour: "white",
+		Sent:   time.Now().UTC(),
+		Body:   []byte(notice),
 	}
-	s.MsgHistory = append(s.MsgHistory, msg)
 }
 
 func (s *Server) SendDisconnectionNotification(user *ConnectedUser) {
-	toSend, err := encoding.PrepBytesForSending([]byte{}, encoding.RequestDisconnect, s.cfg.ServerName, "white", s.cfg.AESKey)
-	if err != nil {
-		s.cfg.Logger.Printf("error creating packet to send: %v", err)
-	}
-	s.cfg.Logger.Printf("SendDisconnectionNotification: len %v\n", len(toSend))
-	SendMessage(user.conn, toSend)
+	toSend := encoding.PrepPacketsForSending([]byte{}, encoding.RequestDisconnect, s.cfg.ServerName, "white")
+	s.cfg.Logger.Printf("SendDisconnectionNotification: packets %v\n", len(toSend))
+	sendControlMessage(user, toSend)
 }
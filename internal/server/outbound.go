@@ -0,0 +1,212 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MatthewTully/simple-chat-server/internal/encoding"
+)
+
+const (
+	DefaultOutboundQueueSize = 256
+	DefaultWriteTimeout      = 10 * time.Second
+)
+
+var (
+	ErrSlowConsumer = errors.New("disconnected as messages could not be sent to you fast enough")
+	errQueueClosed  = errors.New("outbound queue closed")
+)
+
+// OverflowPolicy is what happens when a user's outbound queue is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest drops the oldest queued message to make room. Rekey and
+	// disconnect messages are never dropped.
+	DropOldest OverflowPolicy = iota
+	// DisconnectSlowConsumer disconnects the user, telling them why.
+	DisconnectSlowConsumer
+)
+
+func ParseOverflowPolicy(policy string) (OverflowPolicy, error) {
+	switch strings.ToLower(policy) {
+	case "", "drop-oldest":
+		return DropOldest, nil
+	case "disconnect":
+		return DisconnectSlowConsumer, nil
+	}
+	return DropOldest, fmt.Errorf("unknown overflow policy %q, expected drop-oldest or disconnect", policy)
+}
+
+// OutboundQueueStats describe a user's outbound queue. MaxDepth is the most
+// messages that have been waiting at once.
+type OutboundQueueStats struct {
+	Username string
+	Depth    int
+	MaxDepth int
+	Dropped  uint64
+}
+
+type outboundMessage struct {
+	packets [][]byte
+	// control messages keep the connection working, and are never dropped.
+	control bool
+}
+
+// outboundQueue holds the messages waiting to be written to a user, so a
+// user that reads slowly only holds up their own messages.
+type outboundQueue struct {
+	size       int
+	policy     OverflowPolicy
+	messages   []outboundMessage
+	ready      chan struct{}
+	closed     bool
+	overflowed bool
+	maxDepth   int
+	dropped    uint64
+	mu         sync.Mutex
+}
+
+func newOutboundQueue(size int, policy OverflowPolicy) *outboundQueue {
+	return &outboundQueue{
+		size:   size,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+func (q *outboundQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *outboundQueue) push(msg outboundMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errQueueClosed
+	}
+	if len(q.messages) >= q.size && !q.makeRoom() {
+		q.overflowed = true
+		q.closed = true
+		q.messages = nil
+		q.signal()
+		return ErrSlowConsumer
+	}
+	q.messages = append(q.messages, msg)
+	q.maxDepth = max(q.maxDepth, len(q.messages))
+	q.signal()
+	return nil
+}
+
+// makeRoom drops the oldest message that isn't a control message, if the
+// policy allows it.
+func (q *outboundQueue) makeRoom() bool {
+	if q.policy != DropOldest {
+		return false
+	}
+	for i, msg := range q.messages {
+		if !msg.control {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			q.dropped++
+			return true
+		}
+	}
+	return false
+}
+
+// pop waits for the next message. Once the queue is closed, it returns the
+// messages left, then errQueueClosed, or ErrSlowConsumer if it overflowed.
+func (q *outboundQueue) pop() (outboundMessage, error) {
+	for {
+		q.mu.Lock()
+		if q.overflowed {
+			q.mu.Unlock()
+			return outboundMessage{}, ErrSlowConsumer
+		}
+		if len(q.messages) > 0 {
+			msg := q.messages[0]
+			q.messages = q.messages[1:]
+			q.mu.Unlock()
+			return msg, nil
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return outboundMessage{}, errQueueClosed
+		}
+		q.mu.Unlock()
+		<-q.ready
+	}
+}
+
+// close stops new messages being queued. Those already queued are still
+// written.
+func (q *outboundQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.signal()
+}
+
+func (q *outboundQueue) stats() OutboundQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return OutboundQueueStats{Depth: len(q.messages), MaxDepth: q.maxDepth, Dropped: q.dropped}
+}
+
+// writeMessages writes the user's queued messages until their connection is
+// closed, then closes it.
+func (s *Server) writeMessages(user *ConnectedUser) {
+	defer s.connWG.Done()
+	defer user.conn.Close()
+	for {
+		msg, err := user.queue.pop()
+		if errors.Is(err, ErrSlowConsumer) {
+			s.cfg.Logger.Printf("disconnecting user %v: outbound queue is full", user.userInfo.Username)
+			user.conn.SetWriteDeadline(time.Now().Add(denyWriteTimeout))
+			toSend := encoding.PrepPacketsForSending([]byte(ErrSlowConsumer.Error()), encoding.ErrorMessage, s.cfg.ServerName, "white")
+			toSend = append(toSend, encoding.PrepPacketsForSending([]byte{}, encoding.RequestDisconnect, s.cfg.ServerName, "white")...)
+			user.frameWriter.WriteSealedFrames(user.session.Encrypt, toSend...)
+			s.CloseConnection(user)
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		user.conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+		err = user.frameWriter.WriteSealedFrames(user.session.Encrypt, msg.packets...)
+		if err != nil {
+			s.cfg.Logger.Printf("failed to send to user %v: %v", user.userInfo.Username, err)
+			user.queue.close()
+			s.CloseConnection(user)
+			return
+		}
+	}
+}
+
+// OutboundQueueStats returns the outbound queue of each connected user, by
+// username.
+func (s *Server) OutboundQueueStats() []OutboundQueueStats {
+	s.rwmu.RLock()
+	defer s.rwmu.RUnlock()
+	stats := []OutboundQueueStats{}
+	for username, user := range s.LiveConns {
+		if user.queue == nil {
+			continue
+		}
+		userStats := user.queue.stats()
+		userStats.Username = username
+		stats = append(stats, userStats)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Username < stats[j].Username
+	})
+	return stats
+}
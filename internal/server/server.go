@@ -1,11 +1,15 @@
 package server
 
 import (
+	"crypto/rsa"
+	"fmt"
 	"log"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/MatthewTully/simple-chat-server/internal/crypto"
+	"github.com/MatthewTully/simple-chat-server/internal/encoding"
 )
 
 type serverConfig struct {
@@ -13,53 +17,78 @@ type serverConfig struct {
 	HostUser   string
 	Logger     *log.Logger
 	RSAKeyPair crypto.RSAKeys
-	AESKey     []byte
 }
 
 type Server struct {
 	cfg                *serverConfig
 	LiveConns          map[string]*ConnectedUser
 	Listener           net.Listener
-	MsgHistory         [][]byte
+	Channels           map[string]*Channel
 	MaxMsgHistorySize  uint
+	History            HistoryStore
 	MaxConnectionLimit uint
 	Blacklist          []string
-	rwmu               *sync.RWMutex
+	UserKeys           *UserRegistry
+	RekeyAfterFrames   uint64
+	RekeyAfter         time.Duration
+	TLSOnly            bool
+	Password           string
+	AuthLimiter        *AuthLimiter
+	Invites            *InviteStore
+	ShutdownNotice     time.Duration
+	HandshakeTimeout   time.Duration
+	Handshakes         *PendingHandshakes
+	OutboundQueueSize  int
+	OverflowPolicy     OverflowPolicy
+	WriteTimeout       time.Duration
+	MaxChannels        int
+	MaxUserChannels    int
+	// Admins are the usernames, other than the host, that may send admin
+	// commands.
+	Admins       []string
+	rwmu         *sync.RWMutex
+	shuttingDown bool
+	connWG       *sync.WaitGroup
 }
 
-func NewServer(port string, historySize uint, logger *log.Logger) (Server, error) {
+// NewServer creates a server listening on port. The identity key pair is
+// what clients pin the server by, so it should be the same on every start.
+func NewServer(port string, historySize uint, identity crypto.RSAKeys, logger *log.Logger) (Server, error) {
+	if identity.PrivateKey == nil || identity.PublicKey == nil {
+		return Server{}, fmt.Errorf("server identity key is not set")
+	}
 	l, err := NewListener(port)
 	if err != nil {
 		return Server{}, err
 	}
 
-	priv, pub, err := crypto.GenerateRSAKeyPair()
-	if err != nil {
-		logger.Fatalf("could not generate RSA key pair for server: %v", err)
-	}
-
-	aesKey, err := crypto.GenerateAESSecretKey()
-	if err != nil {
-		logger.Fatalf("could not generate AES key for server: %v", err)
-	}
-
 	srvCfg := serverConfig{
 		ServerName: "Chat Server",
 		Logger:     logger,
-		RSAKeyPair: crypto.RSAKeys{
-			PrivateKey: priv,
-			PublicKey:  pub,
-		},
-		AESKey: aesKey,
+		RSAKeyPair: identity,
 	}
 
 	srv := Server{
 		LiveConns:         make(map[string]*ConnectedUser),
 		Listener:          l,
 		cfg:               &srvCfg,
-		MsgHistory:        [][]byte{},
+		Channels:          map[string]*Channel{encoding.DefaultChannel: NewChannel(encoding.DefaultChannel)},
 		MaxMsgHistorySize: historySize,
+		History:           NewMemoryHistory(historySize),
+		UserKeys:          NewUserRegistry(),
+		RekeyAfterFrames:  crypto.DefaultRekeyAfterFrames,
+		RekeyAfter:        crypto.DefaultRekeyAfter,
+		AuthLimiter:       NewAuthLimiter(DefaultMaxAuthFailures, DefaultAuthLockout),
+		Invites:           NewInviteStore(),
+		ShutdownNotice:    DefaultShutdownNotice,
+		HandshakeTimeout:  DefaultHandshakeTimeout,
+		Handshakes:        NewPendingHandshakes(DefaultMaxPendingHandshakes, DefaultMaxPendingPerIP),
+		OutboundQueueSize: DefaultOutboundQueueSize,
+		WriteTimeout:      DefaultWriteTimeout,
+		MaxChannels:       DefaultMaxChannels,
+		MaxUserChannels:   DefaultMaxUserChannels,
 		rwmu:              &sync.RWMutex{},
+		connWG:            &sync.WaitGroup{},
 	}
 	return srv, nil
 }
@@ -67,3 +96,7 @@ func NewServer(port string, historySize uint, logger *log.Logger) (Server, error
 func (s *Server) SetHostUser(username string) {
 	s.cfg.HostUser = username
 }
+
+func (s *Server) PublicKey() *rsa.PublicKey {
+	return s.cfg.RSAKeyPair.PublicKey
+}
@@ -1,39 +1,27 @@
 package server
 
 import (
-	"bytes"
-	"crypto/rsa"
-	"encoding/binary"
+	"crypto/ecdh"
 	"fmt"
-	"net"
 
 	"github.com/MatthewTully/simple-chat-server/internal/crypto"
 	"github.com/MatthewTully/simple-chat-server/internal/encoding"
 )
 
-func (s *Server) AwaitHandshake(conn net.Conn) (encoding.MsgProtocol, error) {
+func (s *Server) AwaitHandshake(cu *ConnectedUser) (encoding.HandshakeProtocol, error) {
 	for {
-		buf := make([]byte, encoding.MaxPacketSize)
-		nr, err := conn.Read(buf)
+		frame, err := cu.frameReader.ReadFrame()
 		if err != nil {
 			if err.Error() != "EOF" {
 				s.cfg.Logger.Printf("error reading from conn: %v\n", err)
 			}
-			return encoding.MsgProtocol{}, err
+			return encoding.HandshakeProtocol{}, err
 		}
-		if nr == 0 {
-			continue
-		}
-		data := buf[0:nr]
 
-		sd := bytes.Split(data, encoding.HeaderPattern[:])
-		if len(sd) == 0 {
-			return encoding.MsgProtocol{}, fmt.Errorf("incorrect Message length")
+		dataPacket, err := encoding.DecodeHandshakePacket(frame)
+		if err != nil {
+			return encoding.HandshakeProtocol{}, fmt.Errorf("cannot connect to server: %v. Server supports protocol versions %v", err, encoding.VersionRange(encoding.MinProtocolVersion, encoding.MaxProtocolVersion))
 		}
-		packetLen := binary.BigEndian.Uint16(sd[1][4:])
-		packet := sd[1][encoding.HeaderSize : packetLen+encoding.HeaderSize]
-		buffer := bytes.NewBuffer(packet)
-		dataPacket := encoding.DecodeMsgPacket(buffer)
 		if dataPacket.MessageType == encoding.RequestConnect {
 			s.cfg.Logger.Print("handshake received")
 			return dataPacket, nil
@@ -41,80 +29,164 @@ func (s *Server) AwaitHandshake(conn net.Conn) (encoding.MsgProtocol, error) {
 	}
 }
 
-func (s *Server) SendHandshakeResponse(conn net.Conn) error {
+func (s *Server) SendHandshakeResponse(cu *ConnectedUser) error {
 	pubKeyBytes, err := crypto.RSAPublicKeyToBytes(s.cfg.RSAKeyPair.PublicKey)
 	if err != nil {
 		s.cfg.Logger.Printf("%v", err)
 		return err
 	}
-	handshake, err := encoding.PrepHandshakeForSending(pubKeyBytes, s.cfg.ServerName, "white")
+	handshake, err := encoding.PrepHandshakeForSending(encoding.HandshakeProtocol{
+		MessageType:      encoding.RequestConnect,
+		MinVersion:       cu.protocolVersion,
+		MaxVersion:       cu.protocolVersion,
+		Capabilities:     cu.capabilities,
+		Username:         s.cfg.ServerName,
+		UserColour:       "white",
+		PublicKey:        pubKeyBytes,
+		PasswordRequired: s.Password != "",
+	})
 	if err != nil {
 		return fmt.Errorf("error creating packet to send: %v", err)
 	}
 	s.cfg.Logger.Printf("SendHandshakeResponse: len %v\n", len(handshake))
-	_, err = conn.Write(handshake)
+	err = cu.frameWriter.WriteFrame(handshake)
 	if err != nil {
-		s.cfg.Logger.Printf("failed to send to user %s: %v\n", conn.RemoteAddr().String(), err)
-		return fmt.Errorf("failed to send to user %s: %v", conn.RemoteAddr().String(), err)
+		s.cfg.Logger.Printf("failed to send to user %s: %v\n", cu.conn.RemoteAddr().String(), err)
+		return fmt.Errorf("failed to send to user %s: %v", cu.conn.RemoteAddr().String(), err)
 	}
 	return nil
 }
 
-func (s *Server) SendAESKey(conn net.Conn, cliPubKey *rsa.PublicKey) error {
-	packet, err := encoding.PrepAESForSending(s.cfg.AESKey, cliPubKey, s.cfg.RSAKeyPair)
+func (s *Server) SendKeyExchange(cu *ConnectedUser, eph *ecdh.PrivateKey) error {
+	cliPubBytes, err := crypto.RSAPublicKeyToBytes(cu.publicKey)
+	if err != nil {
+		return err
+	}
+	ephBytes := eph.PublicKey().Bytes()
+	sig, err := crypto.RSASign(crypto.ServerKeyExchangeData(ephBytes, cliPubBytes), s.cfg.RSAKeyPair.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to sign key exchange: %v", err)
+	}
+
+	packet, err := encoding.PrepHandshakeForSending(encoding.HandshakeProtocol{
+		MessageType:  encoding.KeyExchange,
+		Username:     s.cfg.ServerName,
+		UserColour:   "white",
+		EphemeralKey: ephBytes,
+		Signature:    sig,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to prepare AES Packet to send to user %s: %v", conn.RemoteAddr().String(), err)
+		return fmt.Errorf("failed to prepare key exchange to send to user %s: %v", cu.conn.RemoteAddr().String(), err)
 	}
-	s.cfg.Logger.Printf("SendAESKey: len %v\n", len(packet))
-	s.cfg.Logger.Printf("SendAESKey: packet %v\n", packet)
-	_, err = conn.Write(packet)
+	s.cfg.Logger.Printf("SendKeyExchange: len %v\n", len(packet))
+	err = cu.frameWriter.WriteFrame(packet)
 	if err != nil {
-		s.cfg.Logger.Printf("failed to send to user %s: %v\n", conn.RemoteAddr().String(), err)
-		return fmt.Errorf("failed to send to user %s: %v", conn.RemoteAddr().String(), err)
+		s.cfg.Logger.Printf("failed to send to user %s: %v\n", cu.conn.RemoteAddr().String(), err)
+		return fmt.Errorf("failed to send to user %s: %v", cu.conn.RemoteAddr().String(), err)
 	}
 	return nil
 }
 
-func (s *Server) AwaitClientAESKey(conn net.Conn, cliPubKey *rsa.PublicKey) ([]byte, error) {
+func (s *Server) AwaitKeyExchange(cu *ConnectedUser, serverEph []byte) ([]byte, error) {
 	for {
-		buf := make([]byte, encoding.MaxPacketSize)
-		nr, err := conn.Read(buf)
+		frame, err := cu.frameReader.ReadFrame()
 		if err != nil {
 			if err.Error() != "EOF" {
 				s.cfg.Logger.Printf("error reading from conn: %v\n", err)
 			}
 			return nil, err
 		}
-		if nr == 0 {
+
+		dataPacket, err := encoding.DecodeHandshakePacket(frame)
+		if err != nil {
+			return nil, err
+		}
+		if dataPacket.MessageType != encoding.KeyExchange {
 			continue
 		}
-		data := buf[0:nr]
 
-		sd := bytes.Split(data, encoding.HeaderPattern[:])
-		if len(sd) == 0 {
-			return nil, fmt.Errorf("incorrect Message length")
+		err = crypto.RSAVerify(crypto.ClientKeyExchangeData(serverEph, dataPacket.EphemeralKey, cu.userInfo.Username), dataPacket.Signature, cu.publicKey)
+		if err != nil {
+			s.cfg.Logger.Printf("error verifying key exchange: %v", err)
+			return nil, fmt.Errorf("cannot connect to server: key exchange signature is not valid")
 		}
-		encPacket := sd[1]
-		packetLen := binary.BigEndian.Uint16(encPacket[4:])
+		s.cfg.Logger.Print("Key exchange received")
+		return dataPacket.EphemeralKey, nil
+	}
+}
+
+// ExchangeSessionKeys runs an ephemeral X25519 exchange with the client. Each
+// side signs its half with its RSA identity key, the derived keys are only
+// held for the lifetime of the connection. The client's signature over the
+// fresh server key and its username is the challenge proving it owns the key
+// registered to that username.
+func (s *Server) ExchangeSessionKeys(cu *ConnectedUser) (crypto.SessionKeys, error) {
+	eph, err := crypto.GenerateX25519Key()
+	if err != nil {
+		return crypto.SessionKeys{}, fmt.Errorf("could not generate ephemeral key: %v", err)
+	}
+	err = s.SendKeyExchange(cu, eph)
+	if err != nil {
+		return crypto.SessionKeys{}, err
+	}
+	serverEph := eph.PublicKey().Bytes()
+	clientEph, err := s.AwaitKeyExchange(cu, serverEph)
+	if err != nil {
+		return crypto.SessionKeys{}, err
+	}
+	return crypto.DeriveSessionKeys(eph, clientEph, serverEph, clientEph)
+}
 
-		payload := encPacket[encoding.HeaderSize : packetLen+encoding.HeaderSize]
-		buffer := bytes.NewBuffer(payload)
-		dataPacket := encoding.DecodeAESPacket(buffer)
+// StartRekey asks the user to run a fresh key exchange over the encrypted
+// channel, see crypto.Session.
+func (s *Server) StartRekey(cu *ConnectedUser) {
+	eph, err := cu.session.StartRekey()
+	if err != nil {
+		s.cfg.Logger.Printf("could not start rekey for user %v: %v", cu.userInfo.Username, err)
+		return
+	}
+	s.cfg.Logger.Printf("Starting rekey for user %v", cu.userInfo.Username)
+	s.sendRekey(cu, encoding.RekeyPayload{Phase: encoding.RekeyRequest, EphemeralKey: eph})
+}
 
-		decPayload, err := crypto.RSADecrypt(dataPacket.Data[:dataPacket.MsgSize], s.cfg.RSAKeyPair.PrivateKey)
+func (s *Server) ActionRekey(cu *ConnectedUser, data []byte) {
+	rekey, err := encoding.DecodeRekey(data)
+	if err != nil {
+		s.cfg.Logger.Printf("error decoding rekey from user %v: %v", cu.userInfo.Username, err)
+		return
+	}
+	s.cfg.Logger.Printf("Rekey message received from user %v (phase %v, %v rekey messages received)", cu.userInfo.Username, rekey.Phase, cu.messageCount(encoding.Rekey))
+
+	switch rekey.Phase {
+	case encoding.RekeyRequest:
+		eph, err := cu.session.RespondToRekey(rekey.EphemeralKey)
 		if err != nil {
-			s.cfg.Logger.Printf("error Decrypting payload: %v", err)
-			return nil, err
+			s.cfg.Logger.Printf("ignoring rekey request from user %v: %v", cu.userInfo.Username, err)
+			return
 		}
-		err = crypto.RSAVerify(decPayload, dataPacket.Sig[:dataPacket.SigSize], cliPubKey)
+		s.sendRekey(cu, encoding.RekeyPayload{Phase: encoding.RekeyResponse, EphemeralKey: eph})
+	case encoding.RekeyResponse:
+		err = cu.session.CompleteRekey(rekey.EphemeralKey)
 		if err != nil {
-			s.cfg.Logger.Printf("error verifying payload: %v", err)
-			return nil, err
+			s.cfg.Logger.Printf("could not complete rekey for user %v: %v", cu.userInfo.Username, err)
+			return
 		}
+		s.sendRekey(cu, encoding.RekeyPayload{Phase: encoding.RekeyDone})
+		s.cfg.Logger.Printf("Rekey complete for user %v", cu.userInfo.Username)
+	case encoding.RekeyDone:
+		s.cfg.Logger.Printf("Rekey complete for user %v", cu.userInfo.Username)
+	}
+}
 
-		if dataPacket.MessageType == encoding.SendAESKey {
-			s.cfg.Logger.Print("AES Key Received complete")
-			return decPayload, nil
-		}
+func (s *Server) sendRekey(cu *ConnectedUser, rekey encoding.RekeyPayload) {
+	data, err := encoding.EncodeRekey(rekey)
+	if err != nil {
+		s.cfg.Logger.Println(err)
+		return
+	}
+	toSend := encoding.PrepPacketsForSending(data, encoding.Rekey, s.cfg.ServerName, "white")
+	err = sendControlMessage(cu, toSend)
+	if err != nil {
+		s.cfg.Logger.Println(err)
 	}
 }
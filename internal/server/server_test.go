@@ -2,12 +2,49 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/big"
 	"net"
+	"runtime"
+	"slices"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/MatthewTully/simple-chat-server/internal/crypto"
+	"github.com/MatthewTully/simple-chat-server/internal/encoding"
+)
+
+var (
+	identityOnce sync.Once
+	identity     crypto.RSAKeys
+	identityErr  error
 )
 
+// testIdentity generates one server key pair for all tests, as generating
+// RSA keys is slow.
+func testIdentity(t *testing.T) crypto.RSAKeys {
+	identityOnce.Do(func() {
+		priv, pub, err := crypto.GenerateRSAKeyPair()
+		identity = crypto.RSAKeys{PrivateKey: priv, PublicKey: pub}
+		identityErr = err
+	})
+	if identityErr != nil {
+		t.Fatalf("could not generate server identity: %v", identityErr)
+	}
+	return identity
+}
+
 func TestAddMessageToHistory(t *testing.T) {
 	cases := []struct {
 		name          string
@@ -39,7 +76,7 @@ func TestAddMessageToHistory(t *testing.T) {
 
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
-			srv, err := NewServer("8144", uint(tc.setLimit), &log.Logger{})
+			srv, err := NewServer("8144", uint(tc.setLimit), testIdentity(t), &log.Logger{})
 			srv.Listener.Close()
 			if err != nil {
 				t.Errorf("error declaring srv for test case %v, error: %v", tc.name, err)
@@ -49,15 +86,23 @@ func TestAddMessageToHistory(t *testing.T) {
 				if i >= (tc.inputCount - tc.setLimit) {
 					tc.expectedMsgs = append(tc.expectedMsgs, msg)
 				}
-				srv.AddMsgToHistory(msg)
+				srv.AddMsgToHistory(encoding.DefaultChannel, encoding.ChatRecord{Type: encoding.RecordMessage, Sender: "alice", Body: msg})
 			}
 
-			if len(srv.MsgHistory) != tc.expectedTotal {
-				t.Errorf("Expected MsgHistory to contain %d elements. Contained %v", tc.expectedTotal, len(srv.MsgHistory))
+			history, err := srv.History.Recent(encoding.DefaultChannel, 0, tc.setLimit)
+			if err != nil {
+				t.Fatalf("could not read history: %v", err)
+			}
+			if len(history) != tc.expectedTotal {
+				t.Errorf("Expected MsgHistory to contain %d elements. Contained %v", tc.expectedTotal, len(history))
 			}
-			for i, msg := range srv.MsgHistory {
-				if string(msg) != string(tc.expectedMsgs[i]) {
-					t.Errorf("Message history does not match. Expected %v at index %d, Got %v", string(tc.expectedMsgs[i]), i, string(msg))
+			for i, data := range history {
+				record, err := encoding.DecodeChatRecord(data)
+				if err != nil {
+					t.Fatalf("could not decode history: %v", err)
+				}
+				if string(record.Body) != string(tc.expectedMsgs[i]) {
+					t.Errorf("Message history does not match. Expected %v at index %d, Got %v", string(tc.expectedMsgs[i]), i, string(record.Body))
 				}
 			}
 		})
@@ -98,7 +143,7 @@ func TestConnectionLimits(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			var buff bytes.Buffer
 			test_logger := log.New(&buff, "", log.Lshortfile|log.LstdFlags)
-			srv, err := NewServer("8142", 10, test_logger)
+			srv, err := NewServer("8142", 10, testIdentity(t), test_logger)
 			srv.MaxConnectionLimit = tc.connectionLimit
 			if err != nil {
 				t.Errorf("error declaring srv for test case %v, error: %v", tc.name, err)
@@ -132,3 +177,1339 @@ func TestConnectionLimits(t *testing.T) {
 		})
 	}
 }
+
+func newTestSessionKeys(t *testing.T) crypto.SessionKeys {
+	c2s, err := crypto.GenerateAESSecretKey()
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	s2c, err := crypto.GenerateAESSecretKey()
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	return crypto.SessionKeys{ClientToServer: c2s, ServerToClient: s2c}
+}
+
+type testClient struct {
+	reader  *encoding.FrameReader
+	writer  *encoding.FrameWriter
+	session *crypto.Session
+}
+
+// addTestUsers adds users connected over in-memory pipes, and returns the
+// client end of each.
+func addTestUsers(t *testing.T, srv *Server, usernames []string) map[string]*testClient {
+	clients := map[string]*testClient{}
+	for _, username := range usernames {
+		srvConn, cliConn := net.Pipe()
+		t.Cleanup(func() {
+			srvConn.Close()
+			cliConn.Close()
+		})
+		keys := newTestSessionKeys(t)
+		clients[username] = &testClient{
+			reader:  encoding.NewFrameReader(cliConn),
+			session: crypto.NewSession(keys, false),
+		}
+		user := newConnectedUser(srvConn)
+		user.userInfo = UserInfo{Username: username}
+		user.publicKey = testIdentity(t).PublicKey
+		user.session = crypto.NewSession(keys, true)
+		err := srv.AddToLiveConns(username, user)
+		if err != nil {
+			t.Fatalf("could not add user %v: %v", username, err)
+		}
+	}
+	return clients
+}
+
+func readTestMessage(t *testing.T, client *testClient) encoding.MsgProtocol {
+	frame, err := client.reader.ReadFrame()
+	if err != nil {
+		t.Fatalf("Unexpected error reading frame: %v", err)
+	}
+	decrypted, err := client.session.Decrypt(frame)
+	if err != nil {
+		t.Fatalf("Unexpected error decrypting frame: %v", err)
+	}
+	msg, err := encoding.DecodeMsgPacket(decrypted)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding frame: %v", err)
+	}
+	return msg
+}
+
+func TestMessagesEncryptedPerRecipient(t *testing.T) {
+	var buff bytes.Buffer
+	test_logger := log.New(&buff, "", log.Lshortfile|log.LstdFlags)
+	srv, err := NewServer("8146", 10, testIdentity(t), test_logger)
+	if err != nil {
+		t.Fatalf("error declaring srv: %v", err)
+	}
+	srv.Listener.Close()
+	srv.MaxConnectionLimit = 10
+
+	usernames := []string{"alice", "bob", "carol"}
+	clients := addTestUsers(t, &srv, usernames)
+
+	t.Run("whisper only readable by recipient", func(t *testing.T) {
+		go srv.SentMessageToClient("bob", []byte("secret for bob"))
+		frame, err := clients["bob"].reader.ReadFrame()
+		if err != nil {
+			t.Fatalf("Unexpected error reading frame: %v", err)
+		}
+
+		for _, username := range usernames {
+			_, err := clients[username].session.Decrypt(frame)
+			if username == "bob" && err != nil {
+				t.Errorf("Expected bob to decrypt whisper, Got %v", err)
+			}
+			if username != "bob" && err == nil {
+				t.Errorf("Expected %v not to be able to decrypt bob's whisper", username)
+			}
+		}
+	})
+
+	t.Run("broadcast encrypted for each recipient", func(t *testing.T) {
+		packets := encoding.PrepPacketsForSending([]byte("hello room"), encoding.Message, "alice", "red")
+		go srv.BroadcastMessage("alice", packets)
+
+		// The server writes to each user in turn over unbuffered pipes, so
+		// the frames must be read at the same time.
+		frames := map[string][]byte{}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, username := range []string{"bob", "carol"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				frame, err := clients[username].reader.ReadFrame()
+				if err != nil {
+					t.Errorf("Unexpected error reading frame: %v", err)
+					return
+				}
+				mu.Lock()
+				frames[username] = frame
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		for recipient, frame := range frames {
+			for _, username := range usernames {
+				decrypted, err := clients[username].session.Decrypt(frame)
+				if username == recipient {
+					if err != nil {
+						t.Errorf("Expected %v to decrypt their frame, Got %v", recipient, err)
+						continue
+					}
+					msg, err := encoding.DecodeMsgPacket(decrypted)
+					if err != nil || string(msg.Data) != "hello room" {
+						t.Errorf("Expected hello room, Got %v (err %v)", string(msg.Data), err)
+					}
+				} else if err == nil {
+					t.Errorf("Expected %v not to be able to decrypt frame sent to %v", username, recipient)
+				}
+			}
+		}
+	})
+}
+
+func TestUserRegistry(t *testing.T) {
+	registryPath := t.TempDir() + "/user_keys.json"
+	registry, err := LoadUserRegistry(registryPath)
+	if err != nil {
+		t.Fatalf("Unexpected error loading registry: %v", err)
+	}
+
+	err = registry.Claim("alice", "SHA256:alice")
+	if err != nil {
+		t.Fatalf("Unexpected error claiming new username: %v", err)
+	}
+	err = registry.Claim("alice", "SHA256:alice")
+	if err != nil {
+		t.Errorf("Expected alice to reclaim the username, Got %v", err)
+	}
+	err = registry.Check("alice", "SHA256:mallory")
+	if !errors.Is(err, ErrUsernameRegistered) {
+		t.Errorf("Expected %v, Got %v", ErrUsernameRegistered, err)
+	}
+	err = registry.Claim("alice", "SHA256:mallory")
+	if !errors.Is(err, ErrUsernameRegistered) {
+		t.Errorf("Expected %v, Got %v", ErrUsernameRegistered, err)
+	}
+	err = registry.Check("bob", "SHA256:mallory")
+	if err != nil {
+		t.Errorf("Expected unregistered username to be available, Got %v", err)
+	}
+
+	reloaded, err := LoadUserRegistry(registryPath)
+	if err != nil {
+		t.Fatalf("Unexpected error reloading registry: %v", err)
+	}
+	err = reloaded.Check("alice", "SHA256:mallory")
+	if !errors.Is(err, ErrUsernameRegistered) {
+		t.Errorf("Expected registration to persist, Got %v", err)
+	}
+}
+
+func TestRelayWhisper(t *testing.T) {
+	var buff bytes.Buffer
+	test_logger := log.New(&buff, "", log.Lshortfile|log.LstdFlags)
+	srv, err := NewServer("8147", 10, testIdentity(t), test_logger)
+	if err != nil {
+		t.Fatalf("error declaring srv: %v", err)
+	}
+	srv.Listener.Close()
+	srv.MaxConnectionLimit = 10
+	clients := addTestUsers(t, &srv, []string{"alice", "bob"})
+
+	t.Run("sealed whisper relayed unchanged", func(t *testing.T) {
+		sealed := []byte("sealed for bob")
+		data, err := encoding.EncodeWhisper(encoding.WhisperPayload{To: "bob", From: "mallory", Sealed: sealed})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		go srv.RelayWhisper("alice", data)
+
+		msg := readTestMessage(t, clients["bob"])
+		if msg.MessageType != encoding.WhisperMessage {
+			t.Errorf("Expected message type %v, Got %v", encoding.WhisperMessage, msg.MessageType)
+		}
+		whisper, err := encoding.DecodeWhisper(msg.Data)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if whisper.From != "alice" {
+			t.Errorf("Expected whisper from the authenticated sender alice, Got %v", whisper.From)
+		}
+		if !bytes.Equal(whisper.Sealed, sealed) {
+			t.Errorf("Expected sealed whisper to be relayed unchanged")
+		}
+	})
+
+	t.Run("unknown recipient", func(t *testing.T) {
+		data, err := encoding.EncodeWhisper(encoding.WhisperPayload{To: "carol", Sealed: []byte("x")})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		go srv.RelayWhisper("alice", data)
+
+		msg := readTestMessage(t, clients["alice"])
+		if msg.MessageType != encoding.ErrorMessage {
+			t.Errorf("Expected message type %v, Got %v", encoding.ErrorMessage, msg.MessageType)
+		}
+	})
+}
+
+// testCertificate generates a self-signed certificate for 127.0.0.1.
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate certificate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "simple-chat-server test"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// handshakeTestClient runs the client side of the handshake over conn and
+// returns the server's handshake response.
+func handshakeTestClient(t *testing.T, conn net.Conn, username string, capabilities encoding.Capability) (*testClient, encoding.HandshakeProtocol) {
+	fr := encoding.NewFrameReader(conn)
+	fw := encoding.NewFrameWriter(conn)
+	clientKey := testIdentity(t)
+	pubKeyBytes, err := crypto.RSAPublicKeyToBytes(clientKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	hs, err := encoding.PrepHandshakeForSending(encoding.HandshakeProtocol{
+		MessageType:  encoding.RequestConnect,
+		MinVersion:   encoding.MinProtocolVersion,
+		MaxVersion:   encoding.MaxProtocolVersion,
+		Capabilities: capabilities,
+		Username:     username,
+		UserColour:   "red",
+		PublicKey:    pubKeyBytes,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err = fw.WriteFrame(hs)
+	if err != nil {
+		t.Fatalf("Unexpected error sending handshake: %v", err)
+	}
+
+	frame, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatalf("Unexpected error reading handshake response: %v", err)
+	}
+	res, err := encoding.DecodeHandshakePacket(frame)
+	if err != nil || res.MessageType == encoding.ErrorMessage {
+		t.Fatalf("Expected handshake response, Got %+v (%v)", res, err)
+	}
+	frame, err = fr.ReadFrame()
+	if err != nil {
+		t.Fatalf("Unexpected error reading key exchange: %v", err)
+	}
+	kx, err := encoding.DecodeHandshakePacket(frame)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	eph, err := crypto.GenerateX25519Key()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	clientEph := eph.PublicKey().Bytes()
+	sig, err := crypto.RSASign(crypto.ClientKeyExchangeData(kx.EphemeralKey, clientEph, username), clientKey.PrivateKey)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out, err := encoding.PrepHandshakeForSending(encoding.HandshakeProtocol{
+		MessageType:  encoding.KeyExchange,
+		EphemeralKey: clientEph,
+		Signature:    sig,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err = fw.WriteFrame(out)
+	if err != nil {
+		t.Fatalf("Unexpected error sending key exchange: %v", err)
+	}
+
+	client := &testClient{reader: fr, writer: fw}
+	if res.Capabilities.Has(encoding.CapTLSOnly) {
+		client.session = crypto.NewPlaintextSession()
+	} else {
+		keys, err := crypto.DeriveSessionKeys(eph, kx.EphemeralKey, kx.EphemeralKey, clientEph)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		client.session = crypto.NewSession(keys, false)
+	}
+	return client, res
+}
+
+func TestTLSTransport(t *testing.T) {
+	var buff bytes.Buffer
+	test_logger := log.New(&buff, "", log.Lshortfile|log.LstdFlags)
+	srv, err := NewServer("8148", 10, testIdentity(t), test_logger)
+	if err != nil {
+		t.Fatalf("error declaring srv: %v", err)
+	}
+	srv.MaxConnectionLimit = 5
+	srv.TLSOnly = true
+	cert := testCertificate(t)
+	srv.EnableTLS(cert)
+	t.Cleanup(func() { srv.Listener.Close() })
+	go srv.StartListening()
+
+	pin := crypto.CertificateFingerprint(cert.Certificate[0])
+	cases := []struct {
+		name         string
+		username     string
+		capabilities encoding.Capability
+		expectTLS    bool
+	}{
+		{
+			name:         "app encryption kept",
+			username:     "alice",
+			capabilities: encoding.SupportedCapabilities &^ encoding.CapTLSOnly,
+			expectTLS:    false,
+		}, {
+			name:         "tls only",
+			username:     "bob",
+			capabilities: encoding.SupportedCapabilities,
+			expectTLS:    true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tlsCfg, err := crypto.ClientTLSConfig("", pin)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			conn, err := tls.Dial("tcp", "127.0.0.1:8148", tlsCfg)
+			if err != nil {
+				t.Fatalf("Unexpected error dialing: %v", err)
+			}
+			defer conn.Close()
+
+			client, res := handshakeTestClient(t, conn, tc.username, tc.capabilities)
+			if res.Capabilities.Has(encoding.CapTLSOnly) != tc.expectTLS {
+				t.Errorf("Expected tls-only %v, Got capabilities %v", tc.expectTLS, res.Capabilities)
+			}
+			msg := readTestMessage(t, client)
+			if msg.MessageType != encoding.ServerActiveUsers {
+				t.Errorf("Expected %v, Got %v", encoding.ServerActiveUsers, msg.MessageType)
+			}
+		})
+	}
+
+	t.Run("wrong pin", func(t *testing.T) {
+		tlsCfg, err := crypto.ClientTLSConfig("", crypto.CertificateFingerprint(testCertificate(t).Certificate[0]))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		conn, err := tls.Dial("tcp", "127.0.0.1:8148", tlsCfg)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("Expected dial to fail with a different certificate pinned")
+		}
+	})
+}
+
+func TestServerPassword(t *testing.T) {
+	var buff bytes.Buffer
+	test_logger := log.New(&buff, "", log.Lshortfile|log.LstdFlags)
+	srv, err := NewServer("8149", 10, testIdentity(t), test_logger)
+	if err != nil {
+		t.Fatalf("error declaring srv: %v", err)
+	}
+	srv.MaxConnectionLimit = 5
+	srv.Password = "correct horse"
+	invite, err := srv.Invites.Issue(1, time.Hour, time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { srv.Listener.Close() })
+	go srv.StartListening()
+
+	cases := []struct {
+		name        string
+		username    string
+		auth        encoding.AuthPayload
+		expectedMsg encoding.MessageType
+	}{
+		{
+			name:        "correct password",
+			username:    "alice",
+			auth:        encoding.AuthPayload{Password: "correct horse"},
+			expectedMsg: encoding.Authenticate,
+		}, {
+			name:        "invite",
+			username:    "carol",
+			auth:        encoding.AuthPayload{Invite: invite.Token},
+			expectedMsg: encoding.Authenticate,
+		}, {
+			name:        "wrong password",
+			username:    "bob",
+			auth:        encoding.AuthPayload{Password: "battery staple"},
+			expectedMsg: encoding.ErrorMessage,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", "127.0.0.1:8149")
+			if err != nil {
+				t.Fatalf("Unexpected error dialing: %v", err)
+			}
+			defer conn.Close()
+
+			client, res := handshakeTestClient(t, conn, tc.username, encoding.SupportedCapabilities)
+			if !res.PasswordRequired {
+				t.Fatalf("Expected server to require a password")
+			}
+			data, err := encoding.EncodeAuth(tc.auth)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			err = client.writer.WriteSealedFrames(client.session.Encrypt, encoding.PrepPacketsForSending(data, encoding.Authenticate, tc.username, "red")...)
+			if err != nil {
+				t.Fatalf("Unexpected error sending password: %v", err)
+			}
+			msg := readTestMessage(t, client)
+			if msg.MessageType != tc.expectedMsg {
+				t.Fatalf("Expected %v, Got %v (%s)", tc.expectedMsg, msg.MessageType, msg.Data)
+			}
+			if tc.expectedMsg == encoding.ErrorMessage && !bytes.Contains(msg.Data, []byte(ErrWrongPassword.Error())) {
+				t.Errorf("Expected error to give the reason, Got %s", msg.Data)
+			}
+		})
+	}
+}
+
+func TestInviteReleasedOnRefusedJoin(t *testing.T) {
+	var buff bytes.Buffer
+	test_logger := log.New(&buff, "", log.Lshortfile|log.LstdFlags)
+	srv, err := NewServer("8157", 10, testIdentity(t), test_logger)
+	if err != nil {
+		t.Fatalf("error declaring srv: %v", err)
+	}
+	srv.MaxConnectionLimit = 5
+	srv.Password = "correct horse"
+	invite, err := srv.Invites.Issue(1, time.Hour, time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { srv.Listener.Close() })
+	go srv.StartListening()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8157")
+	if err != nil {
+		t.Fatalf("Unexpected error dialing: %v", err)
+	}
+	defer conn.Close()
+	client, _ := handshakeTestClient(t, conn, "carol", encoding.SupportedCapabilities)
+	// Another key claims the username while carol is authenticating.
+	err = srv.UserKeys.Claim("carol", "SHA256:someone-else")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := encoding.EncodeAuth(encoding.AuthPayload{Invite: invite.Token})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err = client.writer.WriteSealedFrames(client.session.Encrypt, encoding.PrepPacketsForSending(data, encoding.Authenticate, "carol", "red")...)
+	if err != nil {
+		t.Fatalf("Unexpected error sending invite: %v", err)
+	}
+	var msg encoding.MsgProtocol
+	for msg.MessageType != encoding.ErrorMessage {
+		msg = readTestMessage(t, client)
+	}
+
+	err = srv.Invites.Redeem(invite.Token, "dave", time.Now())
+	if err != nil {
+		t.Errorf("Expected the invite to still be usable after carol was refused, Got %v", err)
+	}
+}
+
+func TestAuthLimiter(t *testing.T) {
+	limiter := NewAuthLimiter(3, time.Minute)
+	now := time.Now()
+	for range 3 {
+		if !limiter.Allowed("10.0.0.1", now) {
+			t.Fatalf("Expected attempts to be allowed before the limit")
+		}
+		limiter.Fail("10.0.0.1", now)
+	}
+	if limiter.Allowed("10.0.0.1", now) {
+		t.Errorf("Expected IP to be locked out after %d failures", limiter.MaxFailures)
+	}
+	if !limiter.Allowed("10.0.0.2", now) {
+		t.Errorf("Expected other IPs to be allowed")
+	}
+	if !limiter.Allowed("10.0.0.1", now.Add(time.Minute)) {
+		t.Errorf("Expected IP to be allowed once the lockout has passed")
+	}
+
+	limiter.Fail("10.0.0.2", now)
+	limiter.Succeed("10.0.0.2")
+	limiter.Fail("10.0.0.2", now)
+	limiter.Fail("10.0.0.2", now)
+	if !limiter.Allowed("10.0.0.2", now) {
+		t.Errorf("Expected a successful login to clear earlier failures")
+	}
+
+	// IPv6 clients are limited by their own address, not as one group.
+	for _, port := range []string{"5000", "5001", "5002"} {
+		addr, err := net.ResolveTCPAddr("tcp", "[::1]:"+port)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		limiter.Fail(remoteHost(addr), now)
+	}
+	addr, _ := net.ResolveTCPAddr("tcp", "[::1]:5003")
+	if limiter.Allowed(remoteHost(addr), now) {
+		t.Errorf("Expected [::1] to be locked out after %d failures from different ports", limiter.MaxFailures)
+	}
+	addr, _ = net.ResolveTCPAddr("tcp", "[2001:db8::2]:5000")
+	if !limiter.Allowed(remoteHost(addr), now) {
+		t.Errorf("Expected other IPv6 clients to be allowed while [::1] is locked out")
+	}
+}
+
+func TestInviteStore(t *testing.T) {
+	store := NewInviteStore()
+	now := time.Now()
+	twoUse, err := store.Issue(2, time.Hour, now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expiring, err := store.Issue(1, time.Minute, now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	revoked, err := store.Issue(1, time.Hour, now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = store.Issue(0, time.Hour, now)
+	if err == nil {
+		t.Errorf("Expected error issuing an invite with no uses")
+	}
+
+	for _, username := range []string{"alice", "bob"} {
+		err = store.Redeem(twoUse.Token, username, now)
+		if err != nil {
+			t.Fatalf("Unexpected error redeeming invite: %v", err)
+		}
+	}
+	err = store.Redeem(twoUse.Token, "carol", now)
+	if !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("Expected %v once the invite is used up, Got %v", ErrInvalidInvite, err)
+	}
+	err = store.Redeem(expiring.Token, "carol", now.Add(time.Minute))
+	if !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("Expected %v once the invite has expired, Got %v", ErrInvalidInvite, err)
+	}
+	if !store.Revoke(revoked.Token) {
+		t.Errorf("Expected invite to be revoked")
+	}
+	err = store.Redeem(revoked.Token, "carol", now)
+	if !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("Expected %v for a revoked invite, Got %v", ErrInvalidInvite, err)
+	}
+
+	invites := store.List()
+	if len(invites) != 2 {
+		t.Fatalf("Expected used and expired invites to be kept, Got %v", invites)
+	}
+	listed := map[string]Invite{}
+	for _, invite := range invites {
+		listed[invite.Token] = invite
+	}
+	expected := map[string]string{twoUse.Token: "used up", expiring.Token: "expired"}
+	for token, status := range expected {
+		if got := listed[token].Status(now.Add(time.Minute)); got != status {
+			t.Errorf("Expected %v to be %v, Got %v", token, status, got)
+		}
+	}
+	if !slices.Equal(listed[twoUse.Token].JoinedBy, []string{"alice", "bob"}) {
+		t.Errorf("Expected %v to have been joined by alice and bob, Got %v", twoUse.Token, listed[twoUse.Token].JoinedBy)
+	}
+	if status := listed[expiring.Token].Status(now); status != "active" {
+		t.Errorf("Expected %v to be active before it expires, Got %v", expiring.Token, status)
+	}
+}
+
+// receiveTestMessages reads every message sent to the client in the
+// background, as the server blocks writing to a pipe until it is read.
+func receiveTestMessages(t *testing.T, client *testClient) <-chan encoding.MsgProtocol {
+	msgs := make(chan encoding.MsgProtocol, 100)
+	go func() {
+		for {
+			frame, err := client.reader.ReadFrame()
+			if err != nil {
+				return
+			}
+			decrypted, err := client.session.Decrypt(frame)
+			if err != nil {
+				t.Errorf("Unexpected error decrypting frame: %v", err)
+				return
+			}
+			msg, err := encoding.DecodeMsgPacket(decrypted)
+			if err != nil {
+				t.Errorf("Unexpected error decoding frame: %v", err)
+				return
+			}
+			msgs <- msg
+		}
+	}()
+	return msgs
+}
+
+// awaitTestMessage skips messages until one of the given type arrives.
+func awaitTestMessage(t *testing.T, msgs <-chan encoding.MsgProtocol, messageType encoding.MessageType) encoding.MsgProtocol {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case msg := <-msgs:
+			if msg.MessageType == messageType {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %v", messageType)
+		}
+	}
+}
+
+func TestChannels(t *testing.T) {
+	var buff bytes.Buffer
+	test_logger := log.New(&buff, "", log.Lshortfile|log.LstdFlags)
+	srv, err := NewServer("8145", 10, testIdentity(t), test_logger)
+	if err != nil {
+		t.Fatalf("error declaring srv: %v", err)
+	}
+	srv.Listener.Close()
+	srv.MaxConnectionLimit = 10
+
+	clients := addTestUsers(t, &srv, []string{"alice", "bob", "carol"})
+	msgs := map[string]<-chan encoding.MsgProtocol{}
+	for username, client := range clients {
+		msgs[username] = receiveTestMessages(t, client)
+	}
+
+	err = srv.JoinChannel("alice", "#random")
+	if err != nil {
+		t.Fatalf("Unexpected error joining channel: %v", err)
+	}
+	err = srv.JoinChannel("bob", "#random")
+	if err != nil {
+		t.Fatalf("Unexpected error joining channel: %v", err)
+	}
+	for _, username := range []string{"alice", "bob"} {
+		var members encoding.MsgProtocol
+		for members.Channel != "#random" || !bytes.Contains(members.Data, []byte("bob")) {
+			members = awaitTestMessage(t, msgs[username], encoding.ChannelMembers)
+		}
+	}
+	err = srv.JoinChannel("bob", "#random")
+	if err == nil {
+		t.Errorf("Expected error joining a channel twice")
+	}
+
+	t.Run("messages only reach members", func(t *testing.T) {
+		srv.ActionMessageType(encoding.MsgProtocol{MessageType: encoding.Message, Username: "alice", Channel: "#random"}, []byte("hello #random"))
+		var record encoding.ChatRecord
+		var msg encoding.MsgProtocol
+		for record.Type != encoding.RecordMessage {
+			msg = awaitTestMessage(t, msgs["bob"], encoding.ChatMessage)
+			record, err = encoding.DecodeChatRecord(msg.Data)
+			if err != nil {
+				t.Fatalf("could not decode chat record: %v", err)
+			}
+		}
+		if msg.Channel != "#random" {
+			t.Errorf("Expected message for #random, Got %q", msg.Channel)
+		}
+		if record.Sender != "alice" || string(record.Body) != "hello #random" {
+			t.Errorf("Expected hello #random from alice, Got %q from %v", record.Body, record.Sender)
+		}
+
+		srv.ActionMessageType(encoding.MsgProtocol{MessageType: encoding.Message, Username: "carol", Channel: "#random"}, []byte("let me in"))
+		awaitTestMessage(t, msgs["carol"], encoding.ErrorMessage)
+		select {
+		case msg := <-msgs["carol"]:
+			t.Errorf("Expected carol to get no channel messages, Got %v %q", msg.MessageType, msg.Data)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		history, _ := srv.History.Recent("#random", 0, int(srv.MaxMsgHistorySize))
+		if len(history) == 0 || !bytes.Contains(history[len(history)-1], []byte("hello #random")) {
+			t.Errorf("Expected message in #random history")
+		}
+		history, _ = srv.History.Recent(encoding.DefaultChannel, 0, int(srv.MaxMsgHistorySize))
+		if len(history) != 0 {
+			t.Errorf("Expected %v history to be empty", encoding.DefaultChannel)
+		}
+	})
+
+	t.Run("history sent on join", func(t *testing.T) {
+		err := srv.JoinChannel("carol", "#random")
+		if err != nil {
+			t.Fatalf("Unexpected error joining channel: %v", err)
+		}
+		msg := awaitTestMessage(t, msgs["carol"], encoding.HistoryPage)
+		page, err := encoding.DecodeHistoryPage(msg.Data)
+		if err != nil {
+			t.Fatalf("could not decode history: %v", err)
+		}
+		last := page.Records[len(page.Records)-1]
+		if msg.Channel != "#random" || last.Type != encoding.RecordMessage || last.Sender != "alice" || string(last.Body) != "hello #random" {
+			t.Errorf("Expected #random history to end with alice's message, Got %v %+v", msg.Channel, last)
+		}
+		if page.More {
+			t.Errorf("Expected no more history")
+		}
+
+		req, _ := encoding.EncodeHistoryRequest(encoding.HistoryRequestPayload{Before: last.ID, Limit: 1})
+		srv.ActionMessageType(encoding.MsgProtocol{MessageType: encoding.HistoryRequest, Username: "carol", Channel: "#random"}, req)
+		msg = awaitTestMessage(t, msgs["carol"], encoding.HistoryPage)
+		older, err := encoding.DecodeHistoryPage(msg.Data)
+		if err != nil {
+			t.Fatalf("could not decode history: %v", err)
+		}
+		if older.Before != last.ID || len(older.Records) != 1 || older.Records[0].ID != page.Records[len(page.Records)-2].ID || !older.More {
+			t.Errorf("Expected the record before alice's message with more to come, Got %+v", older)
+		}
+	})
+
+	t.Run("empty channels are removed", func(t *testing.T) {
+		for _, username := range []string{"alice", "bob", "carol"} {
+			err := srv.LeaveChannel(username, "#random")
+			if err != nil {
+				t.Fatalf("Unexpected error leaving channel: %v", err)
+			}
+		}
+		for _, ch := range srv.ListChannels() {
+			if ch.Name == "#random" {
+				t.Errorf("Expected #random to be removed once empty")
+			}
+		}
+		history, _ := srv.History.Recent("#random", 0, int(srv.MaxMsgHistorySize))
+		if len(history) != 0 {
+			t.Errorf("Expected #random history to be dropped with it, Got %d messages", len(history))
+		}
+		err := srv.LeaveChannel("alice", "#random")
+		if err == nil {
+			t.Errorf("Expected error leaving a channel the user is not in")
+		}
+	})
+
+	t.Run("channel limits", func(t *testing.T) {
+		srv.MaxUserChannels = 3
+		srv.MaxChannels = 3
+		for _, channel := range []string{"#a", "#b"} {
+			err := srv.JoinChannel("alice", channel)
+			if err != nil {
+				t.Fatalf("Unexpected error joining channel: %v", err)
+			}
+		}
+		err := srv.JoinChannel("alice", "#c")
+		if err == nil {
+			t.Errorf("Expected alice to be refused a fourth channel")
+		}
+		err = srv.JoinChannel("bob", "#a")
+		if err != nil {
+			t.Errorf("Expected bob to join an existing channel at the server limit, Got %v", err)
+		}
+		err = srv.JoinChannel("bob", "#d")
+		if err == nil {
+			t.Errorf("Expected a new channel to be refused at the server limit")
+		}
+		if channels := srv.ListChannels(); len(channels) != 3 {
+			t.Errorf("Expected refused joins not to create channels, Got %v", channels)
+		}
+	})
+}
+
+func TestAdminCommands(t *testing.T) {
+	var buff bytes.Buffer
+	test_logger := log.New(&buff, "", log.Lshortfile|log.LstdFlags)
+	srv, err := NewServer("8153", 10, testIdentity(t), test_logger)
+	if err != nil {
+		t.Fatalf("error declaring srv: %v", err)
+	}
+	srv.Listener.Close()
+	srv.MaxConnectionLimit = 10
+	srv.Admins = []string{"alice"}
+
+	clients := addTestUsers(t, &srv, []string{"alice", "bob"})
+	msgs := map[string]<-chan encoding.MsgProtocol{}
+	for username, client := range clients {
+		msgs[username] = receiveTestMessages(t, client)
+	}
+	adminCommand := func(username, command string, args ...string) {
+		data, err := encoding.EncodeAdminCommand(encoding.AdminCommandPayload{Command: command, Args: args})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		srv.ActionMessageType(encoding.MsgProtocol{MessageType: encoding.AdminCommand, Username: username}, data)
+	}
+
+	t.Run("non admins are refused", func(t *testing.T) {
+		adminCommand("bob", "invite")
+		awaitTestMessage(t, msgs["bob"], encoding.ErrorMessage)
+		if len(srv.Invites.List()) != 0 {
+			t.Errorf("Expected no invite to be created")
+		}
+	})
+
+	t.Run("invites require a password", func(t *testing.T) {
+		adminCommand("alice", "invite")
+		msg := awaitTestMessage(t, msgs["alice"], encoding.ErrorMessage)
+		if !bytes.Contains(msg.Data, []byte("password")) {
+			t.Errorf("Expected the error to say a password is needed, Got %s", msg.Data)
+		}
+		if len(srv.Invites.List()) != 0 {
+			t.Errorf("Expected no invite to be created without a password")
+		}
+	})
+
+	t.Run("admins can create and revoke invites", func(t *testing.T) {
+		srv.Password = "correct horse"
+		adminCommand("alice", "invite", "2", "1h")
+		awaitTestMessage(t, msgs["alice"], encoding.Message)
+		invites := srv.Invites.List()
+		if len(invites) != 1 || invites[0].MaxUses != 2 {
+			t.Fatalf("Expected one invite with 2 uses, Got %v", invites)
+		}
+
+		adminCommand("alice", "revoke", invites[0].Token)
+		awaitTestMessage(t, msgs["alice"], encoding.Message)
+		if len(srv.Invites.List()) != 0 {
+			t.Errorf("Expected invite to be revoked")
+		}
+	})
+
+	t.Run("used invites are listed with their status", func(t *testing.T) {
+		invite, err := srv.Invites.Issue(1, time.Hour, time.Now())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		srv.Invites.Redeem(invite.Token, "carol", time.Now())
+		adminCommand("alice", "invites")
+		msg := awaitTestMessage(t, msgs["alice"], encoding.Message)
+		expected := fmt.Sprintf("%v - used up, used 1/1", invite.Token)
+		if !bytes.Contains(msg.Data, []byte(expected)) || !bytes.Contains(msg.Data, []byte("joined by carol")) {
+			t.Errorf("Expected %q joined by carol to be listed, Got %s", expected, msg.Data)
+		}
+		srv.Invites.Revoke(invite.Token)
+	})
+
+	t.Run("queue stats are listed", func(t *testing.T) {
+		adminCommand("alice", "queues")
+		msg := awaitTestMessage(t, msgs["alice"], encoding.Message)
+		if !bytes.Contains(msg.Data, []byte("bob - 0 queued")) {
+			t.Errorf("Expected bob's queue to be listed, Got %s", msg.Data)
+		}
+	})
+
+	t.Run("invalid arguments are reported", func(t *testing.T) {
+		adminCommand("alice", "invite", "many")
+		awaitTestMessage(t, msgs["alice"], encoding.ErrorMessage)
+		adminCommand("alice", "kick", "carol")
+		awaitTestMessage(t, msgs["alice"], encoding.ErrorMessage)
+	})
+
+	t.Run("host is an admin", func(t *testing.T) {
+		if srv.IsAdmin("bob") {
+			t.Fatalf("Expected bob not to be an admin")
+		}
+		srv.SetHostUser("bob")
+		if !srv.IsAdmin("bob") || !srv.IsAdmin("alice") {
+			t.Errorf("Expected both the host and configured admins to be admins")
+		}
+	})
+
+	t.Run("bans are checked while handshakes run", func(t *testing.T) {
+		addTestUsers(t, &srv, []string{"carol"})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for range 100 {
+				srv.isBanned("pipe")
+			}
+		}()
+		adminCommand("alice", "ban", "carol")
+		<-done
+		if !srv.isBanned("pipe") {
+			t.Errorf("Expected carol's address to be banned")
+		}
+		if _, exists := srv.IsActiveUser("carol"); exists {
+			t.Errorf("Expected carol to be disconnected")
+		}
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	var buff bytes.Buffer
+	test_logger := log.New(&buff, "", log.Lshortfile|log.LstdFlags)
+	srv, err := NewServer("8143", 10, testIdentity(t), test_logger)
+	if err != nil {
+		t.Fatalf("error declaring srv: %v", err)
+	}
+	srv.MaxConnectionLimit = 5
+	srv.ShutdownNotice = 200 * time.Millisecond
+	historyDir := t.TempDir()
+	srv.History, err = OpenFileHistory(historyDir, FileHistoryOptions{})
+	if err != nil {
+		t.Fatalf("could not open history: %v", err)
+	}
+	go srv.StartListening()
+
+	msgs := map[string]<-chan encoding.MsgProtocol{}
+	for _, username := range []string{"alice", "bob"} {
+		conn, err := net.Dial("tcp", "127.0.0.1:8143")
+		if err != nil {
+			t.Fatalf("Unexpected error dialing: %v", err)
+		}
+		defer conn.Close()
+		client, _ := handshakeTestClient(t, conn, username, encoding.SupportedCapabilities)
+		msgs[username] = receiveTestMessages(t, client)
+		awaitTestMessage(t, msgs[username], encoding.ChatMessage)
+	}
+
+	// A handler that is still finishing a message once users are
+	// disconnected.
+	release := make(chan struct{})
+	srv.connWG.Add(1)
+	go func() {
+		defer srv.connWG.Done()
+		<-release
+		srv.AddMsgToHistory(encoding.DefaultChannel, srv.noticeRecord("sent during shutdown"))
+	}()
+	time.AfterFunc(srv.ShutdownNotice+100*time.Millisecond, func() { close(release) })
+
+	start := time.Now()
+	err = srv.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error shutting down: %v", err)
+	}
+	if time.Since(start) < srv.ShutdownNotice {
+		t.Errorf("Expected users to be given %v notice", srv.ShutdownNotice)
+	}
+
+	for username, userMsgs := range msgs {
+		msg := awaitTestMessage(t, userMsgs, encoding.Message)
+		if !bytes.Contains(msg.Data, []byte("shutting down")) {
+			t.Errorf("Expected %v to be warned of the shutdown, Got %s", username, msg.Data)
+		}
+		awaitTestMessage(t, userMsgs, encoding.RequestDisconnect)
+	}
+	if len(srv.GetAllActiveUsers()) != 0 {
+		t.Errorf("Expected all users to be disconnected")
+	}
+	_, err = net.Dial("tcp", "127.0.0.1:8143")
+	if err == nil {
+		t.Errorf("Expected new connections to be refused")
+	}
+	err = srv.History.Append(encoding.DefaultChannel, 1, []byte("too late"))
+	if err == nil {
+		t.Errorf("Expected history to be closed")
+	}
+	history, err := OpenFileHistory(historyDir, FileHistoryOptions{})
+	if err != nil {
+		t.Fatalf("could not reopen history: %v", err)
+	}
+	defer history.Close()
+	recent, _ := history.Recent(encoding.DefaultChannel, 0, 100)
+	if len(recent) == 0 || !bytes.Contains(recent[len(recent)-1], []byte("sent during shutdown")) {
+		t.Errorf("Expected a message handled during shutdown to be kept in the history")
+	}
+	if !errors.Is(srv.Shutdown(context.Background()), ErrServerShuttingDown) {
+		t.Errorf("Expected a second shutdown to fail")
+	}
+}
+
+// awaitGoroutines waits for the number of goroutines to drop back to at most
+// expected, and fails the test if it doesn't.
+func awaitGoroutines(t *testing.T, expected int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > expected {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("Expected at most %d goroutines, Got %d\n%s", expected, runtime.NumGoroutine(), buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectionGoroutinesExit(t *testing.T) {
+	var buff bytes.Buffer
+	test_logger := log.New(&buff, "", log.Lshortfile|log.LstdFlags)
+	srv, err := NewServer("8154", 10, testIdentity(t), test_logger)
+	if err != nil {
+		t.Fatalf("error declaring srv: %v", err)
+	}
+	srv.MaxConnectionLimit = 5
+	t.Cleanup(func() { srv.Listener.Close() })
+	go srv.StartListening()
+	time.Sleep(10 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+
+	for i := range 20 {
+		conn, err := net.Dial("tcp", "127.0.0.1:8154")
+		if err != nil {
+			t.Fatalf("Unexpected error dialing: %v", err)
+		}
+		client, _ := handshakeTestClient(t, conn, "alice", encoding.SupportedCapabilities)
+		msgs := receiveTestMessages(t, client)
+		awaitTestMessage(t, msgs, encoding.ChatMessage)
+
+		// Alternate between the client asking to disconnect and the
+		// connection dropping.
+		if i%2 == 0 {
+			err = client.writer.WriteSealedFrames(client.session.Encrypt, encoding.PrepPacketsForSending([]byte{}, encoding.RequestDisconnect, "alice", "red")...)
+			if err != nil {
+				t.Fatalf("Unexpected error requesting disconnect: %v", err)
+			}
+			awaitTestMessage(t, msgs, encoding.RequestDisconnect)
+		}
+		conn.Close()
+		awaitGoroutines(t, baseline)
+	}
+
+	srv.rwmu.RLock()
+	defer srv.rwmu.RUnlock()
+	if len(srv.LiveConns) != 0 {
+		t.Errorf("Expected no live connections, Got %d", len(srv.LiveConns))
+	}
+}
+
+func TestOutOfOrderFrameClosesConnection(t *testing.T) {
+	var buff bytes.Buffer
+	test_logger := log.New(&buff, "", log.Lshortfile|log.LstdFlags)
+	srv, err := NewServer("8158", 10, testIdentity(t), test_logger)
+	if err != nil {
+		t.Fatalf("error declaring srv: %v", err)
+	}
+	t.Cleanup(func() { srv.Listener.Close() })
+	srv.MaxConnectionLimit = 5
+	go srv.StartListening()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8158")
+	if err != nil {
+		t.Fatalf("Unexpected error dialing: %v", err)
+	}
+	defer conn.Close()
+	client, _ := handshakeTestClient(t, conn, "alice", encoding.SupportedCapabilities)
+	msgs := receiveTestMessages(t, client)
+	awaitTestMessage(t, msgs, encoding.ChatMessage)
+
+	// Skip a sequence number, as if a frame was dropped on the way.
+	packet := encoding.PrepPacketsForSending(nil, encoding.KeepAlive, "alice", "red")[0]
+	_, err = client.session.Encrypt(packet)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	frame, err := client.session.Encrypt(packet)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err = client.writer.WriteFrame(frame)
+	if err != nil {
+		t.Fatalf("Unexpected error sending frame: %v", err)
+	}
+
+	awaitTestMessage(t, msgs, encoding.RequestDisconnect)
+	if _, exists := srv.IsActiveUser("alice"); exists {
+		t.Errorf("Expected alice to be disconnected after a frame out of sequence")
+	}
+}
+
+func TestPendingHandshakes(t *testing.T) {
+	pending := NewPendingHandshakes(3, 2)
+	for range 2 {
+		if err := pending.Start("10.0.0.1"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := pending.Start("10.0.0.1"); !errors.Is(err, ErrTooManyPendingFromAddr) {
+		t.Errorf("Expected %v, Got %v", ErrTooManyPendingFromAddr, err)
+	}
+	if err := pending.Start("10.0.0.2"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := pending.Start("10.0.0.3"); !errors.Is(err, ErrTooManyPending) {
+		t.Errorf("Expected %v, Got %v", ErrTooManyPending, err)
+	}
+	pending.Done("10.0.0.1")
+	if err := pending.Start("10.0.0.1"); err != nil {
+		t.Errorf("Expected a finished handshake to free its place, Got %v", err)
+	}
+}
+
+func TestRemoteHost(t *testing.T) {
+	cases := []struct {
+		name     string
+		addr     net.Addr
+		expected string
+	}{
+		{
+			name:     "IPv4",
+			addr:     &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8144},
+			expected: "10.0.0.1",
+		}, {
+			name:     "IPv6",
+			addr:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8144},
+			expected: "2001:db8::1",
+		}, {
+			name:     "IPv6 loopback",
+			addr:     &net.TCPAddr{IP: net.IPv6loopback, Port: 8144},
+			expected: "::1",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			host := remoteHost(tc.addr)
+			if host != tc.expected {
+				t.Errorf("Expected %v, Got %v", tc.expected, host)
+			}
+		})
+	}
+}
+
+func TestSlowHandshake(t *testing.T) {
+	var buff bytes.Buffer
+	test_logger := log.New(&buff, "", log.Lshortfile|log.LstdFlags)
+	srv, err := NewServer("8155", 10, testIdentity(t), test_logger)
+	if err != nil {
+		t.Fatalf("error declaring srv: %v", err)
+	}
+	srv.MaxConnectionLimit = 5
+	srv.HandshakeTimeout = 500 * time.Millisecond
+	srv.Handshakes = NewPendingHandshakes(DefaultMaxPendingHandshakes, 2)
+	t.Cleanup(func() { srv.Listener.Close() })
+	go srv.StartListening()
+
+	stalled, err := net.Dial("tcp", "127.0.0.1:8155")
+	if err != nil {
+		t.Fatalf("Unexpected error dialing: %v", err)
+	}
+	defer stalled.Close()
+	start := time.Now()
+
+	t.Run("others join while a handshake is stalled", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "127.0.0.1:8155")
+		if err != nil {
+			t.Fatalf("Unexpected error dialing: %v", err)
+		}
+		defer conn.Close()
+		client, _ := handshakeTestClient(t, conn, "alice", encoding.SupportedCapabilities)
+		readTestMessage(t, client)
+		if time.Since(start) >= srv.HandshakeTimeout {
+			t.Errorf("Expected to join before the stalled handshake timed out")
+		}
+	})
+
+	t.Run("pending handshakes are limited per IP", func(t *testing.T) {
+		second, err := net.Dial("tcp", "127.0.0.1:8155")
+		if err != nil {
+			t.Fatalf("Unexpected error dialing: %v", err)
+		}
+		defer second.Close()
+		// Wait for the server to accept the second connection.
+		time.Sleep(50 * time.Millisecond)
+
+		third, err := net.Dial("tcp", "127.0.0.1:8155")
+		if err != nil {
+			t.Fatalf("Unexpected error dialing: %v", err)
+		}
+		defer third.Close()
+		third.SetReadDeadline(time.Now().Add(srv.HandshakeTimeout / 2))
+		_, err = third.Read(make([]byte, 1))
+		if !errors.Is(err, io.EOF) {
+			t.Errorf("Expected connection over the limit to be closed, Got %v", err)
+		}
+	})
+
+	t.Run("stalled handshake times out", func(t *testing.T) {
+		stalled.SetReadDeadline(time.Now().Add(2 * srv.HandshakeTimeout))
+		frame, err := encoding.NewFrameReader(stalled).ReadFrame()
+		if err != nil {
+			t.Fatalf("Expected to be told the handshake timed out, Got %v", err)
+		}
+		res, err := encoding.DecodeHandshakePacket(frame)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if res.MessageType != encoding.ErrorMessage || res.Error != ErrHandshakeTimedOut.Error() {
+			t.Errorf("Expected %q, Got %v %q", ErrHandshakeTimedOut, res.MessageType, res.Error)
+		}
+	})
+}
+
+func TestOutboundQueue(t *testing.T) {
+	message := func(body string, control bool) outboundMessage {
+		return outboundMessage{packets: [][]byte{[]byte(body)}, control: control}
+	}
+
+	t.Run("drop oldest keeps control messages", func(t *testing.T) {
+		q := newOutboundQueue(3, DropOldest)
+		q.push(message("rekey", true))
+		q.push(message("one", false))
+		q.push(message("two", false))
+		err := q.push(message("three", false))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		stats := q.stats()
+		if stats.Depth != 3 || stats.MaxDepth != 3 || stats.Dropped != 1 {
+			t.Errorf("Expected depth 3, max depth 3 and 1 dropped, Got %+v", stats)
+		}
+		q.close()
+		expected := []string{"rekey", "two", "three"}
+		for _, body := range expected {
+			msg, err := q.pop()
+			if err != nil || string(msg.packets[0]) != body {
+				t.Errorf("Expected %q, Got %q (%v)", body, msg.packets, err)
+			}
+		}
+		if _, err := q.pop(); !errors.Is(err, errQueueClosed) {
+			t.Errorf("Expected %v once drained, Got %v", errQueueClosed, err)
+		}
+	})
+
+	t.Run("overflow disconnects", func(t *testing.T) {
+		q := newOutboundQueue(2, DisconnectSlowConsumer)
+		q.push(message("one", false))
+		q.push(message("two", false))
+		err := q.push(message("three", false))
+		if !errors.Is(err, ErrSlowConsumer) {
+			t.Fatalf("Expected %v, Got %v", ErrSlowConsumer, err)
+		}
+		if _, err := q.pop(); !errors.Is(err, ErrSlowConsumer) {
+			t.Errorf("Expected writer to be told of the overflow, Got %v", err)
+		}
+		if err := q.push(message("four", false)); !errors.Is(err, errQueueClosed) {
+			t.Errorf("Expected queue to be closed, Got %v", err)
+		}
+	})
+
+	for input, expected := range map[string]OverflowPolicy{"": DropOldest, "drop-oldest": DropOldest, "Disconnect": DisconnectSlowConsumer} {
+		policy, err := ParseOverflowPolicy(input)
+		if err != nil || policy != expected {
+			t.Errorf("Expected %q to parse as %v, Got %v (%v)", input, expected, policy, err)
+		}
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	var buff bytes.Buffer
+	test_logger := log.New(&buff, "", log.Lshortfile|log.LstdFlags)
+	srv, err := NewServer("8156", 10, testIdentity(t), test_logger)
+	if err != nil {
+		t.Fatalf("error declaring srv: %v", err)
+	}
+	srv.Listener.Close()
+	srv.MaxConnectionLimit = 10
+	srv.OutboundQueueSize = 4
+	srv.OverflowPolicy = DisconnectSlowConsumer
+
+	clients := addTestUsers(t, &srv, []string{"alice", "bob"})
+	aliceMsgs := receiveTestMessages(t, clients["alice"])
+
+	// Bob reads nothing until every message has been sent, so his queue
+	// fills while alice reads each one as it arrives.
+	done := make(chan struct{})
+	go func() {
+		for i := range 10 {
+			srv.BroadcastMessage(srv.cfg.ServerName, encoding.PrepPacketsForSending([]byte(fmt.Sprintf("message %d", i)), encoding.Message, srv.cfg.ServerName, "white"))
+			for msg := range aliceMsgs {
+				if msg.MessageType == encoding.Message {
+					break
+				}
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected broadcasts not to wait for a slow user")
+	}
+
+	bobMsgs := receiveTestMessages(t, clients["bob"])
+	msg := awaitTestMessage(t, bobMsgs, encoding.ErrorMessage)
+	if string(msg.Data) != ErrSlowConsumer.Error() {
+		t.Errorf("Expected bob to be told why he was disconnected, Got %s", msg.Data)
+	}
+	awaitTestMessage(t, bobMsgs, encoding.RequestDisconnect)
+	if _, ok := srv.IsActiveUser("bob"); ok {
+		t.Errorf("Expected bob to be disconnected")
+	}
+	if _, ok := srv.IsActiveUser("alice"); !ok {
+		t.Errorf("Expected alice to stay connected")
+	}
+}
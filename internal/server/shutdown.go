@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/MatthewTully/simple-chat-server/internal/encoding"
+)
+
+// DefaultShutdownNotice is how long users are warned before the server shuts
+// down.
+const DefaultShutdownNotice = 5 * time.Second
+
+var ErrServerShuttingDown = errors.New("server is shutting down")
+
+func (s *Server) isShuttingDown() bool {
+	s.rwmu.RLock()
+	defer s.rwmu.RUnlock()
+	return s.shuttingDown
+}
+
+// Shutdown stops accepting connections and warns connected users, then
+// disconnects them once ShutdownNotice has passed, or ctx is done if that is
+// sooner. It waits for every connection's goroutines to return, or until ctx
+// is done, then flushes the history.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.rwmu.Lock()
+	if s.shuttingDown {
+		s.rwmu.Unlock()
+		return ErrServerShuttingDown
+	}
+	s.shuttingDown = true
+	s.rwmu.Unlock()
+
+	s.cfg.Logger.Println("Server is shutting down")
+	err := s.Listener.Close()
+	if err != nil {
+		s.cfg.Logger.Printf("could not close listener: %v", err)
+	}
+
+	notice := s.ShutdownNotice
+	if deadline, ok := ctx.Deadline(); ok {
+		notice = min(notice, time.Until(deadline))
+	}
+	if notice > 0 && len(s.GetAllActiveUsers()) > 0 {
+		seconds := int(math.Ceil(notice.Seconds()))
+		toSend := encoding.PrepPacketsForSending([]byte(fmt.Sprintf("Server shutting down in %d seconds.\n", seconds)), encoding.Message, s.cfg.ServerName, "white")
+		s.BroadcastMessage(s.cfg.ServerName, toSend)
+		select {
+		case <-time.After(notice):
+		case <-ctx.Done():
+		}
+	}
+
+	s.rwmu.RLock()
+	users := make([]*ConnectedUser, 0, len(s.LiveConns))
+	for _, user := range s.LiveConns {
+		users = append(users, user)
+	}
+	s.rwmu.RUnlock()
+	for _, user := range users {
+		s.CloseConnection(user)
+	}
+
+	// Handlers still finishing a message may add it to the history, so it
+	// is only closed once they have returned.
+	done := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		close(done)
+	}()
+	var waitErr error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		waitErr = fmt.Errorf("connections did not close: %w", ctx.Err())
+	}
+
+	err = s.History.Close()
+	if err != nil {
+		s.cfg.Logger.Printf("could not close history: %v", err)
+	}
+	if waitErr != nil {
+		return waitErr
+	}
+	s.cfg.Logger.Println("Server shut down")
+	return err
+}
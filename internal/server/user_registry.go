@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var ErrUsernameRegistered = errors.New("username is registered to a different key")
+
+// UserRegistry ties each username to the fingerprint of the key that first
+// connected with it, so only the holder of that key can use it again. If path
+// is set the registry is saved there as JSON whenever a username is added.
+type UserRegistry struct {
+	path string
+	keys map[string]string
+	mu   sync.Mutex
+}
+
+func NewUserRegistry() *UserRegistry {
+	return &UserRegistry{
+		keys: make(map[string]string),
+	}
+}
+
+func LoadUserRegistry(filePath string) (*UserRegistry, error) {
+	r := NewUserRegistry()
+	r.path = filePath
+
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read user registry: %v", err)
+	}
+	err = json.Unmarshal(data, &r.keys)
+	if err != nil {
+		return nil, fmt.Errorf("could not read user registry: %v", err)
+	}
+	return r, nil
+}
+
+// Check returns ErrUsernameRegistered if the username belongs to another key.
+func (r *UserRegistry) Check(username, fingerprint string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	registered, exists := r.keys[username]
+	if exists && registered != fingerprint {
+		return fmt.Errorf("%w: %v", ErrUsernameRegistered, username)
+	}
+	return nil
+}
+
+// Claim registers the username to the key if it is not already taken. It
+// should only be called once the client has proven it holds the key.
+func (r *UserRegistry) Claim(username, fingerprint string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	registered, exists := r.keys[username]
+	if exists {
+		if registered != fingerprint {
+			return fmt.Errorf("%w: %v", ErrUsernameRegistered, username)
+		}
+		return nil
+	}
+	r.keys[username] = fingerprint
+	return r.save()
+}
+
+func (r *UserRegistry) save() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(r.path, data, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write user registry: %v", err)
+	}
+	return nil
+}
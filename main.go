@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/MatthewTully/simple-chat-server/internal/client"
+	"github.com/MatthewTully/simple-chat-server/internal/crypto"
+	"github.com/MatthewTully/simple-chat-server/internal/encoding"
 	"github.com/MatthewTully/simple-chat-server/internal/server"
 	"github.com/joho/godotenv"
 )
@@ -18,9 +25,19 @@ import (
 var portArg int
 var hostModeArg bool
 var setUsrConfArg bool
+var printFingerprintArg bool
+var tlsCertArg string
+var tlsKeyArg string
+var passwordArg string
+var serveArg bool
+var logFileArg string
 var cliLogger *log.Logger
 var srvLogger *log.Logger
 
+// shutdownTimeout is how long the server waits for connections to close,
+// after warning users it is shutting down.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	godotenv.Load()
 
@@ -29,8 +46,33 @@ func main() {
 	flag.BoolVar(&hostModeArg, "host", false, "Launch application as a server host")
 	flag.BoolVar(&hostModeArg, "h", false, "Launch application as a server host (shorthand)")
 	flag.BoolVar(&setUsrConfArg, "user-config", false, "Ask user to set config on launch")
+	flag.BoolVar(&printFingerprintArg, "print-fingerprint", false, "Print the fingerprint of the server key and exit")
+	flag.StringVar(&tlsCertArg, "tls-cert", "", "Certificate file to serve TLS with when hosting")
+	flag.StringVar(&tlsKeyArg, "tls-key", "", "Private key file for the TLS certificate")
+	flag.StringVar(&passwordArg, "password", "", "Password users must give to join when hosting")
+	flag.BoolVar(&serveArg, "serve", false, "Run only the server, without the chat client")
+	flag.StringVar(&logFileArg, "log-file", "", "File to write server logs to when serving, instead of stdout")
 
 	flag.Parse()
+
+	if printFingerprintArg {
+		identity, err := loadServerIdentity()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fingerprint, err := crypto.RSAPublicKeyFingerprint(identity.PublicKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(fingerprint)
+		return
+	}
+
+	if serveArg {
+		serve()
+		return
+	}
+
 	log_path := os.Getenv("SRV_LOG_OUTPUT")
 	if log_path == "" {
 		log.Fatalf("Could not set log output. Please ensure .env file has been setup.")
@@ -57,11 +99,20 @@ func main() {
 
 	cfg := client.SetupClientConfig(conf_path, setUsrConfArg)
 	cfg.Logger = cliLogger
+	cfg.KnownHostsPath = filepath.Join(filepath.Dir(conf_path), ".simple_server_known_hosts")
+	cfg.KeyPath = filepath.Join(filepath.Dir(conf_path), ".simple_server_user_key.pem")
+	cfg.VerifiedUsersPath = filepath.Join(filepath.Dir(conf_path), ".simple_server_verified_users.json")
+	if os.Getenv("USR_TLS") == "true" {
+		cfg.TLSConfig, err = crypto.ClientTLSConfig(os.Getenv("USR_TLS_CA"), os.Getenv("USR_TLS_PIN"))
+		if err != nil {
+			cliLogger.Fatalln(err)
+		}
+		cfg.TLSOnly = os.Getenv("USR_TLS_ONLY") == "true"
+	}
 	cli := client.NewClient(cfg)
 
+	var srv *server.Server
 	if hostModeArg {
-		var port string
-
 		fileName := fmt.Sprintf("%v_server.log", time.Now().UTC().Format("2006-01-02"))
 		f, err := os.Create(filepath.Join(log_path, fileName))
 
@@ -72,48 +123,229 @@ func main() {
 
 		srvLogger = log.New(f, "Server:", log.Lshortfile|log.LstdFlags|log.Lmsgprefix)
 
-		historySize, err := strconv.ParseUint(os.Getenv("SRV_MSG_HISTORY_SIZE"), 10, 64)
-		if err != nil {
-			srvLogger.Fatalf("could not parse History size to uint: %v", err)
+		var port, certFingerprint string
+		srv, port, certFingerprint = setupServer()
+		if certFingerprint != "" {
+			// The host connects over loopback, so pin its own certificate.
+			cfg.TLSConfig, err = crypto.ClientTLSConfig("", certFingerprint)
+			if err != nil {
+				srvLogger.Fatalln(err)
+			}
+			cfg.TLSOnly = srv.TLSOnly
 		}
 
-		maxConnectionLimit, err := strconv.ParseUint(os.Getenv("SRV_MAX_CONNECTIONS"), 10, 64)
+		go srv.StartListening()
+
+		srv.SetHostUser(cfg.Username)
+		cli.SetAsHost(srv)
+		cli.Connect(fmt.Sprintf("127.0.0.1:%s", port), encoding.AuthPayload{Password: srv.Password})
+	}
+	client.StartTUI(&cli)
+
+	if srv != nil {
+		fmt.Printf("Shutting down server, users have %v to finish up\n", srv.ShutdownNotice)
+		shutdownServer(srv)
+	}
+}
+
+// serve runs the server on its own, without the TUI or a host user, until it
+// is interrupted. Logs go to stdout unless a log file is given.
+func serve() {
+	logOutput := os.Stdout
+	if logFileArg != "" {
+		f, err := os.OpenFile(logFileArg, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
 		if err != nil {
-			srvLogger.Fatalf("could not parse Max connection limit to uint: %v", err)
+			log.Fatalf("Could not open log file: %v", err)
 		}
+		defer f.Close()
+		logOutput = f
+	}
+	srvLogger = log.New(logOutput, "Server:", log.Lshortfile|log.LstdFlags|log.Lmsgprefix)
 
-		if portArg == 0 {
-			port = os.Getenv("SRV_PORT")
-			valid, msg := validatePortString(port)
-			if msg != "" {
-				srvLogger.Println(msg)
-			}
-			if !valid {
-				os.Exit(1)
-			}
-		} else {
-			valid, msg := validatePort(portArg)
-			if msg != "" {
-				srvLogger.Println(msg)
-			}
-			if !valid {
-				os.Exit(1)
-			}
-			port = fmt.Sprintf("%d", portArg)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv, _, _ := setupServer()
+	go srv.StartListening()
+
+	<-ctx.Done()
+	stop()
+	shutdownServer(srv)
+}
+
+// shutdownServer warns users the server is stopping, then disconnects them.
+// It gives up waiting on connections shutdownTimeout after the notice.
+func shutdownServer(srv *server.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), srv.ShutdownNotice+shutdownTimeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		srvLogger.Println(err)
+	}
+}
+
+// setupServer creates the server from the flags and environment, and returns
+// it with the port it listens on. If it serves TLS, it also returns the
+// certificate's fingerprint.
+func setupServer() (*server.Server, string, string) {
+	var port string
+
+	historySize, err := strconv.ParseUint(os.Getenv("SRV_MSG_HISTORY_SIZE"), 10, 64)
+	if err != nil {
+		srvLogger.Fatalf("could not parse History size to uint: %v", err)
+	}
+
+	maxConnectionLimit, err := strconv.ParseUint(os.Getenv("SRV_MAX_CONNECTIONS"), 10, 64)
+	if err != nil {
+		srvLogger.Fatalf("could not parse Max connection limit to uint: %v", err)
+	}
+
+	if portArg == 0 {
+		port = os.Getenv("SRV_PORT")
+		valid, msg := validatePortString(port)
+		if msg != "" {
+			srvLogger.Println(msg)
+		}
+		if !valid {
+			os.Exit(1)
+		}
+	} else {
+		valid, msg := validatePort(portArg)
+		if msg != "" {
+			srvLogger.Println(msg)
 		}
+		if !valid {
+			os.Exit(1)
+		}
+		port = fmt.Sprintf("%d", portArg)
+	}
 
-		srv, err := server.NewServer(port, uint(historySize), srvLogger)
-		srv.MaxConnectionLimit = uint(maxConnectionLimit)
+	identity, err := loadServerIdentity()
+	if err != nil {
+		srvLogger.Fatalln(err)
+	}
+	fingerprint, err := crypto.RSAPublicKeyFingerprint(identity.PublicKey)
+	if err != nil {
+		srvLogger.Fatalln(err)
+	}
+	srvLogger.Printf("Server key fingerprint: %v", fingerprint)
+
+	srv, err := server.NewServer(port, uint(historySize), identity, srvLogger)
+	if err != nil {
+		srvLogger.Fatalln(err)
+	}
+	srv.MaxConnectionLimit = uint(maxConnectionLimit)
+
+	srv.Password = passwordArg
+	if srv.Password == "" {
+		srv.Password = os.Getenv("SRV_PASSWORD")
+	}
+	srv.OverflowPolicy, err = server.ParseOverflowPolicy(os.Getenv("SRV_SLOW_CLIENT_POLICY"))
+	if err != nil {
+		srvLogger.Fatalln(err)
+	}
+	if queueSize := os.Getenv("SRV_OUTBOUND_QUEUE_SIZE"); queueSize != "" {
+		srv.OutboundQueueSize, err = strconv.Atoi(queueSize)
+		if err != nil || srv.OutboundQueueSize <= 0 {
+			srvLogger.Fatalf("could not parse outbound queue size to a positive int: %v", queueSize)
+		}
+	}
+	if maxChannels := os.Getenv("SRV_MAX_CHANNELS"); maxChannels != "" {
+		srv.MaxChannels, err = strconv.Atoi(maxChannels)
+		if err != nil || srv.MaxChannels <= 0 {
+			srvLogger.Fatalf("could not parse max channels to a positive int: %v", maxChannels)
+		}
+	}
+	if maxUserChannels := os.Getenv("SRV_MAX_USER_CHANNELS"); maxUserChannels != "" {
+		srv.MaxUserChannels, err = strconv.Atoi(maxUserChannels)
+		if err != nil || srv.MaxUserChannels <= 0 {
+			srvLogger.Fatalf("could not parse max user channels to a positive int: %v", maxUserChannels)
+		}
+	}
+	if admins := os.Getenv("SRV_ADMINS"); admins != "" {
+		srv.Admins = strings.Split(admins, ",")
+	}
+
+	user_keys_path := os.Getenv("SRV_USER_KEYS_PATH")
+	if user_keys_path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			srvLogger.Fatalf("cannot set default user keys path: %v", err)
+		}
+		user_keys_path = path.Join(home, ".simple_server_user_keys.json")
+	}
+	srv.UserKeys, err = server.LoadUserRegistry(user_keys_path)
+	if err != nil {
+		srvLogger.Fatalln(err)
+	}
+
+	if history_dir := os.Getenv("SRV_HISTORY_DIR"); history_dir != "" {
+		srv.History, err = loadHistoryStore(history_dir)
 		if err != nil {
 			srvLogger.Fatalln(err)
 		}
+	}
 
-		go srv.StartListening()
+	if tlsCertArg == "" {
+		tlsCertArg = os.Getenv("SRV_TLS_CERT")
+	}
+	if tlsKeyArg == "" {
+		tlsKeyArg = os.Getenv("SRV_TLS_KEY")
+	}
+	if tlsCertArg == "" && tlsKeyArg == "" {
+		return &srv, port, ""
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCertArg, tlsKeyArg)
+	if err != nil {
+		srvLogger.Fatalf("could not load TLS certificate: %v", err)
+	}
+	srv.EnableTLS(cert)
+	srv.TLSOnly = os.Getenv("SRV_TLS_ONLY") == "true"
+	certFingerprint := crypto.CertificateFingerprint(cert.Certificate[0])
+	srvLogger.Printf("Serving TLS with certificate fingerprint: %v", certFingerprint)
+	return &srv, port, certFingerprint
+}
 
-		cli.Connect(fmt.Sprintf("127.0.0.1:%s", port))
-		cli.SetAsHost(&srv)
-		srv.SetHostUser(cfg.Username)
+func loadServerIdentity() (crypto.RSAKeys, error) {
+	key_path := os.Getenv("SRV_KEY_PATH")
+	if key_path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return crypto.RSAKeys{}, fmt.Errorf("cannot set default server key path: %v", err)
+		}
+		key_path = path.Join(home, ".simple_server_key.pem")
 	}
-	client.StartTUI(&cli)
+	return crypto.LoadOrGenerateRSAKeyPair(key_path)
+}
 
+// loadHistoryStore opens the file history store in dir, with the sync and
+// retention settings from the environment.
+func loadHistoryStore(dir string) (*server.FileHistory, error) {
+	opts := server.FileHistoryOptions{}
+	var err error
+	opts.Sync, err = server.ParseSyncPolicy(os.Getenv("SRV_HISTORY_SYNC"))
+	if err != nil {
+		return nil, err
+	}
+	if maxAge := os.Getenv("SRV_HISTORY_MAX_AGE"); maxAge != "" {
+		opts.MaxAge, err = time.ParseDuration(maxAge)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse history max age: %v", err)
+		}
+	}
+	if maxBytes := os.Getenv("SRV_HISTORY_MAX_BYTES"); maxBytes != "" {
+		size, err := strconv.ParseUint(maxBytes, 10, 63)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse history max bytes: %v", err)
+		}
+		opts.MaxBytes = int64(size)
+	}
+	if maxRecords := os.Getenv("SRV_HISTORY_MAX_RECORDS"); maxRecords != "" {
+		records, err := strconv.ParseUint(maxRecords, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse history max records: %v", err)
+		}
+		opts.MaxRecords = int(records)
+	}
+	return server.OpenFileHistory(dir, opts)
 }